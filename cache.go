@@ -0,0 +1,347 @@
+package reverseoperator
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+const (
+	// DefaultCacheSize is the number of responses a Cache holds when no other
+	// size is configured.
+	DefaultCacheSize = 4096
+	// DefaultStaleTTL is the TTL given to records in stale responses, as
+	// recommended by RFC 8767.
+	DefaultStaleTTL = 30
+)
+
+// now is locally set to allow its mocking during testing
+var now = time.Now
+
+// CacheOptions is a configuration object for optional Cache configuration
+type CacheOptions struct {
+	// Size is the maximum number of responses held; once reached, the least
+	// recently used response is evicted. If zero, DefaultCacheSize is used.
+	Size int
+	// MaxStale is how long past expiry a response may still be served, when
+	// the upstream is failing, as described by RFC 8767; if zero, expired
+	// responses are never served.
+	MaxStale time.Duration
+	// StaleTTL is the TTL, in seconds, of records in stale responses; it is
+	// also how long the cache waits after a failure before making a client
+	// wait on the upstream again. If zero, DefaultStaleTTL is used.
+	StaleTTL uint32
+}
+
+// NewCache creates a Cache in front of a Resolver
+func NewCache(resolver Resolver, opts *CacheOptions) *Cache {
+	if opts == nil {
+		opts = &CacheOptions{}
+	}
+	size := opts.Size
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	staleTTL := opts.StaleTTL
+	if staleTTL == 0 {
+		staleTTL = DefaultStaleTTL
+	}
+
+	return &Cache{
+		resolver: resolver,
+		size:     size,
+		maxStale: opts.MaxStale,
+		staleTTL: staleTTL,
+		entries:  make(map[questionKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Cache is an in-memory response cache which wraps another Resolver. Served
+// responses have their TTLs decremented by the time they have been held, and
+// negative responses are cached per RFC 2308. If configured, expired
+// responses are served while the upstream is failing, per RFC 8767.
+type Cache struct {
+	resolver Resolver
+	size     int
+	maxStale time.Duration
+	staleTTL uint32
+
+	// refreshes tracks background refreshes of stale entries
+	refreshes sync.WaitGroup
+
+	mutex   sync.Mutex
+	entries map[questionKey]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key     questionKey
+	resp    *Response
+	stored  time.Time
+	expires time.Time
+	// failed is when the upstream last failed to refresh this entry
+	failed     time.Time
+	refreshing bool
+}
+
+// Resolve resolves a question from cache if possible, otherwise from the
+// wrapped Resolver; it implements Resolver.
+func (c *Cache) Resolve(ctx context.Context, q Question) (*Response, error) {
+	key := newQuestionKey(q)
+
+	cached, state := c.get(key)
+	switch state {
+	case cacheFresh:
+		log.Debugf("cache hit for %v[%v]", q.Name, q.Type)
+		return cached, nil
+	case cacheFailing:
+		// the upstream failed recently; rather than make every client wait
+		// on it again, serve stale and try again in the background
+		c.refresh(q, key)
+		log.Debugf("serving stale %v[%v] while upstream is failing", q.Name, q.Type)
+		return cached, nil
+	}
+
+	resp, err := c.resolve(ctx, q, key)
+	// a client which went away hasn't shown the upstream to be failing
+	if ctx.Err() == nil && isResolveFailure(resp, err) && state == cacheStale {
+		log.Warnf("upstream failed for %v[%v], serving stale", q.Name, q.Type)
+		c.setFailed(key, true)
+		return cached, nil
+	}
+
+	return resp, err
+}
+
+// resolve resolves a question from the wrapped Resolver, caching the result.
+func (c *Cache) resolve(ctx context.Context, q Question, key questionKey) (*Response, error) {
+	resp, err := c.resolver.Resolve(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl, ok := cacheTTL(resp); ok {
+		c.set(key, resp, ttl)
+	}
+
+	return resp, nil
+}
+
+// refresh starts a background resolution of a stale entry, unless one is
+// already running.
+func (c *Cache) refresh(q Question, key questionKey) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok || el.Value.(*cacheEntry).refreshing {
+		return
+	}
+	el.Value.(*cacheEntry).refreshing = true
+
+	c.refreshes.Add(1)
+	go func() {
+		defer c.refreshes.Done()
+
+		// the refresh serves no one client, so is bound by none's context
+		resp, err := c.resolve(context.Background(), q, key)
+		c.setFailed(key, isResolveFailure(resp, err))
+	}()
+}
+
+// isResolveFailure reports whether a resolution failed in a way that serving
+// a stale response would be preferable to.
+func isResolveFailure(resp *Response, err error) bool {
+	return err != nil || resp.ResponseCode == dns.RcodeServerFailure
+}
+
+type cacheState int
+
+const (
+	cacheMiss cacheState = iota
+	cacheFresh
+	// cacheStale entries have expired, but may be served if the upstream
+	// fails to provide a fresh response
+	cacheStale
+	// cacheFailing entries are stale, and the upstream recently failed to
+	// refresh them
+	cacheFailing
+)
+
+func (c *Cache) get(key questionKey) (*Response, cacheState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, cacheMiss
+	}
+
+	e := el.Value.(*cacheEntry)
+	t := now()
+	if t.Before(e.expires) {
+		c.lru.MoveToFront(el)
+		return decrementTTLs(e.resp, uint32(t.Sub(e.stored)/time.Second)), cacheFresh
+	}
+
+	if t.Sub(e.expires) >= c.maxStale {
+		c.remove(el)
+		return nil, cacheMiss
+	}
+
+	c.lru.MoveToFront(el)
+	stale := setTTLs(e.resp, c.staleTTL)
+	if t.Sub(e.failed) < time.Duration(c.staleTTL)*time.Second {
+		return stale, cacheFailing
+	}
+	return stale, cacheStale
+}
+
+// setFailed records the outcome of an attempt to refresh a stale entry.
+func (c *Cache) setFailed(key questionKey, failed bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*cacheEntry)
+		e.refreshing = false
+		if failed {
+			e.failed = now()
+		}
+	}
+}
+
+func (c *Cache) set(key questionKey, resp *Response, ttl uint32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t := now()
+	e := &cacheEntry{
+		key:     key,
+		resp:    resp,
+		stored:  t,
+		expires: t.Add(time.Duration(ttl) * time.Second),
+	}
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// cacheTTL determines how long a response may be cached for, if at all.
+// Positive responses live for their smallest TTL; negative ones, for the
+// smaller of the SOA's TTL and minimum field, as RFC 2308 describes.
+func cacheTTL(resp *Response) (uint32, bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+
+	switch resp.ResponseCode {
+	case dns.RcodeSuccess:
+		if len(resp.Answer) > 0 {
+			return minRecordTTL(resp.Answer, resp.Authority)
+		}
+		// NODATA is cached like NXDOMAIN
+		fallthrough
+	case dns.RcodeNameError:
+		return negativeTTL(resp.Authority)
+	}
+
+	return 0, false
+}
+
+func minRecordTTL(sections ...[]secop.DNSRR) (ttl uint32, ok bool) {
+	for _, rrs := range sections {
+		for _, rr := range rrs {
+			if !ok || rr.TTL < ttl {
+				ttl, ok = rr.TTL, true
+			}
+		}
+	}
+	return
+}
+
+func negativeTTL(authority []secop.DNSRR) (uint32, bool) {
+	for _, r := range authority {
+		if r.Type != dns.TypeSOA {
+			continue
+		}
+
+		rr, err := r.DNSRR()
+		if err != nil {
+			continue
+		}
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+
+		if soa.Minttl < soa.Hdr.Ttl {
+			return soa.Minttl, true
+		}
+		return soa.Hdr.Ttl, true
+	}
+
+	// without an SOA, there's no way to know how long the negative answer
+	// is valid for
+	return 0, false
+}
+
+// decrementTTLs copies a response, with the TTL of every record reduced by
+// the given number of seconds.
+func decrementTTLs(resp *Response, elapsed uint32) *Response {
+	return mapTTLs(resp, func(ttl uint32) uint32 {
+		if ttl > elapsed {
+			return ttl - elapsed
+		}
+		return 0
+	})
+}
+
+// setTTLs copies a response, with the TTL of every record set to ttl.
+func setTTLs(resp *Response, ttl uint32) *Response {
+	return mapTTLs(resp, func(uint32) uint32 {
+		return ttl
+	})
+}
+
+func mapTTLs(resp *Response, f func(uint32) uint32) *Response {
+	c := *resp
+	c.Question = append([]secop.DNSQuestion(nil), resp.Question...)
+	c.Answer = mapRecordTTLs(resp.Answer, f)
+	c.Authority = mapRecordTTLs(resp.Authority, f)
+	c.Extra = mapRecordTTLs(resp.Extra, f)
+	return &c
+}
+
+func mapRecordTTLs(rrs []secop.DNSRR, f func(uint32) uint32) []secop.DNSRR {
+	if rrs == nil {
+		return nil
+	}
+
+	c := make([]secop.DNSRR, len(rrs))
+	for i, rr := range rrs {
+		rr.TTL = f(rr.TTL)
+		c[i] = rr
+	}
+	return c
+}
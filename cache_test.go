@@ -0,0 +1,300 @@
+package reverseoperator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+func mockNow(t time.Time) (func(time.Duration), func()) {
+	orig := now
+	now = func() time.Time {
+		return t
+	}
+
+	advance := func(d time.Duration) {
+		t = t.Add(d)
+	}
+	return advance, func() {
+		now = orig
+	}
+}
+
+type funcResolver struct {
+	calls   int
+	resolve func(Question) (*Response, error)
+}
+
+func (f *funcResolver) Resolve(ctx context.Context, q Question) (*Response, error) {
+	f.calls++
+	return f.resolve(q)
+}
+
+func answerResolver(ttl uint32) *funcResolver {
+	return &funcResolver{resolve: func(q Question) (*Response, error) {
+		return &Response{DNSResponse: secop.DNSResponse{
+			Question: []secop.DNSQuestion{q.DNSQuestion},
+			Answer: []secop.DNSRR{
+				secop.DNSRR{Name: dns.Fqdn(q.Name), Type: q.Type, TTL: ttl, Data: "127.0.0.1"}},
+		}}, nil
+	}}
+}
+
+func question(name string, qtype uint16) Question {
+	return Question{DNSQuestion: secop.DNSQuestion{Name: name, Type: qtype}}
+}
+
+func TestCacheDecrementsTTL(t *testing.T) {
+	advance, restore := mockNow(time.Unix(1000, 0))
+	defer restore()
+
+	r := answerResolver(100)
+	c := NewCache(r, nil)
+
+	if _, err := c.Resolve(context.Background(), question("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	advance(30 * time.Second)
+	resp, err := c.Resolve(context.Background(), question("EXAMPLE.com.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.calls != 1 {
+		t.Errorf("expected a cache hit, got %v upstream calls", r.calls)
+	}
+	if ttl := resp.Answer[0].TTL; ttl != 70 {
+		t.Errorf("expected decremented ttl, got %v", ttl)
+	}
+
+	advance(70 * time.Second)
+	if _, err := c.Resolve(context.Background(), question("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if r.calls != 2 {
+		t.Errorf("expected expired entry to be refreshed, got %v upstream calls", r.calls)
+	}
+}
+
+func TestCacheKeysOnFlags(t *testing.T) {
+	r := answerResolver(100)
+	c := NewCache(r, nil)
+
+	q := question("example.com", dns.TypeA)
+	do := q
+	do.DNSSECOK = true
+	cd := q
+	cd.CheckingDisabled = true
+
+	for _, q := range []Question{q, do, cd, question("example.com", dns.TypeAAAA), q, do, cd} {
+		if _, err := c.Resolve(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if r.calls != 4 {
+		t.Errorf("expected 4 upstream calls, got %v", r.calls)
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	advance, restore := mockNow(time.Unix(1000, 0))
+	defer restore()
+
+	r := &funcResolver{resolve: func(q Question) (*Response, error) {
+		return &Response{DNSResponse: secop.DNSResponse{
+			ResponseCode: dns.RcodeNameError,
+			Authority: []secop.DNSRR{secop.DNSRR{
+				Name: "com.", Type: dns.TypeSOA, TTL: 900,
+				Data: "a.gtld-servers.net. nstld.verisign-grs.com. 1 1800 900 604800 60",
+			}},
+		}}, nil
+	}}
+	c := NewCache(r, nil)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Resolve(context.Background(), question("nope.com", dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.calls != 1 {
+		t.Errorf("expected negative answer to be cached, got %v upstream calls", r.calls)
+	}
+
+	// the SOA minimum is lower than its ttl, so should be used
+	advance(60 * time.Second)
+	if _, err := c.Resolve(context.Background(), question("nope.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if r.calls != 2 {
+		t.Errorf("expected negative answer to expire, got %v upstream calls", r.calls)
+	}
+}
+
+func TestCacheSkipsUncacheable(t *testing.T) {
+	responses := []secop.DNSResponse{
+		// servfail
+		secop.DNSResponse{ResponseCode: dns.RcodeServerFailure},
+		// nxdomain without an SOA
+		secop.DNSResponse{ResponseCode: dns.RcodeNameError},
+		// truncated
+		secop.DNSResponse{Truncated: true, Answer: []secop.DNSRR{
+			secop.DNSRR{Name: "example.com.", Type: 1, TTL: 100, Data: "127.0.0.1"}}},
+	}
+
+	for _, dr := range responses {
+		dr := dr
+		r := &funcResolver{resolve: func(q Question) (*Response, error) {
+			return &Response{DNSResponse: dr}, nil
+		}}
+		c := NewCache(r, nil)
+
+		for i := 0; i < 2; i++ {
+			if _, err := c.Resolve(context.Background(), question("example.com", dns.TypeA)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if r.calls != 2 {
+			t.Errorf("expected response not to be cached: %+v", dr)
+		}
+	}
+}
+
+func TestCacheErrors(t *testing.T) {
+	r := &funcResolver{resolve: func(q Question) (*Response, error) {
+		return nil, errors.New("frig")
+	}}
+	c := NewCache(r, nil)
+
+	if _, err := c.Resolve(context.Background(), question("example.com", dns.TypeA)); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestCacheEvictsLRU(t *testing.T) {
+	r := answerResolver(100)
+	c := NewCache(r, &CacheOptions{Size: 2})
+
+	for _, name := range []string{"a.com", "b.com", "a.com", "c.com", "a.com", "b.com"} {
+		if _, err := c.Resolve(context.Background(), question(name, dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a.com is kept as it was recently used, b.com is evicted by c.com
+	if r.calls != 4 {
+		t.Errorf("expected 4 upstream calls, got %v", r.calls)
+	}
+	if l := c.lru.Len(); l != 2 {
+		t.Errorf("expected cache to hold 2 entries, got %v", l)
+	}
+}
+
+func TestCacheServeStale(t *testing.T) {
+	advance, restore := mockNow(time.Unix(1000, 0))
+	defer restore()
+
+	var fail bool
+	good := answerResolver(100)
+	r := &funcResolver{resolve: func(q Question) (*Response, error) {
+		if fail {
+			return nil, errors.New("frig")
+		}
+		return good.resolve(q)
+	}}
+	c := NewCache(r, &CacheOptions{MaxStale: time.Hour})
+
+	if _, err := c.Resolve(context.Background(), question("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	fail = true
+	advance(200 * time.Second)
+	resp, err := c.Resolve(context.Background(), question("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatalf("expected stale response, got error: %v", err)
+	}
+	if ttl := resp.Answer[0].TTL; ttl != DefaultStaleTTL {
+		t.Errorf("unexpected stale ttl %v", ttl)
+	}
+	if r.calls != 2 {
+		t.Errorf("expected upstream to be tried, got %v upstream calls", r.calls)
+	}
+
+	// the upstream just failed, so the next request is served stale without
+	// waiting on it, and it's refreshed in the background instead
+	fail = false
+	if _, err := c.Resolve(context.Background(), question("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	c.refreshes.Wait()
+	if r.calls != 3 {
+		t.Errorf("expected a background refresh, got %v upstream calls", r.calls)
+	}
+
+	resp, err = c.Resolve(context.Background(), question("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := resp.Answer[0].TTL; ttl != 100 {
+		t.Errorf("expected refreshed response, got ttl %v", ttl)
+	}
+	if r.calls != 3 {
+		t.Errorf("expected a cache hit, got %v upstream calls", r.calls)
+	}
+}
+
+func TestCacheServeStaleLimit(t *testing.T) {
+	advance, restore := mockNow(time.Unix(1000, 0))
+	defer restore()
+
+	var fail bool
+	good := answerResolver(100)
+	r := &funcResolver{resolve: func(q Question) (*Response, error) {
+		if fail {
+			return nil, errors.New("frig")
+		}
+		return good.resolve(q)
+	}}
+	c := NewCache(r, &CacheOptions{MaxStale: time.Minute})
+
+	if _, err := c.Resolve(context.Background(), question("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	fail = true
+	advance(200 * time.Second)
+	if _, err := c.Resolve(context.Background(), question("example.com", dns.TypeA)); err == nil {
+		t.Error("expected an error once past the maximum staleness")
+	}
+}
+
+func TestCacheNoServeStale(t *testing.T) {
+	advance, restore := mockNow(time.Unix(1000, 0))
+	defer restore()
+
+	var fail bool
+	good := answerResolver(100)
+	r := &funcResolver{resolve: func(q Question) (*Response, error) {
+		if fail {
+			return nil, errors.New("frig")
+		}
+		return good.resolve(q)
+	}}
+	c := NewCache(r, nil)
+
+	if _, err := c.Resolve(context.Background(), question("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	fail = true
+	advance(100 * time.Second)
+	if _, err := c.Resolve(context.Background(), question("example.com", dns.TypeA)); err == nil {
+		t.Error("expected an error when serving stale is disabled")
+	}
+}
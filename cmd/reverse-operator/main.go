@@ -2,27 +2,46 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
+	"expvar"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 
 	revop "github.com/fardog/reverseoperator"
+	secop "github.com/fardog/secureoperator"
 	"github.com/fardog/secureoperator/cmd"
 )
 
+const (
+	defaultGoogleJSONEndpoint = "https://dns.google.com/resolve"
+	defaultRFC8484Endpoint    = "https://dns.google/dns-query"
+)
+
 var (
 	listenAddress = flag.String(
 		"listen", ":80", "listen address, as `[host]:port`",
 	)
 
+	debugListenAddress = flag.String(
+		"debug-listen",
+		"",
+		`If set, serve counters (such as coalesced upstream queries) at
+        /debug/vars on this address, as [host]:port.`,
+	)
+
 	logLevel = flag.String(
 		"level",
 		"info",
@@ -33,20 +52,236 @@ var (
 		"timeout", 10, "time in seconds to hold shutdown for connected clients",
 	)
 
+	providerName = flag.String(
+		"provider",
+		"dns",
+		`Upstream to resolve queries with, one of: dns, to query the DNS
+        servers directly; google-json, to query a Google DNS-over-HTTPS
+        compatible JSON API; rfc8484, to query an RFC 8484 DNS-over-HTTPS
+        service; iterative, to resolve queries from the root servers down,
+        without another recursive server.`,
+	)
+	providerEndpoint = flag.String(
+		"provider-endpoint",
+		"",
+		`DNS-over-HTTPS endpoint of the google-json and rfc8484 providers; by
+        default, "https://dns.google.com/resolve" and
+        "https://dns.google/dns-query" respectively.`,
+	)
+	providerBootstrap = flag.String(
+		"provider-bootstrap",
+		"",
+		`Comma separated IPs to connect to for the provider endpoint, so its
+        host needn't be looked up; for google-json, if not set, the host is
+        looked up with the DNS servers.`,
+	)
+	rootHints = flag.String(
+		"root-hints",
+		"",
+		`File of root server addresses for the iterative provider, in the format
+        of IANA's named.root; by default, a built in copy is used.`,
+	)
+	iterativeIPv6 = flag.Bool(
+		"iterative-ipv6",
+		false,
+		"Allow the iterative provider to query nameservers over IPv6, rather than IPv4 only",
+	)
+	providerPad = flag.Bool(
+		"provider-pad",
+		true,
+		"Pad queries to the google-json and rfc8484 providers, so their length doesn't reveal the name queried",
+	)
+
+	forwardFile = flag.String(
+		"forward-file",
+		"",
+		`File of conditional forwarding routes, one per line as "zone
+        server[,server...]", where a zone may also be a network such as
+        10.0.0.0/8 to route its reverse zones. Questions within a zone are sent
+        to its servers, using the longest matching zone, and all others to the
+        provider.`,
+	)
+
+	zoneReload = flag.Int(
+		"zone-reload",
+		int(revop.DefaultZoneReloadInterval/time.Second),
+		`Time in seconds between checks of zone files for changes, which are
+        reloaded when changed; 0 disables reloading.`,
+	)
+	hostsTTL = flag.Int(
+		"hosts-ttl",
+		revop.DefaultHostsTTL,
+		"TTL in seconds of records answered from hosts files",
+	)
+	hostsReload = flag.Int(
+		"hosts-reload",
+		int(revop.DefaultHostsReloadInterval/time.Second),
+		`Time in seconds between checks of hosts files for changes, which are
+        reloaded when changed; 0 disables reloading.`,
+	)
+	blockResponse = flag.String(
+		"block-response",
+		"nxdomain",
+		`How questions for blocked names are answered: nxdomain, refused,
+        null for 0.0.0.0 and ::, or a comma separated list of addresses to
+        answer A and AAAA questions with.`,
+	)
+	blockTTL = flag.Int(
+		"block-ttl",
+		revop.DefaultBlockTTL,
+		"TTL in seconds of records answered for blocked names",
+	)
+	blocklistReload = flag.Int(
+		"blocklist-reload",
+		int(revop.DefaultFilterReloadInterval/time.Second),
+		`Time in seconds between checks of blocklists for changes, which are
+        reloaded when changed; 0 disables reloading.`,
+	)
+	rpzReload = flag.Int(
+		"rpz-reload",
+		int(revop.DefaultRPZReloadInterval/time.Second),
+		`Time in seconds between checks of response policy zone files for
+        changes, which are reloaded when changed; 0 disables reloading.`,
+	)
+
+	dns64 = flag.Bool(
+		"dns64",
+		false,
+		`Synthesize AAAA records from A records for names without any, and PTR
+        answers for the addresses synthesized, for IPv6-only clients behind a
+        NAT64 gateway.`,
+	)
+	dns64Prefix = flag.String(
+		"dns64-prefix",
+		revop.DefaultDNS64Prefix,
+		"NAT64 prefix AAAA records are synthesized in, of length 32, 40, 48, 56, 64 or 96",
+	)
+	dns64Exclude = flag.String(
+		"dns64-exclude",
+		"",
+		`Comma separated networks which are never mapped: A records of IPv4
+        addresses in them aren't synthesized, and AAAA records of IPv6
+        addresses in them are ignored.`,
+	)
+
 	dnsServers = flag.String(
 		"dns-servers",
 		"8.8.8.8,8.8.4.4",
-		`DNS Servers used to look up the endpoint; Comma separated, e.g.
+		`DNS Servers queried by the dns provider, or used by the google-json
+        provider to look up its endpoint; Comma separated, e.g.
         "8.8.8.8,8.8.4.4:53". The port section is optional, and 53 will be used
         by default.`,
 	)
 
+	dnsTCP = flag.Bool(
+		"dns-tcp",
+		false,
+		`Query the DNS servers over TCP only; by default, UDP is used, and the
+        query is retried over TCP if the response was truncated.`,
+	)
+
+	dnsTLS = flag.Bool(
+		"dns-tls",
+		false,
+		`Query the DNS servers over DNS-over-TLS; each server may be given as
+        "ip[:port]#servername" to verify its certificate against a name rather
+        than its IP, and the port defaults to 853.`,
+	)
+	dnsTLSCA = flag.String(
+		"dns-tls-ca",
+		"",
+		"PEM file of CA certificates to verify DNS-over-TLS servers with, instead of the system roots",
+	)
+	dnsTLSPins = flag.String(
+		"dns-tls-pins",
+		"",
+		`Comma separated base64 SHA-256 digests of public keys, one of which
+        must be present in each DNS-over-TLS server's certificate chain.`,
+	)
+
+	dnsStrategy = flag.String(
+		"dns-strategy",
+		revop.StrategyRandom.String(),
+		`How a DNS server is chosen for each query, one of: random;
+        round-robin; priority, preferring servers in the order given; weighted,
+        by the weights in dns-weights; fastest, by average response time.`,
+	)
+	dnsWeights = flag.String(
+		"dns-weights",
+		"",
+		`Comma separated weights of DNS servers for the weighted strategy, e.g.
+        "10.0.0.1=5,8.8.8.8:53=1", where the port defaults as it does in
+        dns-servers; servers without a weight have a weight of 1.`,
+	)
+	dnsRace = flag.Int(
+		"dns-race",
+		0,
+		`Number of DNS servers each query is sent to at once, using the first
+        useful response; SERVFAIL and REFUSED responses never win while another
+        server may answer. 0 or 1 sends each query to one server at a time.`,
+	)
+	dnsHedgeDelay = flag.Int(
+		"dns-hedge-delay",
+		0,
+		`Time in milliseconds after which a query is also sent to another DNS
+        server, if no useful response has arrived; 0 disables hedging.`,
+	)
+	dnsTimeout = flag.Int(
+		"dns-timeout",
+		int(revop.DefaultTimeout/time.Millisecond),
+		"time in milliseconds a DNS server is given to respond before the query is retried",
+	)
+	dnsDeadline = flag.Int(
+		"dns-deadline",
+		int(revop.DefaultDeadline/time.Millisecond),
+		`Time in milliseconds a query may take in all, across retries, before
+        it fails; queries also stop when the HTTP client goes away.`,
+	)
+	dnsRetries = flag.Int(
+		"dns-retries",
+		revop.DefaultRetries,
+		`Number of other DNS servers a query is retried on when a server fails
+        to answer, or answers SERVFAIL or REFUSED; 0 disables retries.`,
+	)
+	dnsMaxFailures = flag.Int(
+		"dns-max-failures",
+		revop.DefaultMaxFailures,
+		`Number of consecutive failed queries after which a DNS server is
+        ejected, and not queried again until its backoff has passed.`,
+	)
+	dnsProbeInterval = flag.Int(
+		"dns-probe-interval",
+		0,
+		`Time in seconds between health probes of each DNS server, which find
+        failing servers and return recovered ones; 0 disables probes.`,
+	)
+	dnsProbeName = flag.String(
+		"dns-probe-name",
+		revop.DefaultProbeName,
+		"name whose NS records are queried by health probes",
+	)
+	dnssec = flag.Bool(
+		"dnssec",
+		false,
+		`Validate responses from the DNS servers with DNSSEC, rather than
+        trusting their AD bit; bogus responses are answered with SERVFAIL
+        unless the client sets the CD bit. Zones in the forward file aren't
+        validated.`,
+	)
+	dnssecTrustAnchor = flag.String(
+		"dnssec-trust-anchor",
+		"",
+		`File of DS or DNSKEY records which anchor DNSSEC validation, in master
+        file format; by default, the root zone's published keys are used.`,
+	)
+
 	useJSONContentType = flag.Bool(
 		"json-content-type",
 		false,
 		`Google's services use content-type header "application/x-javascript", 
         however setting this flag overrides to "application/json", which is
-        more standard, but differs from Google.`,
+        more standard, but differs from Google. Clients may still ask for a
+        particular type with the ct parameter or accept header.`,
 	)
 	serverHeader = flag.String(
 		"server-header",
@@ -54,8 +289,173 @@ var (
 		`Value to send in the Server header; if set to an empty string, no
         header will be sent.`,
 	)
+	ecsFromClient = flag.Bool(
+		"ecs-from-client",
+		false,
+		`Send the address of the HTTP client upstream as an EDNS client subnet,
+        truncated to the prefix lengths below, when the request doesn't specify
+        one itself.`,
+	)
+	ecsPrefixV4 = flag.Int(
+		"ecs-prefix-v4",
+		revop.DefaultClientSubnetPrefixV4,
+		"prefix length IPv4 client addresses are truncated to for ecs-from-client; 0 sends none of the address",
+	)
+	ecsPrefixV6 = flag.Int(
+		"ecs-prefix-v6",
+		revop.DefaultClientSubnetPrefixV6,
+		"prefix length IPv6 client addresses are truncated to for ecs-from-client; 0 sends none of the address",
+	)
+	paddingBlockSize = flag.Int(
+		"padding-block-size",
+		revop.DefaultPaddingBlockSize,
+		`Pad responses to a multiple of this many bytes, to hide the length of
+        the name queried; 0 disables padding. Responses are only padded when
+        the request was: RFC 8484 queries with an EDNS padding option, and
+        JSON requests with a random_padding parameter.`,
+	)
+	cacheSize = flag.Int(
+		"cache-size",
+		0,
+		`Number of responses to hold in an in-memory cache, evicting the least
+        recently used once full; 0 disables caching.`,
+	)
+	cacheMaxStale = flag.Int(
+		"cache-max-stale",
+		0,
+		`Time in seconds past expiry that cached responses may still be served
+        while the upstream DNS servers are failing; 0 disables serving stale.`,
+	)
+	cacheStaleTTL = flag.Int(
+		"cache-stale-ttl",
+		revop.DefaultStaleTTL,
+		"TTL in seconds of records in stale responses",
+	)
+	maxBodySize = flag.Int64(
+		"max-body-size",
+		revop.DefaultMaxBodySize,
+		"maximum size in bytes of an RFC 8484 POST request body",
+	)
 )
 
+// parseTLSServers parses a comma separated list of DNS-over-TLS servers, in
+// the form "ip[:port][#servername]"
+func parseTLSServers(csv, pins string) (secop.Endpoints, *revop.DNSTLSOptions, error) {
+	var eps secop.Endpoints
+	opts := &revop.DNSTLSOptions{Servers: make(map[string]revop.DNSTLSServer)}
+
+	var spki []string
+	for _, p := range strings.Split(pins, ",") {
+		if p != "" {
+			spki = append(spki, p)
+		}
+	}
+
+	for _, r := range strings.Split(csv, ",") {
+		if r == "" {
+			continue
+		}
+
+		parts := strings.SplitN(r, "#", 2)
+		ep, err := secop.ParseEndpoint(parts[0], revop.DefaultDNSTLSPort)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		server := revop.DNSTLSServer{SPKIPins: spki}
+		if len(parts) > 1 {
+			server.ServerName = parts[1]
+		}
+
+		eps = append(eps, ep)
+		opts.Servers[ep.String()] = server
+	}
+
+	return eps, opts, nil
+}
+
+// hasEndpoint returns whether the endpoint in `ip:port` form is among eps.
+func hasEndpoint(eps secop.Endpoints, address string) bool {
+	for _, ep := range eps {
+		if ep.String() == address {
+			return true
+		}
+	}
+	return false
+}
+
+// parseWeights parses a comma separated list of server weights, in the form
+// "ip[:port]=weight", where the port defaults as it does for the servers
+func parseWeights(csv string, defaultPort uint16) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, r := range strings.Split(csv, ",") {
+		if r == "" {
+			continue
+		}
+
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("weight must be given as ip[:port]=weight, got %v", r)
+		}
+		ep, err := secop.ParseEndpoint(parts[0], defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		w, err := strconv.Atoi(parts[1])
+		if err != nil || w < 1 {
+			return nil, fmt.Errorf("weight must be a positive integer, got %v", parts[1])
+		}
+
+		weights[ep.String()] = w
+	}
+
+	return weights, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %v", path)
+	}
+
+	return pool, nil
+}
+
+// loadDNSSEC configures DNSSEC validation, with the trust anchors in path if
+// given.
+func loadDNSSEC(path string) (*revop.DNSSECOptions, error) {
+	opts := &revop.DNSSECOptions{}
+	if path == "" {
+		return opts, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if opts.TrustAnchors, err = revop.ParseTrustAnchors(f); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func loadRootHints(path string) ([]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return revop.ParseRootHints(f)
+}
+
 func serve(server *http.Server) {
 	go func() {
 		if err := server.ListenAndServe(); err != http.ErrServerClosed {
@@ -63,7 +463,7 @@ func serve(server *http.Server) {
 		}
 	}()
 	// serve until exit
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 	<-sig
 
@@ -78,6 +478,164 @@ func serve(server *http.Server) {
 	<-ctx.Done()
 }
 
+// stringsFlag is a flag which may be given more than once
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+var (
+	forwards   stringsFlag
+	zones      stringsFlag
+	hostsFiles stringsFlag
+	blocklists stringsFlag
+	allowlists stringsFlag
+	rpzFiles   stringsFlag
+)
+
+func init() {
+	flag.Var(
+		&forwards,
+		"forward",
+		`A conditional forwarding route, as "zone=server[,server...]"; may be
+        given more than once. See forward-file.`,
+	)
+	flag.Var(
+		&zones,
+		"zone",
+		`A master file of a zone to answer authoritatively, as
+        "[origin=]path", where origin is that of relative names preceding any
+        $ORIGIN directive; may be given more than once.`,
+	)
+	flag.Var(
+		&hostsFiles,
+		"hosts",
+		`A file in the format of /etc/hosts, whose names and addresses are
+        answered locally, ahead of zones and the provider; may be given more
+        than once.`,
+	)
+	flag.Var(
+		&blocklists,
+		"blocklist",
+		`A list of names to block, along with their subdomains, as
+        "[response=]path"; may be given more than once. Lists may be in the
+        format of a hosts file, a plain list of names, or AdBlock style
+        "||name^" rules, with "@@" exceptions and "/regexp/" rules. Names are
+        answered as set by response, which is as for block-response, or
+        otherwise by block-response itself.`,
+	)
+	flag.Var(
+		&allowlists,
+		"allowlist",
+		`A list of names which are never blocked, in any of the formats of a
+        blocklist; may be given more than once.`,
+	)
+	flag.Var(
+		&rpzFiles,
+		"rpz",
+		`A response policy zone file, as "[origin=]path", whose policies are
+        applied to every question; may be given more than once, with earlier
+        zones taking precedence.`,
+	)
+}
+
+// parseBlockPolicy parses how blocked names are answered: the name of an
+// action, or a comma separated list of addresses.
+func parseBlockPolicy(response string) (*revop.BlockPolicy, error) {
+	action, err := revop.ParseBlockAction(response)
+	if err == nil {
+		return &revop.BlockPolicy{Action: action}, nil
+	}
+	ips, ipErr := cmd.CSVtoIPs(response)
+	if ipErr != nil || len(ips) == 0 {
+		return nil, fmt.Errorf("%v, or a list of addresses", err)
+	}
+
+	return &revop.BlockPolicy{Action: revop.BlockAddress, Addresses: ips}, nil
+}
+
+// parseDNS64 parses the DNS64 prefix, and a comma separated list of networks
+// to exclude.
+func parseDNS64(prefix, exclude string) (*revop.DNS64Options, error) {
+	_, p, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	opts := &revop.DNS64Options{Prefix: p}
+	for _, e := range strings.Split(exclude, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, err
+		}
+		opts.Exclude = append(opts.Exclude, n)
+	}
+
+	return opts, nil
+}
+
+// filterLists parses the blocklist and allowlist flags. A blocklist is
+// given as "[response=]path"; where what precedes "=" isn't a response, it's
+// taken to be part of the path.
+func filterLists() []revop.FilterList {
+	var lists []revop.FilterList
+	for _, b := range blocklists {
+		l := revop.FilterList{Path: b}
+		if i := strings.Index(b, "="); i >= 0 {
+			if policy, err := parseBlockPolicy(b[:i]); err == nil {
+				l.Path, l.Policy = b[i+1:], policy
+			}
+		}
+		lists = append(lists, l)
+	}
+	for _, a := range allowlists {
+		lists = append(lists, revop.FilterList{Path: a, Allow: true})
+	}
+
+	return lists
+}
+
+// zoneFiles parses zone files given as "[origin=]path".
+func zoneFiles(flags stringsFlag) []revop.ZoneFile {
+	var files []revop.ZoneFile
+	for _, z := range flags {
+		f := revop.ZoneFile{Path: z}
+		if i := strings.Index(z, "="); i >= 0 {
+			f.Origin, f.Path = z[:i], z[i+1:]
+		}
+		files = append(files, f)
+	}
+
+	return files
+}
+
+// loadRoutes reads the conditional forwarding routes from the forward flags
+// and file.
+func loadRoutes(defaultPort uint16) (map[string]secop.Endpoints, error) {
+	var lines []string
+	for _, f := range forwards {
+		lines = append(lines, strings.Replace(f, "=", " ", 1))
+	}
+	if *forwardFile != "" {
+		b, err := ioutil.ReadFile(*forwardFile)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, string(b))
+	}
+
+	return revop.ParseRoutes(strings.NewReader(strings.Join(lines, "\n")), defaultPort)
+}
+
 func main() {
 	flag.Usage = func() {
 		_, exe := filepath.Split(os.Args[0])
@@ -98,23 +656,245 @@ func main() {
 	}
 	log.SetLevel(level)
 
-	dips, err := cmd.CSVtoEndpoints(*dnsServers)
-	if err != nil {
+	dnsOptions := &revop.DNSProviderOptions{
+		TCPOnly:    *dnsTCP,
+		Retries:    *dnsRetries,
+		Race:       *dnsRace,
+		HedgeDelay: time.Duration(*dnsHedgeDelay) * time.Millisecond,
+		Timeout:    time.Duration(*dnsTimeout) * time.Millisecond,
+		Deadline:   time.Duration(*dnsDeadline) * time.Millisecond,
+		Health: &revop.HealthOptions{
+			MaxFailures:   *dnsMaxFailures,
+			ProbeInterval: time.Duration(*dnsProbeInterval) * time.Second,
+			ProbeName:     *dnsProbeName,
+		},
+	}
+	if dnsOptions.Retries == 0 {
+		dnsOptions.Retries = -1
+	}
+	if dnsOptions.Strategy, err = revop.ParseStrategy(*dnsStrategy); err != nil {
+		log.Fatalf("error parsing dns-strategy: %v", err)
+	}
+	// servers, weights and forwarding routes all default to the port of the
+	// transport in use
+	port := uint16(53)
+	if *dnsTLS {
+		port = revop.DefaultDNSTLSPort
+	}
+	if dnsOptions.Weights, err = parseWeights(*dnsWeights, port); err != nil {
+		log.Fatalf("error parsing dns-weights: %v", err)
+	}
+
+	var dips secop.Endpoints
+	if *dnsTLS {
+		if dips, dnsOptions.TLS, err = parseTLSServers(*dnsServers, *dnsTLSPins); err != nil {
+			log.Fatalf("error parsing dns-servers: %v", err)
+		}
+		if *dnsTLSCA != "" {
+			if dnsOptions.TLS.RootCAs, err = loadCertPool(*dnsTLSCA); err != nil {
+				log.Fatalf("error loading dns-tls-ca: %v", err)
+			}
+		}
+	} else if dips, err = cmd.CSVtoEndpoints(*dnsServers); err != nil {
 		log.Fatalf("error parsing dns-servers: %v", err)
 	}
+	for server := range dnsOptions.Weights {
+		if !hasEndpoint(dips, server) {
+			log.Warnf("dns-weights has a weight for %v, which isn't in dns-servers", server)
+		}
+	}
+
+	bootstrap, err := cmd.CSVtoIPs(*providerBootstrap)
+	if err != nil {
+		log.Fatalf("error parsing provider-bootstrap: %v", err)
+	}
+
+	var resolver revop.Resolver
+	switch *providerName {
+	case "dns":
+		opts := *dnsOptions
+		if *dnssec {
+			if opts.DNSSEC, err = loadDNSSEC(*dnssecTrustAnchor); err != nil {
+				log.Fatalf("error loading dnssec-trust-anchor: %v", err)
+			}
+		}
+		dnsProvider, err := revop.NewDNSProvider(dips, &opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		expvar.Publish("dns_provider", expvar.Func(func() interface{} {
+			return dnsProvider.Stats()
+		}))
+		resolver = dnsProvider
+	case "google-json":
+		endpoint := *providerEndpoint
+		if endpoint == "" {
+			endpoint = defaultGoogleJSONEndpoint
+		}
+		provider, err := secop.NewGDNSProvider(endpoint, &secop.GDNSOptions{
+			Pad:         *providerPad,
+			EndpointIPs: bootstrap,
+			DNSServers:  dips,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		resolver = revop.NewProviderResolver(provider)
+	case "rfc8484":
+		endpoint := *providerEndpoint
+		if endpoint == "" {
+			endpoint = defaultRFC8484Endpoint
+		}
+		resolver, err = revop.NewDoHProvider(endpoint, &revop.DoHOptions{
+			Pad:          *providerPad,
+			BootstrapIPs: bootstrap,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "iterative":
+		opts := &revop.IterativeOptions{IPv6: *iterativeIPv6}
+		if *rootHints != "" {
+			if opts.RootHints, err = loadRootHints(*rootHints); err != nil {
+				log.Fatalf("error loading root-hints: %v", err)
+			}
+		}
+		iterative, err := revop.NewIterativeResolver(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		expvar.Publish("iterative", expvar.Func(func() interface{} {
+			return iterative.Stats()
+		}))
+		resolver = iterative
+	default:
+		log.Fatalf("invalid provider: %v", *providerName)
+	}
+	if *dnssec && *providerName != "dns" {
+		log.Fatalf("dnssec validation requires the dns provider")
+	}
 
-	provider, err := revop.NewDNSProvider(dips)
+	routes, err := loadRoutes(port)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("error parsing forwarding routes: %v", err)
+	}
+	if len(routes) > 0 {
+		resolvers := make(map[string]revop.Resolver)
+		for zone, servers := range routes {
+			p, err := revop.NewDNSProvider(servers, dnsOptions)
+			if err != nil {
+				log.Fatal(err)
+			}
+			resolvers[zone] = p
+		}
+		resolver = revop.NewRouter(resolver, resolvers)
+	}
+
+	if *cacheSize > 0 {
+		resolver = revop.NewCache(resolver, &revop.CacheOptions{
+			Size:     *cacheSize,
+			MaxStale: time.Duration(*cacheMaxStale) * time.Second,
+			StaleTTL: uint32(*cacheStaleTTL),
+		})
+	}
+	if len(zones) > 0 {
+		interval := time.Duration(*zoneReload) * time.Second
+		if interval == 0 {
+			interval = -1
+		}
+		z, err := revop.NewZoneResolver(resolver, zoneFiles(zones), &revop.ZoneOptions{
+			ReloadInterval: interval,
+		})
+		if err != nil {
+			log.Fatalf("error loading zones: %v", err)
+		}
+		resolver = z
+	}
+	if len(hostsFiles) > 0 {
+		interval := time.Duration(*hostsReload) * time.Second
+		if interval == 0 {
+			interval = -1
+		}
+		h, err := revop.NewHostsResolver(resolver, hostsFiles, &revop.HostsOptions{
+			TTL:            uint32(*hostsTTL),
+			ReloadInterval: interval,
+		})
+		if err != nil {
+			log.Fatalf("error loading hosts files: %v", err)
+		}
+		resolver = h
+	}
+	if len(blocklists) > 0 {
+		policy, err := parseBlockPolicy(*blockResponse)
+		if err != nil {
+			log.Fatalf("error parsing block-response: %v", err)
+		}
+		interval := time.Duration(*blocklistReload) * time.Second
+		if interval == 0 {
+			interval = -1
+		}
+		filter, err := revop.NewFilter(resolver, filterLists(), &revop.FilterOptions{
+			Action:         policy.Action,
+			Addresses:      policy.Addresses,
+			TTL:            uint32(*blockTTL),
+			ReloadInterval: interval,
+		})
+		if err != nil {
+			log.Fatalf("error loading blocklists: %v", err)
+		}
+		expvar.Publish("filter", expvar.Func(func() interface{} {
+			return filter.Stats()
+		}))
+		resolver = filter
 	}
+	if len(rpzFiles) > 0 {
+		interval := time.Duration(*rpzReload) * time.Second
+		if interval == 0 {
+			interval = -1
+		}
+		rpz, err := revop.NewRPZ(resolver, zoneFiles(rpzFiles), &revop.RPZOptions{
+			ReloadInterval: interval,
+		})
+		if err != nil {
+			log.Fatalf("error loading response policy zones: %v", err)
+		}
+		resolver = rpz
+	}
+	if *dns64 {
+		opts, err := parseDNS64(*dns64Prefix, *dns64Exclude)
+		if err != nil {
+			log.Fatalf("error parsing DNS64 options: %v", err)
+		}
+		d, err := revop.NewDNS64(resolver, opts)
+		if err != nil {
+			log.Fatalf("error creating DNS64: %v", err)
+		}
+		expvar.Publish("dns64", expvar.Func(func() interface{} {
+			return d.Stats()
+		}))
+		resolver = d
+	}
+
 	options := &revop.HandlerOptions{
-		ContentTypeJSON: *useJSONContentType,
-		ServerHeader:    *serverHeader,
+		ContentTypeJSON:  *useJSONContentType,
+		ServerHeader:     *serverHeader,
+		MaxBodySize:      *maxBodySize,
+		PaddingBlockSize: *paddingBlockSize,
+
+		ClientSubnetFromRemote: *ecsFromClient,
+		ClientSubnetPrefixV4:   ecsPrefixV4,
+		ClientSubnetPrefixV6:   ecsPrefixV6,
 	}
-	handler := revop.NewHandler(provider, options)
+	if err := options.Validate(); err != nil {
+		log.Fatalf("invalid option: %v", err)
+	}
+	handler := revop.NewHandler(revop.NewResolverProvider(resolver), options)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/resolve", handler.Handle)
+	mux.HandleFunc("/dns-query", handler.HandleDNSMessage)
 	server := &http.Server{
 		Addr:    *listenAddress,
 		Handler: mux,
@@ -127,6 +907,14 @@ func main() {
 		servers <- true
 	}()
 
+	if *debugListenAddress != "" {
+		// expvar registers its handler on the default mux
+		go func() {
+			log.Fatal(http.ListenAndServe(*debugListenAddress, nil))
+		}()
+		log.Infof("debug server started on %v", *debugListenAddress)
+	}
+
 	log.Infof("server started on %v", *listenAddress)
 	<-servers
 	log.Infoln("servers exited, stopping")
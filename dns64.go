@@ -0,0 +1,410 @@
+package reverseoperator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+const (
+	// DefaultDNS64Prefix is the well-known prefix of RFC 6052, which NAT64
+	// gateways translate to and from IPv4 by default.
+	DefaultDNS64Prefix = "64:ff9b::/96"
+
+	// dns64TTL is the greatest TTL of synthesized records when the
+	// response to the AAAA question gave none, as RFC 6147 section 5.1.7
+	// suggests.
+	dns64TTL = 600
+)
+
+var (
+	// dns64Mapped holds the IPv4-mapped IPv6 addresses, which an IPv6-only
+	// client can't reach; AAAA records of these addresses are ignored, as
+	// RFC 6147 section 5.1.4 requires.
+	dns64Mapped = mustParseNetworks("::ffff:0:0/96")
+	// dns64Unmappable holds IPv4 addresses which mean nothing beyond the
+	// host or link they're used on, so are never synthesized.
+	dns64Unmappable = mustParseNetworks(
+		"0.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16", "224.0.0.0/4", "240.0.0.0/4",
+	)
+	// dns64NonGlobal holds the private IPv4 addresses which RFC 6052 section
+	// 3.1 forbids from being synthesized with the well-known prefix.
+	dns64NonGlobal = mustParseNetworks(
+		"10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16",
+	)
+)
+
+// DNS64Options is a configuration object for optional DNS64 configuration
+type DNS64Options struct {
+	// Prefix is the NAT64 prefix addresses are synthesized in, of length 32,
+	// 40, 48, 56, 64 or 96; if nil, DefaultDNS64Prefix is used.
+	Prefix *net.IPNet
+	// Exclude holds networks which are never mapped: A records of IPv4
+	// addresses in them aren't synthesized, and AAAA records of IPv6
+	// addresses in them are ignored, as if they weren't answered.
+	Exclude []*net.IPNet
+}
+
+// NewDNS64 creates a DNS64 which synthesizes answers from those of fallback.
+func NewDNS64(fallback Resolver, opts *DNS64Options) (*DNS64, error) {
+	if opts == nil {
+		opts = &DNS64Options{}
+	}
+
+	prefix := opts.Prefix
+	if prefix == nil {
+		_, prefix, _ = net.ParseCIDR(DefaultDNS64Prefix)
+	}
+	ones, bits := prefix.Mask.Size()
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		bits = 0
+	}
+	if bits != 128 || prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("DNS64 prefix %v must be an IPv6 prefix of length 32, 40, 48, 56, 64 or 96", prefix)
+	}
+	prefix = &net.IPNet{IP: prefix.IP.To16().Mask(prefix.Mask), Mask: prefix.Mask}
+	if prefix.IP[8] != 0 {
+		return nil, fmt.Errorf("DNS64 prefix %v must have bits 64 to 71 unset", prefix)
+	}
+
+	d := &DNS64{
+		fallback: fallback,
+		prefix:   prefix,
+		exclude4: append([]*net.IPNet{}, dns64Unmappable...),
+		exclude6: append([]*net.IPNet{}, dns64Mapped...),
+	}
+	if prefix.String() == DefaultDNS64Prefix {
+		d.exclude4 = append(d.exclude4, dns64NonGlobal...)
+	}
+	for _, n := range opts.Exclude {
+		if n.IP.To4() != nil && len(n.Mask) == net.IPv4len {
+			d.exclude4 = append(d.exclude4, n)
+		} else {
+			d.exclude6 = append(d.exclude6, n)
+		}
+	}
+
+	return d, nil
+}
+
+// DNS64 is a Resolver which synthesizes AAAA records from A records for
+// names which have no AAAA records of their own, embedding their IPv4
+// addresses in a NAT64 prefix as in RFC 6147, so that IPv6-only clients may
+// reach them through a NAT64 gateway. PTR questions for addresses within
+// the prefix are answered with a CNAME to the in-addr.arpa name of the
+// embedded IPv4 address.
+type DNS64 struct {
+	// fields accessed atomically come first, for alignment
+	queries     uint64
+	synthesized uint64
+
+	fallback Resolver
+	prefix   *net.IPNet
+	exclude4 []*net.IPNet
+	exclude6 []*net.IPNet
+}
+
+// DNS64Stats holds statistics of a DNS64.
+type DNS64Stats struct {
+	// Queries is the number of questions resolved
+	Queries uint64
+	// Synthesized is the number of questions answered with synthesized
+	// records
+	Synthesized uint64
+}
+
+// Stats returns the statistics of the DNS64 so far.
+func (d *DNS64) Stats() DNS64Stats {
+	return DNS64Stats{
+		Queries:     atomic.LoadUint64(&d.queries),
+		Synthesized: atomic.LoadUint64(&d.synthesized),
+	}
+}
+
+// Resolve resolves a question, synthesizing the answer to AAAA and PTR
+// questions where needed; it implements Resolver.
+func (d *DNS64) Resolve(ctx context.Context, q Question) (*Response, error) {
+	atomic.AddUint64(&d.queries, 1)
+
+	switch q.Type {
+	case dns.TypeAAAA:
+		// a client which validates for itself would find synthesized
+		// records bogus, so is given only those which exist
+		if q.DNSSECOK && q.CheckingDisabled {
+			break
+		}
+		return d.resolveAAAA(ctx, q)
+	case dns.TypePTR:
+		ip4 := d.extract(reverseIPv6(q.Name))
+		if ip4 == nil || excluded(d.exclude4, ip4) {
+			break
+		}
+		return d.resolvePTR(ctx, q, ip4)
+	}
+
+	return d.fallback.Resolve(ctx, q)
+}
+
+// resolveAAAA answers an AAAA question with the AAAA records of the name,
+// or if it has none but those excluded, with records synthesized from its A
+// records. A name which doesn't exist isn't looked up again, but any other
+// failure is treated as if the name had no AAAA records.
+func (d *DNS64) resolveAAAA(ctx context.Context, q Question) (*Response, error) {
+	resp, err := d.fallback.Resolve(ctx, q)
+	if err == ErrDropped || (err != nil && ctx.Err() != nil) {
+		// a question dropped by policy must not be answered regardless, and
+		// one whose caller has given up needn't be
+		return nil, err
+	}
+	if err == nil {
+		if resp.ResponseCode == dns.RcodeNameError {
+			return resp, nil
+		}
+		if resp.ResponseCode == dns.RcodeSuccess {
+			var answer []secop.DNSRR
+			found := false
+			for _, rr := range resp.Answer {
+				if rr.Type == dns.TypeAAAA && excluded(d.exclude6, net.ParseIP(rr.Data)) {
+					continue
+				}
+				found = found || rr.Type == dns.TypeAAAA
+				answer = append(answer, rr)
+			}
+			if found {
+				if len(answer) == len(resp.Answer) {
+					return resp, nil
+				}
+				filtered := *resp
+				filtered.Answer = answer
+				return &filtered, nil
+			}
+			if len(answer) < len(resp.Answer) {
+				filtered := *resp
+				filtered.Answer = answer
+				resp = &filtered
+			}
+		}
+	}
+
+	aq := q
+	aq.Type = dns.TypeA
+	aresp, aerr := d.fallback.Resolve(ctx, aq)
+	if aerr != nil {
+		log.Debugf("error resolving A records of %v to synthesize from: %v", q.Name, aerr)
+	} else if synth := d.synthesize(q, resp, aresp); synth != nil {
+		atomic.AddUint64(&d.synthesized, 1)
+		log.Debugf("synthesized AAAA records for %v", q.Name)
+		return synth, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// synthesize builds the response to an AAAA question from the response to
+// its A question, or returns nil if there are no addresses to synthesize
+// from. resp is the response to the AAAA question, if there is one, whose
+// negative TTL limits those of the synthesized records.
+func (d *DNS64) synthesize(q Question, resp, aresp *Response) *Response {
+	if aresp.ResponseCode != dns.RcodeSuccess {
+		return nil
+	}
+
+	maxTTL := uint32(dns64TTL)
+	if resp != nil {
+		if ttl, ok := negativeTTL(resp.Authority); ok {
+			maxTTL = ttl
+		}
+	}
+
+	var answer []secop.DNSRR
+	found := false
+	for _, rr := range aresp.Answer {
+		switch rr.Type {
+		case dns.TypeCNAME, dns.TypeDNAME:
+			answer = append(answer, rr)
+		case dns.TypeA:
+			ip4 := net.ParseIP(rr.Data).To4()
+			if ip4 == nil || excluded(d.exclude4, ip4) {
+				continue
+			}
+			ttl := rr.TTL
+			if maxTTL < ttl {
+				ttl = maxTTL
+			}
+			answer = append(answer, secop.DNSRR{
+				Name: rr.Name,
+				Type: dns.TypeAAAA,
+				TTL:  ttl,
+				Data: d.embed(ip4).String(),
+			})
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	synth := *aresp
+	synth.Question = []secop.DNSQuestion{{Name: dns.Fqdn(q.Name), Type: dns.TypeAAAA}}
+	synth.Answer = answer
+	synth.Authority = nil
+	synth.Extra = nil
+	synth.Authoritative = false
+	if resp != nil && narrower(resp.ClientSubnet, synth.ClientSubnet) {
+		synth.ClientSubnet = resp.ClientSubnet
+	}
+	synth.Comment = fmt.Sprintf("Synthesized with DNS64 prefix %v", d.prefix)
+	return &synth
+}
+
+// resolvePTR answers a PTR question for an address within the prefix with
+// a CNAME to the in-addr.arpa name of its embedded IPv4 address, along with
+// the answer to the PTR question for that name.
+func (d *DNS64) resolvePTR(ctx context.Context, q Question, ip4 net.IP) (*Response, error) {
+	target, err := dns.ReverseAddr(ip4.String())
+	if err != nil {
+		return nil, err
+	}
+
+	tq := q
+	tq.Name = target
+	tresp, err := d.fallback.Resolve(ctx, tq)
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddUint64(&d.synthesized, 1)
+	log.Debugf("synthesized CNAME from %v to %v", q.Name, target)
+
+	synth := *tresp
+	synth.Question = []secop.DNSQuestion{{Name: dns.Fqdn(q.Name), Type: dns.TypePTR}}
+	synth.Answer = append([]secop.DNSRR{{
+		Name: dns.Fqdn(q.Name),
+		Type: dns.TypeCNAME,
+		TTL:  dns64TTL,
+		Data: target,
+	}}, tresp.Answer...)
+	synth.Authoritative = false
+	synth.Comment = fmt.Sprintf("Synthesized with DNS64 prefix %v", d.prefix)
+	return &synth, nil
+}
+
+// embed returns the IPv6 address of an IPv4 address within the prefix, as
+// in RFC 6052 section 2.2; bits 64 to 71 are always unset, so the IPv4
+// address is split around them if it would otherwise cover them.
+func (d *DNS64) embed(ip4 net.IP) net.IP {
+	ones, _ := d.prefix.Mask.Size()
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.prefix.IP)
+	i := ones / 8
+	for _, b := range ip4 {
+		if i == 8 {
+			i++
+		}
+		ip[i] = b
+		i++
+	}
+
+	return ip
+}
+
+// extract returns the IPv4 address embedded in an IPv6 address within the
+// prefix, or nil if it isn't within the prefix.
+func (d *DNS64) extract(ip net.IP) net.IP {
+	if ip == nil || ip.To4() != nil || !d.prefix.Contains(ip) {
+		return nil
+	}
+	ones, _ := d.prefix.Mask.Size()
+
+	ip4 := make(net.IP, net.IPv4len)
+	i := ones / 8
+	for j := range ip4 {
+		if i == 8 {
+			i++
+		}
+		ip4[j] = ip[i]
+		i++
+	}
+
+	return ip4
+}
+
+// reverseIPv6 returns the IPv6 address of an ip6.arpa name, or nil if it
+// isn't the name of a whole address.
+func reverseIPv6(name string) net.IP {
+	name = canonicalName(name)
+	if !strings.HasSuffix(name, ".ip6.arpa.") {
+		return nil
+	}
+	nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+	if len(nibbles) != net.IPv6len*2 {
+		return nil
+	}
+
+	ip := make(net.IP, net.IPv6len)
+	for i, n := range nibbles {
+		if len(n) != 1 {
+			return nil
+		}
+		v := strings.IndexByte("0123456789abcdef", n[0])
+		if v < 0 {
+			return nil
+		}
+		// nibbles run from the least significant
+		j := len(nibbles) - 1 - i
+		ip[j/2] |= byte(v) << uint(4*(1-j%2))
+	}
+
+	return ip
+}
+
+// excluded returns whether an address is within any of the networks.
+func excluded(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// narrower returns whether client subnet a is more specific than b, where
+// either may be nil if the upstream gave no scope.
+func narrower(a, b *net.IPNet) bool {
+	if a == nil {
+		return false
+	}
+	if b == nil {
+		return true
+	}
+	ao, _ := a.Mask.Size()
+	bo, _ := b.Mask.Size()
+	return ao > bo
+}
+
+// mustParseNetworks parses a list of CIDR networks, panicking if any is
+// invalid; it's for networks known at compile time.
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
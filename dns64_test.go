@@ -0,0 +1,338 @@
+package reverseoperator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// dns64Fallback answers questions from a table of responses by name and
+// type; questions not in the table have an empty answer with an SOA.
+func dns64Fallback(responses map[string]map[uint16]*Response) *funcResolver {
+	return &funcResolver{resolve: func(q Question) (*Response, error) {
+		if r, ok := responses[canonicalName(q.Name)][q.Type]; ok {
+			if r == nil {
+				return nil, errors.New("upstream failed")
+			}
+			return r, nil
+		}
+		return &Response{DNSResponse: secop.DNSResponse{
+			Question:  []secop.DNSQuestion{q.DNSQuestion},
+			Authority: []secop.DNSRR{{Name: "example.", Type: dns.TypeSOA, TTL: 300, Data: "ns.example. hostmaster.example. 1 3600 600 86400 60"}},
+		}}, nil
+	}}
+}
+
+func dns64Answer(rcode int, rrs ...secop.DNSRR) *Response {
+	return &Response{DNSResponse: secop.DNSResponse{ResponseCode: rcode, Answer: rrs}}
+}
+
+func TestDNS64(t *testing.T) {
+	fallback := dns64Fallback(map[string]map[uint16]*Response{
+		"v4.example.": {
+			dns.TypeA: dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "v4.example.", Type: dns.TypeA, TTL: 3600, Data: "192.0.2.33"}),
+		},
+		"dual.example.": {
+			dns.TypeA:    dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "dual.example.", Type: dns.TypeA, TTL: 300, Data: "192.0.2.1"}),
+			dns.TypeAAAA: dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "dual.example.", Type: dns.TypeAAAA, TTL: 300, Data: "2001:db8::1"}),
+		},
+		"mapped.example.": {
+			dns.TypeA:    dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "mapped.example.", Type: dns.TypeA, TTL: 300, Data: "192.0.2.3"}),
+			dns.TypeAAAA: dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "mapped.example.", Type: dns.TypeAAAA, TTL: 300, Data: "::ffff:192.0.2.3"}),
+		},
+		"nx.example.": {
+			dns.TypeAAAA: dns64Answer(dns.RcodeNameError),
+		},
+		"broken.example.": {
+			dns.TypeA:    dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "broken.example.", Type: dns.TypeA, TTL: 3600, Data: "192.0.2.4"}),
+			dns.TypeAAAA: dns64Answer(dns.RcodeServerFailure),
+		},
+		"failed.example.": {
+			dns.TypeA:    dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "failed.example.", Type: dns.TypeA, TTL: 30, Data: "192.0.2.5"}),
+			dns.TypeAAAA: nil,
+		},
+		"private.example.": {
+			dns.TypeA: dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "private.example.", Type: dns.TypeA, TTL: 300, Data: "10.0.0.1"}),
+		},
+		"alias.example.": {
+			dns.TypeA: dns64Answer(dns.RcodeSuccess,
+				secop.DNSRR{Name: "alias.example.", Type: dns.TypeCNAME, TTL: 300, Data: "v4.example."},
+				secop.DNSRR{Name: "v4.example.", Type: dns.TypeA, TTL: 3600, Data: "192.0.2.33"},
+			),
+		},
+	})
+	d, err := NewDNS64(fallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name     string
+		dnssec   bool
+		rcode    int
+		answer   []secop.DNSRR
+		upstream int
+	}{
+		{
+			name:     "v4.example.",
+			answer:   []secop.DNSRR{{Name: "v4.example.", Type: dns.TypeAAAA, TTL: 60, Data: "64:ff9b::c000:221"}},
+			upstream: 2,
+		},
+		{
+			name:     "dual.example.",
+			answer:   []secop.DNSRR{{Name: "dual.example.", Type: dns.TypeAAAA, TTL: 300, Data: "2001:db8::1"}},
+			upstream: 1,
+		},
+		{
+			name:     "mapped.example.",
+			answer:   []secop.DNSRR{{Name: "mapped.example.", Type: dns.TypeAAAA, TTL: 300, Data: "64:ff9b::c000:203"}},
+			upstream: 2,
+		},
+		{
+			name:     "nx.example.",
+			rcode:    dns.RcodeNameError,
+			upstream: 1,
+		},
+		{
+			name:     "broken.example.",
+			answer:   []secop.DNSRR{{Name: "broken.example.", Type: dns.TypeAAAA, TTL: dns64TTL, Data: "64:ff9b::c000:204"}},
+			upstream: 2,
+		},
+		{
+			name:     "failed.example.",
+			answer:   []secop.DNSRR{{Name: "failed.example.", Type: dns.TypeAAAA, TTL: 30, Data: "64:ff9b::c000:205"}},
+			upstream: 2,
+		},
+		{
+			name:     "private.example.",
+			upstream: 2,
+		},
+		{
+			name: "alias.example.",
+			answer: []secop.DNSRR{
+				{Name: "alias.example.", Type: dns.TypeCNAME, TTL: 300, Data: "v4.example."},
+				{Name: "v4.example.", Type: dns.TypeAAAA, TTL: 60, Data: "64:ff9b::c000:221"},
+			},
+			upstream: 2,
+		},
+		{
+			name:     "v4.example.",
+			dnssec:   true,
+			upstream: 1,
+		},
+	} {
+		fallback.calls = 0
+		q := Question{DNSQuestion: secop.DNSQuestion{Name: c.name, Type: dns.TypeAAAA}, DNSSECOK: c.dnssec, CheckingDisabled: c.dnssec}
+		resp, err := d.Resolve(context.Background(), q)
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", c.name, err)
+			continue
+		}
+		if resp.ResponseCode != c.rcode {
+			t.Errorf("%v: expected rcode %v, got %v", c.name, c.rcode, resp.ResponseCode)
+		}
+		if !reflect.DeepEqual(resp.Answer, c.answer) {
+			t.Errorf("%v: expected answer %v, got %v", c.name, c.answer, resp.Answer)
+		}
+		if fallback.calls != c.upstream {
+			t.Errorf("%v: expected %v upstream questions, got %v", c.name, c.upstream, fallback.calls)
+		}
+	}
+
+	// other questions are passed through untouched
+	resp, err := d.Resolve(context.Background(), Question{DNSQuestion: secop.DNSQuestion{Name: "v4.example.", Type: dns.TypeA}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Data != "192.0.2.33" {
+		t.Errorf("expected the A record, got %v", resp.Answer)
+	}
+
+	if s := d.Stats(); s.Queries != 10 || s.Synthesized != 5 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestDNS64Exclude(t *testing.T) {
+	fallback := dns64Fallback(map[string]map[uint16]*Response{
+		"excluded.example.": {
+			dns.TypeA: dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "excluded.example.", Type: dns.TypeA, TTL: 300, Data: "198.51.100.1"}),
+		},
+		"unreachable.example.": {
+			dns.TypeA:    dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "unreachable.example.", Type: dns.TypeA, TTL: 300, Data: "192.0.2.1"}),
+			dns.TypeAAAA: dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "unreachable.example.", Type: dns.TypeAAAA, TTL: 300, Data: "2001:db8:bad::1"}),
+		},
+		"private.example.": {
+			dns.TypeA: dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "private.example.", Type: dns.TypeA, TTL: 300, Data: "10.0.0.1"}),
+		},
+	})
+	_, prefix, _ := net.ParseCIDR("2001:db8:64::/96")
+	d, err := NewDNS64(fallback, &DNS64Options{
+		Prefix:  prefix,
+		Exclude: mustParseNetworks("198.51.100.0/24", "2001:db8:bad::/48"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string][]secop.DNSRR{
+		"excluded.example.":    nil,
+		"unreachable.example.": {{Name: "unreachable.example.", Type: dns.TypeAAAA, TTL: 300, Data: "2001:db8:64::c000:201"}},
+		// private addresses may be synthesized with a network-specific prefix
+		"private.example.": {{Name: "private.example.", Type: dns.TypeAAAA, TTL: 60, Data: "2001:db8:64::a00:1"}},
+	} {
+		resp, err := d.Resolve(context.Background(), Question{DNSQuestion: secop.DNSQuestion{Name: name, Type: dns.TypeAAAA}})
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(resp.Answer, expected) {
+			t.Errorf("%v: expected answer %v, got %v", name, expected, resp.Answer)
+		}
+	}
+}
+
+func TestDNS64Dropped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fallback := &funcResolver{resolve: func(q Question) (*Response, error) {
+		if q.Type == dns.TypeAAAA {
+			if q.Name == "cancelled.example." {
+				cancel()
+				return nil, ctx.Err()
+			}
+			return nil, ErrDropped
+		}
+		return dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: q.Name, Type: dns.TypeA, TTL: 300, Data: "192.0.2.1"}), nil
+	}}
+	d, err := NewDNS64(fallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]error{
+		"dropped.example.":   ErrDropped,
+		"cancelled.example.": context.Canceled,
+	} {
+		fallback.calls = 0
+		resp, err := d.Resolve(ctx, Question{DNSQuestion: secop.DNSQuestion{Name: name, Type: dns.TypeAAAA}})
+		if err != expected {
+			t.Errorf("%v: expected error %v, got %v with %v", name, expected, err, resp)
+		}
+		if fallback.calls != 1 {
+			t.Errorf("%v: expected no A lookup to synthesize from, got %v lookups", name, fallback.calls)
+		}
+	}
+}
+
+func TestDNS64PTR(t *testing.T) {
+	fallback := dns64Fallback(map[string]map[uint16]*Response{
+		"33.2.0.192.in-addr.arpa.": {
+			dns.TypePTR: dns64Answer(dns.RcodeSuccess, secop.DNSRR{Name: "33.2.0.192.in-addr.arpa.", Type: dns.TypePTR, TTL: 300, Data: "v4.example."}),
+		},
+	})
+	d, err := NewDNS64(fallback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, _ := dns.ReverseAddr("64:ff9b::192.0.2.33")
+	resp, err := d.Resolve(context.Background(), Question{DNSQuestion: secop.DNSQuestion{Name: name, Type: dns.TypePTR}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []secop.DNSRR{
+		{Name: name, Type: dns.TypeCNAME, TTL: dns64TTL, Data: "33.2.0.192.in-addr.arpa."},
+		{Name: "33.2.0.192.in-addr.arpa.", Type: dns.TypePTR, TTL: 300, Data: "v4.example."},
+	}
+	if !reflect.DeepEqual(resp.Answer, expected) {
+		t.Errorf("expected answer %v, got %v", expected, resp.Answer)
+	}
+
+	// addresses outside the prefix, or which are never synthesized, are
+	// passed through
+	for _, addr := range []string{"2001:db8::192.0.2.33", "64:ff9b::127.0.0.1"} {
+		fallback.calls = 0
+		name, _ := dns.ReverseAddr(addr)
+		resp, err := d.Resolve(context.Background(), Question{DNSQuestion: secop.DNSQuestion{Name: name, Type: dns.TypePTR}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) != 0 || fallback.calls != 1 {
+			t.Errorf("%v: expected to be passed through, got %v", addr, resp.Answer)
+		}
+	}
+}
+
+func TestDNS64Embed(t *testing.T) {
+	// the examples of RFC 6052 section 2.4
+	ip4 := net.ParseIP("192.0.2.33").To4()
+	for prefix, expected := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+		"64:ff9b::/96":          "64:ff9b::c000:221",
+	} {
+		_, network, _ := net.ParseCIDR(prefix)
+		d, err := NewDNS64(nil, &DNS64Options{Prefix: network})
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", prefix, err)
+			continue
+		}
+
+		ip := d.embed(ip4)
+		if ip.String() != expected {
+			t.Errorf("%v: expected %v, got %v", prefix, expected, ip)
+		}
+		if e := d.extract(ip); !e.Equal(ip4) {
+			t.Errorf("%v: expected to extract %v, got %v", prefix, ip4, e)
+		}
+		if e := d.extract(net.ParseIP("2001:db9::1")); e != nil {
+			t.Errorf("%v: expected nothing extracted outside the prefix, got %v", prefix, e)
+		}
+	}
+}
+
+func TestNewDNS64(t *testing.T) {
+	for _, prefix := range []string{
+		"2001:db8::/60",
+		"2001:db8::/128",
+		"192.0.2.0/24",
+		"2001:db8:0:0:ff00::/96",
+	} {
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewDNS64(nil, &DNS64Options{Prefix: network}); err == nil {
+			t.Errorf("%v: expected an error", prefix)
+		}
+	}
+}
+
+func TestReverseIPv6(t *testing.T) {
+	for _, addr := range []string{"64:ff9b::c000:221", "2001:db8::1", "::"} {
+		name, _ := dns.ReverseAddr(addr)
+		if ip := reverseIPv6(name); !ip.Equal(net.ParseIP(addr)) {
+			t.Errorf("%v: expected %v, got %v", name, addr, ip)
+		}
+	}
+	for _, name := range []string{
+		"1.0.0.0.ip6.arpa.",
+		"33.2.0.192.in-addr.arpa.",
+		"example.",
+		"x.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+	} {
+		if ip := reverseIPv6(name); ip != nil {
+			t.Errorf("%v: expected no address, got %v", name, ip)
+		}
+	}
+}
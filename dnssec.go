@@ -0,0 +1,570 @@
+package reverseoperator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// DefaultTrustAnchors are the DS records of the root zone's key signing keys,
+// as published by IANA, which anchor validation when no other trust anchors
+// are configured.
+const DefaultTrustAnchors = `
+. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+const (
+	// maxTrustTTL is the longest a link in a chain of trust is cached, however
+	// long its records' TTLs
+	maxTrustTTL = time.Hour
+	// bogusTTL is how long a link which failed validation is cached, so that
+	// a broken zone isn't asked for its keys with every question
+	bogusTTL = 30 * time.Second
+	// maxTrusts is the number of names whose trust is cached before expired
+	// ones are removed to make room; every name looked up has an entry, so
+	// without a limit, questions for random names would grow it forever
+	maxTrusts = 10000
+)
+
+// DNSSECOptions configures DNSSEC validation.
+type DNSSECOptions struct {
+	// TrustAnchors are the DS records which validation is anchored by; if
+	// empty, DefaultTrustAnchors are used. Names below no anchor are
+	// insecure.
+	TrustAnchors []*dns.DS
+}
+
+// ParseTrustAnchors parses trust anchors from a master file of DS or DNSKEY
+// records; the SHA-256 digest of a DNSKEY is used as its DS.
+func ParseTrustAnchors(r io.Reader) ([]*dns.DS, error) {
+	var (
+		anchors []*dns.DS
+		err     error
+	)
+	for t := range dns.ParseZone(r, ".", "") {
+		// the parser stops at its first error, but the channel must still
+		// be drained
+		if err != nil {
+			continue
+		}
+		if t.Error != nil {
+			err = t.Error
+			continue
+		}
+
+		switch rr := t.RR.(type) {
+		case *dns.DS:
+			anchors = append(anchors, rr)
+		case *dns.DNSKEY:
+			anchors = append(anchors, rr.ToDS(dns.SHA256))
+		default:
+			err = fmt.Errorf("trust anchor must be a DS or DNSKEY record, got %v", dns.TypeToString[rr.Header().Rrtype])
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no trust anchors found")
+	}
+
+	return anchors, nil
+}
+
+// security is the outcome of validating data, as described by RFC 4035
+// section 4.3.
+type security int
+
+const (
+	// insecure data is known not to be signed, as a zone above it has no
+	// chain of trust to it
+	insecure security = iota
+	// secure data has a chain of trust to a trust anchor
+	secure
+	// bogus data should be secure, but failed validation
+	bogus
+)
+
+var securityNames = map[security]string{
+	insecure: "insecure",
+	secure:   "secure",
+	bogus:    "bogus",
+}
+
+func (s security) String() string {
+	return securityNames[s]
+}
+
+// trust is the security of a zone, and its keys if secure.
+type trust struct {
+	zone     string
+	security security
+	keys     []*dns.DNSKEY
+	expires  time.Time
+	// reason explains why the zone is bogus
+	reason string
+}
+
+// validator validates responses, fetching the DS and DNSKEY records of each
+// zone between a trust anchor and the data with query.
+type validator struct {
+	// query sends a question upstream with the DO and CD bits set, so that
+	// signatures are returned, and bogus data isn't withheld
+	query   func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+	anchors map[string][]*dns.DS
+
+	mutex sync.Mutex
+	// trusts holds the trust of the zone containing each name looked up,
+	// keyed by the name's canonical form
+	trusts map[string]*trust
+}
+
+func newValidator(opts *DNSSECOptions, query func(context.Context, string, uint16) (*dns.Msg, error)) (*validator, error) {
+	anchors := opts.TrustAnchors
+	if len(anchors) == 0 {
+		var err error
+		if anchors, err = ParseTrustAnchors(strings.NewReader(DefaultTrustAnchors)); err != nil {
+			return nil, err
+		}
+	}
+
+	v := &validator{
+		query:   query,
+		anchors: make(map[string][]*dns.DS),
+		trusts:  make(map[string]*trust),
+	}
+	for _, ds := range anchors {
+		name := canonicalName(ds.Hdr.Name)
+		v.anchors[name] = append(v.anchors[name], ds)
+	}
+
+	return v, nil
+}
+
+// validate validates the response to a question, returning its security and,
+// if bogus, why.
+func (v *validator) validate(ctx context.Context, q Question, m *dns.Msg) (security, string) {
+	sets, sigs := rrsets(m.Answer)
+	nsSets, nsSigs := rrsets(m.Ns)
+	for k, s := range nsSigs {
+		sigs[k] = append(sigs[k], s...)
+	}
+
+	result := secure
+	// worse records the security of data, which can only make the result
+	// worse: bogus data makes the whole response bogus, and insecure data
+	// makes a secure response insecure
+	var reason string
+	worse := func(s security, why string) {
+		switch {
+		case s == bogus && result != bogus:
+			result, reason = bogus, why
+		case s == insecure && result == secure:
+			result = insecure
+		}
+	}
+
+	check := func(set []dns.RR) {
+		t := v.verifySet(ctx, set, sigs[rrsetKey(set[0])])
+		worse(t.security, t.reason)
+	}
+	for _, set := range sets {
+		// a CNAME synthesized from a DNAME is unsigned, and is secure if the
+		// DNAME is
+		if c, ok := set[0].(*dns.CNAME); ok && synthesized(c, sets) {
+			continue
+		}
+		check(set)
+	}
+	for _, set := range nsSets {
+		switch set[0].Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+			check(set)
+		}
+	}
+	if result == bogus {
+		return result, reason
+	}
+
+	// the name whose data answers the question, following any CNAMEs
+	target := canonicalName(q.Name)
+	for i := 0; i < maxCNAMEChain; i++ {
+		set, ok := sets[rrsetKeyOf(target, dns.TypeCNAME)]
+		if !ok || q.Type == dns.TypeCNAME {
+			break
+		}
+		target = canonicalName(set[0].(*dns.CNAME).Target)
+	}
+
+	// a wildcard answer is only secure with proof that the name itself
+	// doesn't exist
+	if set, ok := sets[rrsetKeyOf(target, q.Type)]; ok {
+		for _, sig := range sigs[rrsetKey(set[0])] {
+			if int(sig.Labels) < dns.CountLabel(target) && result == secure {
+				if !nsecDenies(m.Ns, target, int(sig.Labels)) {
+					return bogus, fmt.Sprintf("no proof that %v doesn't exist for its wildcard answer", target)
+				}
+				break
+			}
+		}
+		return result, reason
+	}
+
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return result, reason
+	}
+
+	// the answer is negative, and is only secure with proof from the zone
+	// which gave it; the target itself may not exist, so the zone is found
+	// from its SOA record, if any
+	zone := target
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, target) {
+			zone = soa.Hdr.Name
+		}
+	}
+	t := v.trust(ctx, zone)
+	if t.security != secure {
+		worse(t.security, t.reason)
+		return result, reason
+	}
+	if m.Rcode == dns.RcodeNameError {
+		if !nxdomainProven(m.Ns, target) {
+			return bogus, fmt.Sprintf("no proof that %v doesn't exist", target)
+		}
+	} else if !nodataProven(m.Ns, target, q.Type) {
+		return bogus, fmt.Sprintf("no proof that %v has no %v records", target, dns.TypeToString[q.Type])
+	}
+
+	return result, reason
+}
+
+// verifySet verifies an RRset with its signatures, returning the trust of
+// the zone which signed it.
+func (v *validator) verifySet(ctx context.Context, set []dns.RR, sigs []*dns.RRSIG) *trust {
+	owner := canonicalName(set[0].Header().Name)
+	if len(sigs) == 0 {
+		t := v.trust(ctx, owner)
+		if t.security == secure {
+			return &trust{security: bogus, reason: fmt.Sprintf("%v[%v] is unsigned", owner, dns.TypeToString[set[0].Header().Rrtype])}
+		}
+		return t
+	}
+
+	signer := canonicalName(sigs[0].SignerName)
+	t := v.trust(ctx, signer)
+	if t.security != secure {
+		return t
+	}
+	if t.zone != signer || !dns.IsSubDomain(signer, owner) {
+		return &trust{security: bogus, reason: fmt.Sprintf("%v is not signed by its zone", owner)}
+	}
+	if !verify(set, sigs, t.keys) {
+		return &trust{security: bogus, reason: fmt.Sprintf("signature of %v[%v] is invalid", owner, dns.TypeToString[set[0].Header().Rrtype])}
+	}
+
+	return t
+}
+
+// trust returns the trust of the zone containing name, by following the
+// chain of DS and DNSKEY records from the closest trust anchor above it.
+func (v *validator) trust(ctx context.Context, name string) *trust {
+	name = canonicalName(name)
+
+	v.mutex.Lock()
+	t, ok := v.trusts[name]
+	v.mutex.Unlock()
+	if ok && now().Before(t.expires) {
+		return t
+	}
+
+	if ds, ok := v.anchors[name]; ok {
+		t = v.keys(ctx, name, ds, now().Add(maxTrustTTL))
+	} else if name == "." {
+		t = &trust{zone: name, security: insecure, expires: now().Add(maxTrustTTL)}
+	} else {
+		off, _ := dns.NextLabel(name, 0)
+		parent := name[off:]
+		if parent == "" {
+			parent = "."
+		}
+
+		t = v.trust(ctx, parent)
+		if t.security == secure {
+			t = v.delegation(ctx, name, t)
+		}
+	}
+	if t.security == bogus {
+		log.Warnf("validation of %v failed: %v", name, t.reason)
+		t.expires = now().Add(bogusTTL)
+	}
+
+	v.mutex.Lock()
+	if len(v.trusts) >= maxTrusts {
+		v.prune()
+	}
+	v.trusts[name] = t
+	v.mutex.Unlock()
+
+	return t
+}
+
+// prune removes expired trusts from the cache, and if that leaves it nearly
+// full, arbitrary ones, so that a full cache isn't scanned with every name
+// added; the mutex must be held.
+func (v *validator) prune() {
+	t := now()
+	for name, tr := range v.trusts {
+		if !t.Before(tr.expires) {
+			delete(v.trusts, name)
+		}
+	}
+	for name := range v.trusts {
+		if len(v.trusts) <= maxTrusts-maxTrusts/10 {
+			break
+		}
+		delete(v.trusts, name)
+	}
+}
+
+// delegation finds whether name is the apex of a zone below the secure zone
+// parent, from the DS records of name: if it has some, its keys are fetched;
+// if it is proven not to, it is either an insecure zone, or not a zone at all.
+func (v *validator) delegation(ctx context.Context, name string, parent *trust) *trust {
+	m, err := v.query(ctx, name, dns.TypeDS)
+	if err != nil {
+		return &trust{zone: name, security: bogus, reason: fmt.Sprintf("error fetching DS of %v: %v", name, err)}
+	}
+
+	sets, sigs := rrsets(m.Answer)
+	if set, ok := sets[rrsetKeyOf(name, dns.TypeDS)]; ok {
+		if !verify(set, sigs[rrsetKey(set[0])], parent.keys) {
+			return &trust{zone: name, security: bogus, reason: fmt.Sprintf("DS of %v is not signed by %v", name, parent.zone)}
+		}
+		var ds []*dns.DS
+		for _, rr := range set {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		return v.keys(ctx, name, ds, expiry(parent.expires, set))
+	}
+
+	// the absence of DS records must be proven by the parent
+	nsSets, nsSigs := rrsets(m.Ns)
+	var proven bool
+	for _, set := range nsSets {
+		t := set[0].Header().Rrtype
+		if t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			continue
+		}
+		if !verify(set, nsSigs[rrsetKey(set[0])], parent.keys) {
+			return &trust{zone: name, security: bogus, reason: fmt.Sprintf("denial of DS of %v is not signed by %v", name, parent.zone)}
+		}
+		proven = true
+	}
+	if !proven {
+		return &trust{zone: name, security: bogus, reason: fmt.Sprintf("no proof that %v has no DS records", name)}
+	}
+
+	expires := parent.expires
+	for _, set := range nsSets {
+		expires = expiry(expires, set)
+	}
+
+	if m.Rcode == dns.RcodeNameError {
+		if !nxdomainProven(m.Ns, name) {
+			return &trust{zone: name, security: bogus, reason: fmt.Sprintf("no proof that %v doesn't exist", name)}
+		}
+		return &trust{zone: parent.zone, security: secure, keys: parent.keys, expires: expires}
+	}
+
+	types, ok := nsecTypes(m.Ns, name)
+	switch {
+	case ok && types[dns.TypeDS]:
+		return &trust{zone: name, security: bogus, reason: fmt.Sprintf("denial of DS of %v lists DS", name)}
+	case ok && types[dns.TypeNS] && !types[dns.TypeSOA]:
+		// a delegation without DS records is to an insecure zone
+		return &trust{zone: name, security: insecure, expires: expires}
+	case ok:
+		return &trust{zone: parent.zone, security: secure, keys: parent.keys, expires: expires}
+	case optOut(m.Ns, name):
+		// an unsigned delegation may be hidden by opt-out
+		return &trust{zone: name, security: insecure, expires: expires}
+	case emptyNonTerminal(m.Ns, name):
+		return &trust{zone: parent.zone, security: secure, keys: parent.keys, expires: expires}
+	}
+
+	return &trust{zone: name, security: bogus, reason: fmt.Sprintf("no proof that %v has no DS records", name)}
+}
+
+// keys fetches the DNSKEY records of a zone, trusting them if they are
+// signed by a key matching one of its DS records.
+func (v *validator) keys(ctx context.Context, zone string, ds []*dns.DS, expires time.Time) *trust {
+	// a zone whose DS records all use algorithms which can't be validated is
+	// treated as insecure, per RFC 4035 section 5.2
+	var supported bool
+	for _, d := range ds {
+		if supportedDS(d) {
+			supported = true
+		}
+	}
+	if !supported {
+		return &trust{zone: zone, security: insecure, expires: expires}
+	}
+
+	m, err := v.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return &trust{zone: zone, security: bogus, reason: fmt.Sprintf("error fetching DNSKEY of %v: %v", zone, err)}
+	}
+	sets, sigs := rrsets(m.Answer)
+	set, ok := sets[rrsetKeyOf(zone, dns.TypeDNSKEY)]
+	if !ok {
+		return &trust{zone: zone, security: bogus, reason: fmt.Sprintf("%v has no DNSKEY records", zone)}
+	}
+
+	var keys, anchored []*dns.DNSKEY
+	for _, rr := range set {
+		k := rr.(*dns.DNSKEY)
+		// only zone keys sign data
+		if k.Flags&dns.ZONE == 0 {
+			continue
+		}
+		keys = append(keys, k)
+		for _, d := range ds {
+			if matchesDS(k, d) {
+				anchored = append(anchored, k)
+				break
+			}
+		}
+	}
+	if len(anchored) == 0 {
+		return &trust{zone: zone, security: bogus, reason: fmt.Sprintf("no DNSKEY of %v matches its DS records", zone)}
+	}
+	if !verify(set, sigs[rrsetKey(set[0])], anchored) {
+		return &trust{zone: zone, security: bogus, reason: fmt.Sprintf("DNSKEY of %v is not signed by a key matching its DS records", zone)}
+	}
+
+	return &trust{zone: zone, security: secure, keys: keys, expires: expiry(expires, set)}
+}
+
+// verify returns whether any of the signatures of an RRset, which is within
+// its validity period, was made by one of the keys.
+func verify(set []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) bool {
+	t := now()
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(t) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(k, set); err == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func supportedDS(d *dns.DS) bool {
+	switch d.DigestType {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+	default:
+		return false
+	}
+	_, ok := dns.AlgorithmToHash[d.Algorithm]
+	return ok
+}
+
+func matchesDS(k *dns.DNSKEY, d *dns.DS) bool {
+	if k.KeyTag() != d.KeyTag || k.Algorithm != d.Algorithm {
+		return false
+	}
+	kd := k.ToDS(d.DigestType)
+	return kd != nil && strings.EqualFold(kd.Digest, d.Digest)
+}
+
+// expiry returns the earlier of t and the expiry of an RRset fetched now.
+func expiry(t time.Time, set []dns.RR) time.Time {
+	for _, rr := range set {
+		if e := now().Add(time.Duration(rr.Header().Ttl) * time.Second); e.Before(t) {
+			t = e
+		}
+	}
+
+	return t
+}
+
+// rrsets groups records into RRsets, and their signatures by the RRset they
+// cover, both keyed by rrsetKey.
+func rrsets(rrs []dns.RR) (map[string][]dns.RR, map[string][]*dns.RRSIG) {
+	sets := make(map[string][]dns.RR)
+	sigs := make(map[string][]*dns.RRSIG)
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k := rrsetKeyOf(sig.Hdr.Name, sig.TypeCovered)
+			sigs[k] = append(sigs[k], sig)
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		k := rrsetKey(rr)
+		sets[k] = append(sets[k], rr)
+	}
+
+	return sets, sigs
+}
+
+func rrsetKey(rr dns.RR) string {
+	return rrsetKeyOf(rr.Header().Name, rr.Header().Rrtype)
+}
+
+func rrsetKeyOf(name string, rrtype uint16) string {
+	return canonicalName(name) + "/" + dns.TypeToString[rrtype]
+}
+
+// synthesized returns whether a CNAME was synthesized from a DNAME among
+// the RRsets.
+func synthesized(c *dns.CNAME, sets map[string][]dns.RR) bool {
+	owner := canonicalName(c.Hdr.Name)
+	for _, set := range sets {
+		if d, ok := set[0].(*dns.DNAME); ok {
+			if apex := canonicalName(d.Hdr.Name); apex != owner && dns.IsSubDomain(apex, owner) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// stripDNSSEC removes the DNSSEC records from a message which the client
+// didn't ask for, other than those of the type it asked for.
+func stripDNSSEC(m *dns.Msg, qtype uint16) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		var kept []dns.RR
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+
+	m.Answer = strip(m.Answer)
+	m.Ns = strip(m.Ns)
+	m.Extra = strip(m.Extra)
+}
@@ -0,0 +1,625 @@
+package reverseoperator
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testSignedZone is a zone served by a testHierarchy, signed with a key of its
+// own unless it is insecure.
+type testSignedZone struct {
+	apex string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+	rrs  []dns.RR
+}
+
+// newTestSignedZone builds a zone from records, one per line; if signed, a
+// key is generated, and the zone is given an NSEC chain and signatures.
+func newTestSignedZone(t *testing.T, apex string, signed bool, records string) *testSignedZone {
+	z := &testSignedZone{apex: apex}
+	for _, line := range strings.Split(records, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatalf("%v: %v", line, err)
+		}
+		z.rrs = append(z.rrs, rr)
+	}
+	if !signed {
+		return z
+	}
+
+	z.key = &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: apex, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := z.key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.priv = priv.(crypto.Signer)
+	z.rrs = append(z.rrs, z.key)
+
+	// each name has an NSEC record pointing to the next in canonical order
+	types := make(map[string][]uint16)
+	for _, rr := range z.rrs {
+		name := rr.Header().Name
+		types[name] = append(types[name], rr.Header().Rrtype)
+	}
+	var names []string
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return canonicalCompare(names[i], names[j]) < 0 })
+	for i, name := range names {
+		bitmap := append(types[name], dns.TypeNSEC, dns.TypeRRSIG)
+		sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+		z.rrs = append(z.rrs, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: bitmap,
+		})
+	}
+
+	sets, _ := rrsets(z.rrs)
+	for _, set := range sets {
+		// a delegation's NS records are the child's, so aren't signed
+		h := set[0].Header()
+		if h.Rrtype == dns.TypeNS && h.Name != apex {
+			continue
+		}
+		z.rrs = append(z.rrs, z.sign(t, set, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour)))
+	}
+
+	return z
+}
+
+func (z *testSignedZone) sign(t *testing.T, set []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: set[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: set[0].Header().Ttl},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.apex,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(z.priv, set); err != nil {
+		t.Fatal(err)
+	}
+
+	return sig
+}
+
+// ds returns the DS record of the zone's key.
+func (z *testSignedZone) ds() string {
+	return z.key.ToDS(dns.SHA256).String()
+}
+
+// at returns the records at name of type qtype, along with their signatures.
+func (z *testSignedZone) at(name string, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.rrs {
+		if canonicalCompare(rr.Header().Name, name) != 0 {
+			continue
+		}
+		if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		} else if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+
+	return rrs
+}
+
+// exists returns whether name has records in the zone, or names below it do.
+func (z *testSignedZone) exists(name string) bool {
+	for _, rr := range z.rrs {
+		if dns.IsSubDomain(name, rr.Header().Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// covering returns the NSEC record covering name, along with its signature.
+func (z *testSignedZone) covering(name string) []dns.RR {
+	n := nsecCovering(z.rrs, name)
+	if n == nil {
+		return nil
+	}
+	return z.at(n.Hdr.Name, dns.TypeNSEC)
+}
+
+// testHierarchy answers questions as a recursive server would, from a set of
+// zones; tamper, if set, may change each response.
+type testHierarchy struct {
+	zones []*testSignedZone
+
+	mutex  sync.Mutex
+	tamper func(*dns.Msg)
+}
+
+func (h *testHierarchy) setTamper(tamper func(*dns.Msg)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.tamper = tamper
+}
+
+func (h *testHierarchy) zone(name string, qtype uint16) *testSignedZone {
+	var best *testSignedZone
+	for _, z := range h.zones {
+		if !dns.IsSubDomain(z.apex, name) {
+			continue
+		}
+		// DS records are served by the parent
+		if qtype == dns.TypeDS && z.apex == name && name != "." {
+			continue
+		}
+		if best == nil || dns.CountLabel(z.apex) > dns.CountLabel(best.apex) {
+			best = z
+		}
+	}
+
+	return best
+}
+
+func (h *testHierarchy) answer(m *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(m)
+	r.RecursionAvailable = true
+	h.lookup(r, canonicalName(m.Question[0].Name), m.Question[0].Qtype)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.tamper != nil {
+		h.tamper(r)
+	}
+	return r
+}
+
+func (h *testHierarchy) lookup(r *dns.Msg, name string, qtype uint16) {
+	z := h.zone(name, qtype)
+	soa := z.at(z.apex, dns.TypeSOA)
+
+	if rrs := z.at(name, qtype); len(rrs) > 0 {
+		r.Answer = append(r.Answer, rrs...)
+		return
+	}
+	if rrs := z.at(name, dns.TypeCNAME); len(rrs) > 0 {
+		r.Answer = append(r.Answer, rrs...)
+		h.lookup(r, rrs[0].(*dns.CNAME).Target, qtype)
+		return
+	}
+	if z.exists(name) {
+		r.Ns = append(append(soa, z.at(name, dns.TypeNSEC)...), z.covering(name)...)
+		return
+	}
+
+	ce := name
+	for !z.exists(ce) {
+		ce = ancestor(ce, dns.CountLabel(ce)-1)
+	}
+	wildcard := wildcardName(ce)
+	if rrs := z.at(wildcard, qtype); len(rrs) > 0 {
+		for _, rr := range rrs {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			r.Answer = append(r.Answer, rr)
+		}
+		r.Ns = z.covering(name)
+		return
+	}
+
+	r.Rcode = dns.RcodeNameError
+	r.Ns = append(append(soa, z.covering(name)...), z.covering(wildcard)...)
+}
+
+// newTestHierarchy builds a signed root zone, with a signed child zone
+// "example." and an unsigned child zone "insecure.". If mismatched, the DS
+// record of "example." doesn't match its key.
+func newTestHierarchy(t *testing.T, mismatched bool) (*testHierarchy, *DNSSECOptions) {
+	example := newTestSignedZone(t, "example.", true, `
+example. 300 IN SOA ns.example. hostmaster.example. 1 3600 600 86400 60
+example. 300 IN NS ns.example.
+ns.example. 300 IN A 192.0.2.53
+www.example. 300 IN A 192.0.2.1
+alias.example. 300 IN CNAME www.example.
+*.wild.example. 300 IN A 192.0.2.2
+`)
+	insecure := newTestSignedZone(t, "insecure.", false, `
+insecure. 300 IN SOA ns.insecure. hostmaster.insecure. 1 3600 600 86400 60
+insecure. 300 IN NS ns.insecure.
+host.insecure. 300 IN A 192.0.2.3
+`)
+
+	ds := example.ds()
+	if mismatched {
+		ds = newTestSignedZone(t, "example.", true, "").ds()
+	}
+	root := newTestSignedZone(t, ".", true, `
+. 300 IN SOA a.root. hostmaster.root. 1 3600 600 86400 60
+. 300 IN NS a.root.
+example. 300 IN NS ns.example.
+insecure. 300 IN NS ns.insecure.
+`+ds)
+
+	h := &testHierarchy{zones: []*testSignedZone{root, example, insecure}}
+	opts := &DNSSECOptions{TrustAnchors: []*dns.DS{root.key.ToDS(dns.SHA256)}}
+	return h, opts
+}
+
+func validatingProvider(t *testing.T, h *testHierarchy, opts *DNSSECOptions) (*DNSProvider, func()) {
+	restore := mockExchangeAddr(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		if !m.CheckingDisabled {
+			t.Errorf("expected upstream query for %v to disable checking", m.Question[0].Name)
+		}
+		if opt := m.IsEdns0(); opt == nil || !opt.Do() {
+			t.Errorf("expected upstream query for %v to ask for DNSSEC records", m.Question[0].Name)
+		}
+		return h.answer(m), nil
+	})
+
+	c, err := NewDNSProvider(testEndpoints("10.0.0.1"), &DNSProviderOptions{DNSSEC: opts})
+	if err != nil {
+		restore()
+		t.Fatal(err)
+	}
+
+	return c, restore
+}
+
+func TestDNSSECValidation(t *testing.T) {
+	h, opts := newTestHierarchy(t, false)
+	c, restore := validatingProvider(t, h, opts)
+	defer restore()
+
+	for _, tc := range []struct {
+		name     string
+		qtype    uint16
+		rcode    int
+		ad       bool
+		expected []string
+	}{
+		{"www.example.", dns.TypeA, dns.RcodeSuccess, true, []string{"192.0.2.1"}},
+		{"alias.example.", dns.TypeA, dns.RcodeSuccess, true, []string{"www.example.", "192.0.2.1"}},
+		{"a.wild.example.", dns.TypeA, dns.RcodeSuccess, true, []string{"192.0.2.2"}},
+		{"nope.example.", dns.TypeA, dns.RcodeNameError, true, nil},
+		{"www.example.", dns.TypeTXT, dns.RcodeSuccess, true, nil},
+		// an empty non-terminal exists, but has no records
+		{"wild.example.", dns.TypeA, dns.RcodeSuccess, true, nil},
+		{"example.", dns.TypeDNSKEY, dns.RcodeSuccess, true, []string{"dnskey"}},
+		{"host.insecure.", dns.TypeA, dns.RcodeSuccess, false, []string{"192.0.2.3"}},
+		{"nope.insecure.", dns.TypeA, dns.RcodeNameError, false, nil},
+	} {
+		resp, err := c.Resolve(context.Background(), question(tc.name, tc.qtype))
+		if err != nil {
+			t.Fatalf("%v[%v]: %v", tc.name, tc.qtype, err)
+		}
+		if resp.ResponseCode != tc.rcode {
+			t.Errorf("%v[%v]: expected rcode %v, got %v", tc.name, tc.qtype, tc.rcode, resp.ResponseCode)
+		}
+		if resp.AuthenticatedData != tc.ad {
+			t.Errorf("%v[%v]: expected AD %v, got %v", tc.name, tc.qtype, tc.ad, resp.AuthenticatedData)
+		}
+
+		var data []string
+		for _, a := range resp.Answer {
+			if a.Type == dns.TypeRRSIG {
+				t.Errorf("%v[%v]: expected signatures to be removed, got %v", tc.name, tc.qtype, a.Data)
+			}
+			if a.Type == dns.TypeDNSKEY {
+				data = append(data, "dnskey")
+				continue
+			}
+			data = append(data, a.Data)
+		}
+		if strings.Join(data, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("%v[%v]: expected %v, got %v", tc.name, tc.qtype, tc.expected, data)
+		}
+		for _, a := range resp.Authority {
+			if a.Type == dns.TypeNSEC || a.Type == dns.TypeRRSIG {
+				t.Errorf("%v[%v]: expected DNSSEC records to be removed, got %v", tc.name, tc.qtype, a.Data)
+			}
+		}
+	}
+}
+
+func TestDNSSECRecordsRequested(t *testing.T) {
+	h, opts := newTestHierarchy(t, false)
+	c, restore := validatingProvider(t, h, opts)
+	defer restore()
+
+	q := question("www.example.", dns.TypeA)
+	q.DNSSECOK = true
+	resp, err := c.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.AuthenticatedData {
+		t.Error("expected the response to be authenticated")
+	}
+	var signed bool
+	for _, a := range resp.Answer {
+		if a.Type == dns.TypeRRSIG {
+			signed = true
+		}
+	}
+	if !signed {
+		t.Errorf("expected signatures when asked for, got %v", resp.Answer)
+	}
+}
+
+func TestDNSSECBogus(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		name   string
+		qtype  uint16
+		tamper func(*dns.Msg)
+	}{
+		{
+			desc:  "altered data",
+			name:  "www.example.",
+			qtype: dns.TypeA,
+			tamper: func(r *dns.Msg) {
+				for _, rr := range r.Answer {
+					if a, ok := rr.(*dns.A); ok && a.Hdr.Name == "www.example." {
+						a.A = []byte{192, 0, 2, 99}
+					}
+				}
+			},
+		},
+		{
+			desc:  "missing signature",
+			name:  "www.example.",
+			qtype: dns.TypeA,
+			tamper: func(r *dns.Msg) {
+				if r.Question[0].Name == "www.example." {
+					r.Answer = removeType(r.Answer, dns.TypeRRSIG)
+				}
+			},
+		},
+		{
+			desc:  "missing denial of existence",
+			name:  "nope.example.",
+			qtype: dns.TypeA,
+			tamper: func(r *dns.Msg) {
+				r.Ns = removeType(r.Ns, dns.TypeNSEC)
+			},
+		},
+		{
+			desc:  "missing denial of records",
+			name:  "www.example.",
+			qtype: dns.TypeTXT,
+			tamper: func(r *dns.Msg) {
+				r.Ns = removeType(r.Ns, dns.TypeNSEC)
+			},
+		},
+		{
+			desc:  "wildcard answer without denial of the name",
+			name:  "a.wild.example.",
+			qtype: dns.TypeA,
+			tamper: func(r *dns.Msg) {
+				r.Ns = removeType(r.Ns, dns.TypeNSEC)
+			},
+		},
+		{
+			desc:  "unsigned delegation passed off as insecure",
+			name:  "www.example.",
+			qtype: dns.TypeA,
+			tamper: func(r *dns.Msg) {
+				if r.Question[0].Qtype == dns.TypeDS {
+					r.Answer = nil
+				}
+			},
+		},
+	} {
+		h, opts := newTestHierarchy(t, false)
+		h.setTamper(tc.tamper)
+		c, restore := validatingProvider(t, h, opts)
+
+		resp, err := c.Resolve(context.Background(), question(tc.name, tc.qtype))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.desc, err)
+		}
+		if resp.ResponseCode != dns.RcodeServerFailure {
+			t.Errorf("%v: expected SERVFAIL, got %v", tc.desc, dns.RcodeToString[resp.ResponseCode])
+		}
+		if len(resp.Answer) != 0 {
+			t.Errorf("%v: expected no answer, got %v", tc.desc, resp.Answer)
+		}
+		restore()
+	}
+}
+
+func removeType(rrs []dns.RR, rrtype uint16) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != rrtype {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+func TestDNSSECBogusCheckingDisabled(t *testing.T) {
+	h, opts := newTestHierarchy(t, true)
+	c, restore := validatingProvider(t, h, opts)
+	defer restore()
+
+	resp, err := c.Resolve(context.Background(), question("www.example.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeServerFailure {
+		t.Errorf("expected a mismatched DS to fail validation, got %v", dns.RcodeToString[resp.ResponseCode])
+	}
+
+	q := question("www.example.", dns.TypeA)
+	q.CheckingDisabled = true
+	resp, err = c.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.Answer[0].Data != "192.0.2.1" {
+		t.Errorf("expected the data when checking is disabled, got %v %v", dns.RcodeToString[resp.ResponseCode], resp.Answer)
+	}
+	if resp.AuthenticatedData {
+		t.Error("expected bogus data not to be authenticated")
+	}
+	if !resp.CheckingDisabled {
+		t.Error("expected checking to be reported disabled")
+	}
+
+	// zones without a chain of trust to the mismatch are unaffected
+	resp, err = c.Resolve(context.Background(), question("host.insecure.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeSuccess {
+		t.Errorf("expected the insecure zone to be unaffected, got %v", dns.RcodeToString[resp.ResponseCode])
+	}
+}
+
+func TestDNSSECExpiredSignatures(t *testing.T) {
+	h, opts := newTestHierarchy(t, false)
+	c, restore := validatingProvider(t, h, opts)
+	defer restore()
+
+	_, restoreNow := mockNow(time.Now().Add(48 * time.Hour))
+	defer restoreNow()
+
+	resp, err := c.Resolve(context.Background(), question("www.example.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeServerFailure {
+		t.Errorf("expected expired signatures to fail validation, got %v", dns.RcodeToString[resp.ResponseCode])
+	}
+}
+
+func TestDNSSECTrustCached(t *testing.T) {
+	h, opts := newTestHierarchy(t, false)
+	var (
+		mutex   sync.Mutex
+		queries = make(map[string]int)
+	)
+	defer mockExchangeAddr(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		mutex.Lock()
+		queries[m.Question[0].Name+"/"+dns.TypeToString[m.Question[0].Qtype]]++
+		mutex.Unlock()
+		return h.answer(m), nil
+	})()
+
+	c, err := NewDNSProvider(testEndpoints("10.0.0.1"), &DNSProviderOptions{DNSSEC: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"www.example.", "alias.example.", "www.example."} {
+		if _, err := c.Resolve(context.Background(), question(name, dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, k := range []string{"./DNSKEY", "example./DS", "example./DNSKEY"} {
+		if queries[k] != 1 {
+			t.Errorf("expected %v to be fetched once, got %v", k, queries[k])
+		}
+	}
+}
+
+func TestDNSSECTrustBounded(t *testing.T) {
+	h, opts := newTestHierarchy(t, false)
+	v, err := newValidator(opts, func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		return h.answer(m), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// names beneath the unsigned zone are insecure without any queries
+	// beyond the first, so many may be looked up cheaply
+	for i := 0; i < maxTrusts*2; i++ {
+		name := fmt.Sprintf("r%v.insecure.", i)
+		if tr := v.trust(context.Background(), name); tr.security != insecure {
+			t.Fatalf("%v: expected insecure, got %v", name, tr.security)
+		}
+		if l := len(v.trusts); l > maxTrusts {
+			t.Fatalf("expected at most %v cached trusts, got %v", maxTrusts, l)
+		}
+	}
+
+	// once expired, trusts are removed before any others
+	_, restore := mockNow(now().Add(2 * maxTrustTTL))
+	defer restore()
+	for i := 0; i < maxTrusts/5; i++ {
+		v.trust(context.Background(), fmt.Sprintf("s%v.insecure.", i))
+	}
+	if l := len(v.trusts); l > maxTrusts/5+3 {
+		t.Errorf("expected expired trusts to be removed, got %v cached", l)
+	}
+}
+
+func TestParseTrustAnchors(t *testing.T) {
+	h, _ := newTestHierarchy(t, false)
+	root := h.zones[0]
+
+	anchors, err := ParseTrustAnchors(strings.NewReader(root.key.String() + "\n" + DefaultTrustAnchors))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anchors) != 3 {
+		t.Fatalf("expected 3 anchors, got %v", len(anchors))
+	}
+	if !matchesDS(root.key, anchors[0]) {
+		t.Errorf("expected a DNSKEY anchor to be converted to its DS, got %v", anchors[0])
+	}
+
+	for _, content := range []string{
+		"",
+		"example. 300 IN A 192.0.2.1",
+		". IN DS not a ds",
+	} {
+		if _, err := ParseTrustAnchors(strings.NewReader(content)); err == nil {
+			t.Errorf("%q: expected an error", content)
+		}
+	}
+}
+
+func TestStripDNSSEC(t *testing.T) {
+	m := new(dns.Msg)
+	for _, s := range []string{
+		"example. 300 IN NSEC www.example. A NSEC RRSIG",
+		"example. 300 IN A 192.0.2.1",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+
+	stripDNSSEC(m, dns.TypeNSEC)
+	if len(m.Answer) != 2 {
+		t.Errorf("expected records of the asked type to be kept, got %v", m.Answer)
+	}
+	stripDNSSEC(m, dns.TypeA)
+	if len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("expected NSEC records to be removed, got %v", m.Answer)
+	}
+}
@@ -0,0 +1,141 @@
+package reverseoperator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	errClientSubnetInvalid = errors.New("edns_client_subnet parameter must be an IP address or CIDR subnet")
+	errClientSubnetFamily  = errors.New("client subnet option has an unknown address family")
+	errClientSubnetPrefix  = errors.New("client subnet option has a prefix length too long for its address family")
+)
+
+// parseClientSubnet parses an `edns_client_subnet` parameter, which may be
+// either a CIDR subnet or a bare address; a bare address is used in full.
+func parseClientSubnet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errClientSubnetInvalid
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+	}
+
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, errClientSubnetInvalid
+	}
+
+	return n, nil
+}
+
+// clientSubnetFromAddr derives a client subnet from a request's remote
+// address, in `host:port` form, truncating it to the given prefix length
+// depending on its address family so that the full address is never sent;
+// if the prefix length is out of range for the family, there is none.
+func clientSubnetFromAddr(addr string, v4Prefix, v6Prefix int) *net.IPNet {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		m := net.CIDRMask(v4Prefix, net.IPv4len*8)
+		if m == nil {
+			return nil
+		}
+		return &net.IPNet{IP: ip4.Mask(m), Mask: m}
+	}
+
+	m := net.CIDRMask(v6Prefix, net.IPv6len*8)
+	if m == nil {
+		return nil
+	}
+	return &net.IPNet{IP: ip.Mask(m), Mask: m}
+}
+
+// clientSubnetString formats a client subnet as Google's API does, which is
+// the subnet address followed by the prefix length.
+func clientSubnetString(n *net.IPNet) string {
+	ones, _ := n.Mask.Size()
+	return fmt.Sprintf("%v/%v", n.IP, ones)
+}
+
+func clientSubnetToOption(n *net.IPNet) *dns.EDNS0_SUBNET {
+	ones, _ := n.Mask.Size()
+	e := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+	}
+
+	if ip4 := n.IP.To4(); ip4 != nil {
+		e.Family = 1
+		e.Address = ip4
+	} else {
+		e.Family = 2
+		e.Address = n.IP.To16()
+	}
+
+	return e
+}
+
+// clientSubnetOption finds the client subnet option in an OPT record.
+func clientSubnetOption(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// optionToClientSubnet converts a client subnet option to the address it
+// carries, with a mask of the given prefix length; this is the source prefix
+// in a query, and usually the scope prefix in a response. An option with
+// prefix lengths out of range for its family is rejected, as RFC 7871
+// section 7.1.1 requires.
+func optionToClientSubnet(e *dns.EDNS0_SUBNET, prefix uint8) (*net.IPNet, error) {
+	var (
+		ip   net.IP
+		bits int
+	)
+	switch e.Family {
+	// a family of zero is only sent with a zero-length prefix, by clients
+	// asking that their address not be used
+	case 0, 1:
+		ip, bits = e.Address.To4(), net.IPv4len*8
+	case 2:
+		ip, bits = e.Address.To16(), net.IPv6len*8
+	default:
+		return nil, errClientSubnetFamily
+	}
+	if ip == nil {
+		return nil, errClientSubnetFamily
+	}
+	if int(e.SourceNetmask) > bits || int(prefix) > bits {
+		return nil, errClientSubnetPrefix
+	}
+
+	return &net.IPNet{
+		IP:   ip.Mask(net.CIDRMask(int(e.SourceNetmask), bits)),
+		Mask: net.CIDRMask(int(prefix), bits),
+	}, nil
+}
@@ -0,0 +1,113 @@
+package reverseoperator
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseClientSubnet(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"1.2.3.4/24", "1.2.3.0/24"},
+		{"1.2.3.4", "1.2.3.4/32"},
+		{"0.0.0.0/0", "0.0.0.0/0"},
+		{"2001:db8::1/56", "2001:db8::/56"},
+		{"2001:db8::1", "2001:db8::1/128"},
+	}
+
+	for _, tt := range tests {
+		n, err := parseClientSubnet(tt.in)
+		if err != nil {
+			t.Errorf("unexpected error for %v: %v", tt.in, err)
+			continue
+		}
+		if s := clientSubnetString(n); s != tt.out {
+			t.Errorf("expected %v for %v, got %v", tt.out, tt.in, s)
+		}
+	}
+
+	for _, in := range []string{"wut", "1.2.3.4/33", "1.2.3/24"} {
+		if _, err := parseClientSubnet(in); err != errClientSubnetInvalid {
+			t.Errorf("unexpected error for %v: %v", in, err)
+		}
+	}
+}
+
+func TestClientSubnetFromAddr(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"192.0.2.55:1234", "192.0.2.0/24"},
+		{"[2001:db8:1:2:3::1]:1234", "2001:db8:1::/56"},
+	}
+
+	for _, tt := range tests {
+		n := clientSubnetFromAddr(tt.in, 24, 56)
+		if n == nil {
+			t.Errorf("expected subnet for %v", tt.in)
+			continue
+		}
+		if s := clientSubnetString(n); s != tt.out {
+			t.Errorf("expected %v for %v, got %v", tt.out, tt.in, s)
+		}
+	}
+
+	if n := clientSubnetFromAddr("wut", 24, 56); n != nil {
+		t.Errorf("unexpected subnet %v", n)
+	}
+	if n := clientSubnetFromAddr("192.0.2.55:1234", 33, 56); n != nil {
+		t.Errorf("expected no subnet for an out of range prefix, got %v", n)
+	}
+	if n := clientSubnetFromAddr("[2001:db8::1]:1234", 24, 129); n != nil {
+		t.Errorf("expected no subnet for an out of range prefix, got %v", n)
+	}
+}
+
+func TestOptionToClientSubnetInvalid(t *testing.T) {
+	for _, e := range []*dns.EDNS0_SUBNET{
+		{Family: 1, SourceNetmask: 33, Address: net.ParseIP("192.0.2.0")},
+		{Family: 1, SourceNetmask: 24, SourceScope: 40, Address: net.ParseIP("192.0.2.0")},
+		{Family: 2, SourceNetmask: 129, Address: net.ParseIP("2001:db8::")},
+		{Family: 3, SourceNetmask: 8, Address: net.ParseIP("192.0.2.0")},
+	} {
+		if n, err := optionToClientSubnet(e, e.SourceScope); err == nil {
+			t.Errorf("%v: expected an error, got %v", e, n)
+		}
+	}
+}
+
+func TestClientSubnetOptionRoundTrip(t *testing.T) {
+	n, err := parseClientSubnet("2001:db8::/48")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.SetEdns0(ednsUDPSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, clientSubnetToOption(n))
+
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+
+	e := clientSubnetOption(m.IsEdns0())
+	if e == nil {
+		t.Fatal("expected client subnet option")
+	}
+	n, err = optionToClientSubnet(e, e.SourceNetmask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := clientSubnetString(n); s != "2001:db8::/48" {
+		t.Errorf("unexpected subnet %v", s)
+	}
+}
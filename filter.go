@@ -0,0 +1,572 @@
+package reverseoperator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultBlockTTL is the TTL of records answered for blocked names when no
+	// other TTL is configured.
+	DefaultBlockTTL = 60
+	// DefaultFilterReloadInterval is how often filter lists are checked for
+	// changes when no other interval is configured.
+	DefaultFilterReloadInterval = 30 * time.Second
+)
+
+// BlockAction is how a Filter answers questions for blocked names.
+type BlockAction int
+
+const (
+	// BlockNXDomain answers that the name doesn't exist
+	BlockNXDomain BlockAction = iota
+	// BlockRefused refuses to answer
+	BlockRefused
+	// BlockNull answers A questions with 0.0.0.0 and AAAA questions with ::
+	BlockNull
+	// BlockAddress answers A and AAAA questions with the configured addresses
+	BlockAddress
+)
+
+var blockActionNames = map[BlockAction]string{
+	BlockNXDomain: "nxdomain",
+	BlockRefused:  "refused",
+	BlockNull:     "null",
+	BlockAddress:  "address",
+}
+
+func (a BlockAction) String() string {
+	if n, ok := blockActionNames[a]; ok {
+		return n
+	}
+	return fmt.Sprintf("BlockAction(%d)", int(a))
+}
+
+// ParseBlockAction parses the name of a BlockAction, as returned by its
+// String method.
+func ParseBlockAction(name string) (BlockAction, error) {
+	for a, n := range blockActionNames {
+		if n == name {
+			return a, nil
+		}
+	}
+
+	var names []string
+	for _, n := range blockActionNames {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return 0, fmt.Errorf("block action must be one of %v", strings.Join(names, ", "))
+}
+
+// BlockPolicy is how questions for blocked names are answered.
+type BlockPolicy struct {
+	// Action is how questions are answered.
+	Action BlockAction
+	// Addresses are answered when Action is BlockAddress; IPv4 addresses for
+	// A questions, and IPv6 addresses for AAAA questions.
+	Addresses []net.IP
+}
+
+func (p *BlockPolicy) validate() error {
+	if p.Action == BlockAddress && len(p.Addresses) == 0 {
+		return fmt.Errorf("addresses are required to block with %v", BlockAddress)
+	}
+
+	return nil
+}
+
+// FilterList is a file of names to block, or to allow.
+type FilterList struct {
+	// Path is the location of the file
+	Path string
+	// Allow makes the list an allowlist, whose names are never blocked,
+	// whichever list they are in.
+	Allow bool
+	// Policy is how questions for names blocked by the list are answered; if
+	// nil, the Filter's Action and Addresses are used.
+	Policy *BlockPolicy
+}
+
+// FilterOptions is a configuration object for optional Filter configuration
+type FilterOptions struct {
+	// Action is how questions for blocked names are answered, unless their
+	// list has a policy of its own.
+	Action BlockAction
+	// Addresses are answered for blocked names when Action is BlockAddress;
+	// IPv4 addresses for A questions, and IPv6 addresses for AAAA questions.
+	Addresses []net.IP
+	// TTL is the TTL of records answered for blocked names; if zero,
+	// DefaultBlockTTL is used.
+	TTL uint32
+	// ReloadInterval is how often lists are checked for changes, and
+	// reloaded if changed; if zero, DefaultFilterReloadInterval is used, and
+	// if negative, lists are never reloaded.
+	ReloadInterval time.Duration
+}
+
+// NewFilter creates a Filter, loading each of the lists. Where a name is
+// blocked by more than one list, the rule of the first is used.
+func NewFilter(fallback Resolver, lists []FilterList, opts *FilterOptions) (*Filter, error) {
+	if opts == nil {
+		opts = &FilterOptions{}
+	}
+
+	f := &Filter{
+		fallback: fallback,
+		policy:   BlockPolicy{Action: opts.Action, Addresses: opts.Addresses},
+		ttl:      opts.TTL,
+	}
+	if err := f.policy.validate(); err != nil {
+		return nil, err
+	}
+	if f.ttl == 0 {
+		f.ttl = DefaultBlockTTL
+	}
+	for _, l := range lists {
+		if l.Policy != nil {
+			if err := l.Policy.validate(); err != nil {
+				return nil, fmt.Errorf("%v: %v", l.Path, err)
+			}
+		}
+		fl := &filterFile{FilterList: l}
+		if err := fl.load(); err != nil {
+			return nil, err
+		}
+		f.files = append(f.files, fl)
+	}
+	f.block, f.allow = mergeRules(f.files)
+
+	interval := opts.ReloadInterval
+	if interval == 0 {
+		interval = DefaultFilterReloadInterval
+	}
+	f.watcher = newWatcher(interval, f.reload)
+
+	return f, nil
+}
+
+// Filter is a Resolver which blocks questions for names in its lists, and
+// passes all others to another Resolver. A listed name blocks all of its
+// subdomains too, unless an allowlist or exception rule allows them. Lists
+// may be in the format of a hosts file, a plain list of names, or AdBlock
+// style "||name^" rules, and are reloaded when they change on disk.
+type Filter struct {
+	// fields accessed atomically come first, for alignment
+	queries uint64
+	blocks  uint64
+	allows  uint64
+
+	fallback Resolver
+	policy   BlockPolicy
+	ttl      uint32
+	files    []*filterFile
+
+	mutex sync.RWMutex
+	block *ruleSet
+	allow *ruleSet
+
+	watcher *watcher
+}
+
+// FilterStats holds statistics of a Filter.
+type FilterStats struct {
+	// Queries is the number of questions filtered
+	Queries uint64
+	// Blocked is the number of questions blocked
+	Blocked uint64
+	// Allowed is the number of questions which would have been blocked, but
+	// were allowed
+	Allowed uint64
+	// Rules is the number of rules which block names
+	Rules int
+}
+
+// Stats returns the statistics of the filter so far.
+func (f *Filter) Stats() FilterStats {
+	f.mutex.RLock()
+	rules := f.block.len()
+	f.mutex.RUnlock()
+
+	return FilterStats{
+		Queries: atomic.LoadUint64(&f.queries),
+		Blocked: atomic.LoadUint64(&f.blocks),
+		Allowed: atomic.LoadUint64(&f.allows),
+		Rules:   rules,
+	}
+}
+
+// Resolve blocks a question if its name is listed, or otherwise passes it to
+// the fallback; it implements Resolver. The response to a blocked question
+// explains which rule blocked it in its Comment.
+func (f *Filter) Resolve(ctx context.Context, q Question) (*Response, error) {
+	atomic.AddUint64(&f.queries, 1)
+
+	f.mutex.RLock()
+	block, allow := f.block, f.allow
+	f.mutex.RUnlock()
+
+	rule := block.match(q.Name)
+	if rule == nil {
+		return f.fallback.Resolve(ctx, q)
+	}
+	if a := allow.match(q.Name); a != nil {
+		atomic.AddUint64(&f.allows, 1)
+		log.Debugf("allowing %v, %v", q.Name, a)
+		return f.fallback.Resolve(ctx, q)
+	}
+
+	atomic.AddUint64(&f.blocks, 1)
+	log.Debugf("blocking %v, %v", q.Name, rule)
+	resp := f.answer(q, rule)
+	resp.Comment = fmt.Sprintf("Blocked by %v", rule)
+	return resp, nil
+}
+
+// answer answers a question for a name blocked by a rule.
+func (f *Filter) answer(q Question, rule *filterRule) *Response {
+	m := new(dns.Msg)
+	m.Question = []dns.Question{{Name: dns.Fqdn(q.Name), Qtype: q.Type, Qclass: dns.ClassINET}}
+	m.RecursionDesired = true
+	m.RecursionAvailable = true
+
+	policy := &f.policy
+	if rule.list.Policy != nil {
+		policy = rule.list.Policy
+	}
+
+	var addresses []net.IP
+	switch policy.Action {
+	case BlockNXDomain:
+		m.Rcode = dns.RcodeNameError
+	case BlockRefused:
+		m.Rcode = dns.RcodeRefused
+	case BlockNull:
+		addresses = []net.IP{net.IPv4zero, net.IPv6zero}
+	case BlockAddress:
+		addresses = policy.Addresses
+	}
+
+	// other questions for the name have an empty answer
+	hdr := dns.RR_Header{Name: dns.Fqdn(q.Name), Class: dns.ClassINET, Ttl: f.ttl}
+	for _, ip := range addresses {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dns.TypeA {
+			hdr.Rrtype = dns.TypeA
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && q.Type == dns.TypeAAAA {
+			hdr.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+
+	return msgToResponse(q, m)
+}
+
+// Close stops watching lists for changes.
+func (f *Filter) Close() error {
+	f.watcher.close()
+
+	return nil
+}
+
+// reload reloads any lists which have changed; a list which fails to load
+// keeps its previous names.
+func (f *Filter) reload() {
+	var reloaded bool
+	for _, l := range f.files {
+		changed, err := l.stamp.changed(l.Path)
+		if err != nil {
+			log.Errorf("error checking filter list %v: %v", l.Path, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		if err := l.load(); err != nil {
+			log.Errorf("error reloading filter list, keeping previous names: %v", err)
+			continue
+		}
+		reloaded = true
+		log.Infof("reloaded filter list %v", l.Path)
+	}
+	if !reloaded {
+		return
+	}
+
+	block, allow := mergeRules(f.files)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.block, f.allow = block, allow
+}
+
+type filterFile struct {
+	FilterList
+	stamp fileStamp
+	// block and allow hold the list's rules which block and allow names; an
+	// allowlist only has rules which allow
+	block *ruleSet
+	allow *ruleSet
+}
+
+// load loads the rules of the list, recording the file's modification time
+// and size to tell when it has changed.
+func (l *filterFile) load() error {
+	file, err := os.Open(l.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	block, allow, err := parseFilterList(file, l)
+	if err != nil {
+		return fmt.Errorf("%v: %v", l.Path, err)
+	}
+	if l.Allow {
+		allow.merge(block)
+		block = newRuleSet()
+	}
+
+	l.block, l.allow, l.stamp = block, allow, newFileStamp(info)
+	return nil
+}
+
+// filterRule is a rule of a list, which matched a name.
+type filterRule struct {
+	list *filterFile
+	// rule is the rule as written in the list
+	rule string
+	// pattern matches names, for rules given as regular expressions
+	pattern *regexp.Regexp
+}
+
+func (r *filterRule) String() string {
+	return fmt.Sprintf("rule %q of list %v", r.rule, r.list.Path)
+}
+
+// ruleSet is a set of rules, which matches a name if it or any of its parents
+// is listed, or it matches any pattern.
+type ruleSet struct {
+	// names holds the rules of listed names, keyed by their canonical form
+	names    map[string]*filterRule
+	patterns []*filterRule
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{names: make(map[string]*filterRule)}
+}
+
+// add adds a rule for a name, unless the name already has one.
+func (s *ruleSet) add(name string, r *filterRule) {
+	if _, ok := s.names[name]; !ok {
+		s.names[name] = r
+	}
+}
+
+// merge adds the rules of another set to the set.
+func (s *ruleSet) merge(o *ruleSet) {
+	for name, r := range o.names {
+		s.add(name, r)
+	}
+	s.patterns = append(s.patterns, o.patterns...)
+}
+
+func (s *ruleSet) len() int {
+	return len(s.names) + len(s.patterns)
+}
+
+// match returns the rule which matches name, if any. The rule of the most
+// specific listed name is preferred, then the first pattern to match.
+func (s *ruleSet) match(name string) *filterRule {
+	name = canonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if r, ok := s.names[name[off:]]; ok {
+			return r
+		}
+	}
+
+	// patterns are written for names as they're usually seen, without the
+	// trailing dot
+	bare := strings.TrimSuffix(name, ".")
+	for _, r := range s.patterns {
+		if r.pattern.MatchString(bare) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// mergeRules merges the rules of lists, in order.
+func mergeRules(files []*filterFile) (block, allow *ruleSet) {
+	block, allow = newRuleSet(), newRuleSet()
+	for _, l := range files {
+		block.merge(l.block)
+		allow.merge(l.allow)
+	}
+
+	return block, allow
+}
+
+// hostsListNames are names which hosts format lists give for the local host,
+// rather than to block
+var hostsListNames = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+	"0.0.0.0.":               true,
+}
+
+// parseFilterList parses the rules of a list, one or more per line in any of
+// the formats:
+//
+//	0.0.0.0 name [name...]   a hosts file
+//	name                     a plain list of names
+//	||name^                  an AdBlock style rule
+//	/regexp/                 a regular expression, matching whole names
+//
+// An AdBlock style rule or regular expression may be preceded by "@@" to make
+// it an exception, which allows rather than blocks. Anything following a "#"
+// is a comment, as are lines starting with "!" or "[" in AdBlock style lists.
+// Published lists are often untidy, so lines which can't be understood, or
+// AdBlock rules which apply to more than a name, are skipped rather than
+// failing the whole list.
+func parseFilterList(r io.Reader, l *filterFile) (block, allow *ruleSet, err error) {
+	block, allow = newRuleSet(), newRuleSet()
+
+	var skipped int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '!' || text[0] == '[' {
+			continue
+		}
+
+		set, rule := block, text
+		if strings.HasPrefix(rule, "@@") {
+			set, rule = allow, rule[2:]
+		}
+		if len(rule) > 2 && rule[0] == '/' && rule[len(rule)-1] == '/' {
+			pattern, err := regexp.Compile(rule[1 : len(rule)-1])
+			if err != nil {
+				skipped++
+				continue
+			}
+			set.patterns = append(set.patterns, &filterRule{list: l, rule: text, pattern: pattern})
+			continue
+		}
+		if strings.HasPrefix(rule, "||") {
+			name, ok := parseAdBlockRule(rule)
+			if !ok {
+				skipped++
+				continue
+			}
+			set.add(canonicalName(name), &filterRule{list: l, rule: text})
+			continue
+		}
+		if set != block {
+			skipped++
+			continue
+		}
+
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		switch {
+		case len(fields) == 0:
+			continue
+		case len(fields) == 1:
+		case net.ParseIP(fields[0]) != nil:
+			fields = fields[1:]
+		default:
+			skipped++
+			continue
+		}
+
+		for _, n := range fields {
+			n = strings.TrimPrefix(n, "*.")
+			if !isListName(n) {
+				skipped++
+				continue
+			}
+			if name := canonicalName(n); !hostsListNames[name] {
+				block.add(name, &filterRule{list: l, rule: n})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if skipped > 0 {
+		log.Warnf("%v: skipped %v entries which could not be understood", l.Path, skipped)
+	}
+	return block, allow, nil
+}
+
+// parseAdBlockRule parses the name of an AdBlock style "||name^" rule. Rules
+// with options, other than $important, apply to only some requests for the
+// name, so aren't understood.
+func parseAdBlockRule(rule string) (string, bool) {
+	rule = strings.TrimPrefix(rule, "||")
+	if i := strings.Index(rule, "$"); i >= 0 {
+		if rule[i+1:] != "important" {
+			return "", false
+		}
+		rule = rule[:i]
+	}
+	rule = strings.TrimSuffix(rule, "^")
+
+	if !isListName(rule) {
+		return "", false
+	}
+
+	return rule, true
+}
+
+// isListName returns whether a name in a list is a valid host name; a name
+// with other characters is more likely a pattern or rule which isn't
+// understood.
+func isListName(name string) bool {
+	if _, ok := dns.IsDomainName(name); !ok || name == "" || name == "." {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,351 @@
+package reverseoperator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testFilterList = `
+# hosts format
+0.0.0.0 ads.example.com tracker.example.com
+127.0.0.1 localhost
+:: ipv6.example.com
+
+# plain names
+Telemetry.Example.Net
+*.wild.example.org
+
+! AdBlock style
+[Adblock Plus 2.0]
+||doubleclick.example^
+||important.example^$important
+||thirdparty.example^$third-party
+||example.com/path^
+@@||allowed.example^
+/^ad[0-9]+\./
+@@/^ok\.example\./
+@@plain.example
+/[invalid/
+`
+
+func writeFilterList(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "list")
+	writeZoneFile(t, path, content)
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func ruleNames(s *ruleSet) map[string]string {
+	names := make(map[string]string)
+	for name, r := range s.names {
+		names[name] = r.rule
+	}
+	for _, r := range s.patterns {
+		names[r.pattern.String()] = r.rule
+	}
+	return names
+}
+
+func TestParseFilterList(t *testing.T) {
+	block, allow, err := parseFilterList(strings.NewReader(testFilterList), &filterFile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"ads.example.com.":       "ads.example.com",
+		"tracker.example.com.":   "tracker.example.com",
+		"ipv6.example.com.":      "ipv6.example.com",
+		"telemetry.example.net.": "Telemetry.Example.Net",
+		"wild.example.org.":      "wild.example.org",
+		"doubleclick.example.":   "||doubleclick.example^",
+		"important.example.":     "||important.example^$important",
+		`^ad[0-9]+\.`:            `/^ad[0-9]+\./`,
+	}
+	if names := ruleNames(block); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected block rules %v, got %v", expected, names)
+	}
+
+	expected = map[string]string{
+		"allowed.example.": "@@||allowed.example^",
+		`^ok\.example\.`:   `@@/^ok\.example\./`,
+	}
+	if names := ruleNames(allow); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected allow rules %v, got %v", expected, names)
+	}
+}
+
+func TestRuleSetMatch(t *testing.T) {
+	l := &filterFile{}
+	s := newRuleSet()
+	s.add("ads.example.com.", &filterRule{list: l, rule: "ads.example.com"})
+	s.add("x.ads.example.com.", &filterRule{list: l, rule: "x.ads.example.com"})
+	s.patterns = append(s.patterns, &filterRule{list: l, rule: "/^ad[0-9]+[.]/", pattern: regexp.MustCompile(`^ad[0-9]+[.]`)})
+
+	for name, expected := range map[string]string{
+		"ads.example.com":       "ads.example.com",
+		"ADS.EXAMPLE.COM.":      "ads.example.com",
+		"a.b.ads.example.com":   "ads.example.com",
+		"a.x.ads.example.com":   "x.ads.example.com",
+		"bads.example.com":      "",
+		"example.com":           "",
+		"ad12.example.net":      "/^ad[0-9]+[.]/",
+		"notad12.example.net":   "",
+		"ad.example.net":        "",
+		"AD7.Example.Net.":      "/^ad[0-9]+[.]/",
+		"ad12.ads.example.com.": "ads.example.com",
+	} {
+		var rule string
+		if r := s.match(name); r != nil {
+			rule = r.rule
+		}
+		if rule != expected {
+			t.Errorf("%v: expected to match %q, got %q", name, expected, rule)
+		}
+	}
+}
+
+func TestFilterActions(t *testing.T) {
+	path, cleanup := writeFilterList(t, testFilterList)
+	defer cleanup()
+
+	for _, c := range []struct {
+		opts     FilterOptions
+		qtype    uint16
+		rcode    int
+		expected []string
+	}{
+		{FilterOptions{Action: BlockNXDomain}, dns.TypeA, dns.RcodeNameError, []string{}},
+		{FilterOptions{Action: BlockRefused}, dns.TypeA, dns.RcodeRefused, []string{}},
+		{FilterOptions{Action: BlockNull}, dns.TypeA, dns.RcodeSuccess, []string{"0.0.0.0"}},
+		{FilterOptions{Action: BlockNull}, dns.TypeAAAA, dns.RcodeSuccess, []string{"::"}},
+		{FilterOptions{Action: BlockNull}, dns.TypeMX, dns.RcodeSuccess, []string{}},
+		{
+			FilterOptions{Action: BlockAddress, Addresses: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}},
+			dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.1"},
+		},
+		{
+			FilterOptions{Action: BlockAddress, Addresses: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}},
+			dns.TypeAAAA, dns.RcodeSuccess, []string{"2001:db8::1"},
+		},
+	} {
+		opts := c.opts
+		opts.ReloadInterval = -1
+		f, err := NewFilter(answerResolver(60), []FilterList{{Path: path}}, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := f.Resolve(context.Background(), question("x.ads.example.com", c.qtype))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ResponseCode != c.rcode {
+			t.Errorf("%v[%v]: expected rcode %v, got %v", opts.Action, c.qtype, c.rcode, resp.ResponseCode)
+		}
+		if data := answerData(t, f, "x.ads.example.com", c.qtype); !reflect.DeepEqual(data, c.expected) {
+			t.Errorf("%v[%v]: expected %v, got %v", opts.Action, c.qtype, c.expected, data)
+		}
+		if len(resp.Answer) > 0 && resp.Answer[0].TTL != DefaultBlockTTL {
+			t.Errorf("expected the default TTL, got %v", resp.Answer[0].TTL)
+		}
+
+		// names which aren't listed are resolved
+		if data := answerData(t, f, "example.com", dns.TypeA); !reflect.DeepEqual(data, []string{"127.0.0.1"}) {
+			t.Errorf("expected example.com to be resolved, got %v", data)
+		}
+
+		f.Close()
+	}
+}
+
+func TestFilterStats(t *testing.T) {
+	path, cleanup := writeFilterList(t, "ads.example.com\n")
+	defer cleanup()
+
+	f, err := NewFilter(answerResolver(60), []FilterList{{Path: path}}, &FilterOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, name := range []string{"ads.example.com", "example.com", "a.ads.example.com"} {
+		if _, err := f.Resolve(context.Background(), question(name, dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := FilterStats{Queries: 3, Blocked: 2, Rules: 1}
+	if s := f.Stats(); s != expected {
+		t.Errorf("expected %+v, got %+v", expected, s)
+	}
+}
+
+func TestFilterReload(t *testing.T) {
+	path, cleanup := writeFilterList(t, "ads.example.com\n")
+	defer cleanup()
+
+	f, err := NewFilter(answerResolver(60), []FilterList{{Path: path}}, &FilterOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	writeZoneFile(t, path, "ads.example.com\ntracker.example.com\n")
+	f.reload()
+	if data := answerData(t, f, "tracker.example.com", dns.TypeA); len(data) != 0 {
+		t.Errorf("expected the new name to be blocked, got %v", data)
+	}
+}
+
+func TestFilterOptionsErrors(t *testing.T) {
+	if _, err := NewFilter(answerResolver(60), nil, &FilterOptions{Action: BlockAddress}); err == nil {
+		t.Error("expected an error without addresses")
+	}
+	if _, err := NewFilter(answerResolver(60), []FilterList{{Path: "/nonexistent"}}, nil); err == nil {
+		t.Error("expected an error for a missing list")
+	}
+	if _, err := ParseBlockAction("nope"); err == nil {
+		t.Error("expected an error for an unknown action")
+	}
+	if a, err := ParseBlockAction("refused"); err != nil || a != BlockRefused {
+		t.Errorf("expected refused, got %v, %v", a, err)
+	}
+}
+
+func TestFilterAllow(t *testing.T) {
+	blocklist, cleanup := writeFilterList(t, `
+example.com
+||cdn.example.net^
+@@||ok.cdn.example.net^
+/^track[0-9]*\./
+`)
+	defer cleanup()
+	allowlist, cleanupAllow := writeFilterList(t, `
+# needed for login
+www.example.com
+||api.example.com^
+/^tracker7\./
+`)
+	defer cleanupAllow()
+
+	f, err := NewFilter(answerResolver(60), []FilterList{
+		{Path: blocklist},
+		{Path: allowlist, Allow: true},
+	}, &FilterOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for name, blocked := range map[string]bool{
+		"example.com":            true,
+		"ads.example.com":        true,
+		"www.example.com":        false,
+		"static.www.example.com": false,
+		"v1.api.example.com":     false,
+		"cdn.example.net":        true,
+		"ok.cdn.example.net":     false,
+		"track1.example.org":     true,
+		"tracker7.example.org":   false,
+		"example.org":            false,
+	} {
+		resp, err := f.Resolve(context.Background(), question(name, dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (resp.ResponseCode == dns.RcodeNameError) != blocked {
+			t.Errorf("%v: expected blocked %v, got %+v", name, blocked, resp)
+		}
+	}
+
+	if s := f.Stats(); s.Blocked != 4 || s.Allowed != 4 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestFilterListPolicy(t *testing.T) {
+	ads, cleanup := writeFilterList(t, "ads.example\n")
+	defer cleanup()
+	malware, cleanupMalware := writeFilterList(t, "malware.example\nads.example\n")
+	defer cleanupMalware()
+	other, cleanupOther := writeFilterList(t, "other.example\n")
+	defer cleanupOther()
+
+	f, err := NewFilter(answerResolver(60), []FilterList{
+		{Path: ads, Policy: &BlockPolicy{Action: BlockNull}},
+		{Path: malware, Policy: &BlockPolicy{Action: BlockAddress, Addresses: []net.IP{net.ParseIP("192.0.2.80")}}},
+		{Path: other},
+	}, &FilterOptions{Action: BlockRefused, ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for name, expected := range map[string][]string{
+		// the first list to block a name wins
+		"ads.example":     {"0.0.0.0"},
+		"malware.example": {"192.0.2.80"},
+		"other.example":   {},
+	} {
+		if data := answerData(t, f, name, dns.TypeA); !reflect.DeepEqual(data, expected) {
+			t.Errorf("%v: expected %v, got %v", name, expected, data)
+		}
+	}
+
+	resp, err := f.Resolve(context.Background(), question("x.other.example", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeRefused {
+		t.Errorf("expected the filter's action to be used, got rcode %v", resp.ResponseCode)
+	}
+
+	if _, err := NewFilter(answerResolver(60), []FilterList{
+		{Path: ads, Policy: &BlockPolicy{Action: BlockAddress}},
+	}, nil); err == nil {
+		t.Error("expected an error for a policy without addresses")
+	}
+}
+
+func TestFilterComment(t *testing.T) {
+	path, cleanup := writeFilterList(t, "||ads.example^\n")
+	defer cleanup()
+
+	f, err := NewFilter(answerResolver(60), []FilterList{{Path: path}}, &FilterOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	resp, err := f.Resolve(context.Background(), question("x.ads.example", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf(`Blocked by rule "||ads.example^" of list %v`, path)
+	if g := fromDNStoGDNS(resp); g.Comment != expected {
+		t.Errorf("expected comment %q, got %q", expected, g.Comment)
+	}
+
+	resp, err = f.Resolve(context.Background(), question("example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Comment != "" {
+		t.Errorf("expected no comment for a resolved name, got %q", resp.Comment)
+	}
+}
@@ -2,29 +2,83 @@ package reverseoperator
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
 
 	secop "github.com/fardog/secureoperator"
 )
 
+const (
+	// DefaultMaxBodySize is the largest POST body accepted when no other limit
+	// is configured; it is the largest possible DNS message.
+	DefaultMaxBodySize = dns.MaxMsgSize
+	// DefaultClientSubnetPrefixV4 is the prefix length IPv4 client addresses
+	// are truncated to when deriving a client subnet, per RFC 7871
+	DefaultClientSubnetPrefixV4 = 24
+	// DefaultClientSubnetPrefixV6 is the prefix length IPv6 client addresses
+	// are truncated to when deriving a client subnet, per RFC 7871
+	DefaultClientSubnetPrefixV6 = 56
+)
+
+var (
+	errContentTypeInvalid = errors.New("content-type must be " + dnsMessageContentType)
+	errBodyTooLarge       = errors.New("request body exceeds the maximum size")
+)
+
 type HandlerOptions struct {
 	ContentTypeJSON bool
 	ServerHeader    string
+	// MaxBodySize is the largest POST body accepted by HandleDNSMessage, in
+	// bytes; if zero, DefaultMaxBodySize is used.
+	MaxBodySize int64
+	// ClientSubnetFromRemote derives an EDNS client subnet from the address
+	// of the HTTP client, when the request doesn't specify one itself
+	ClientSubnetFromRemote bool
+	// ClientSubnetPrefixV4 and ClientSubnetPrefixV6 are the prefix lengths a
+	// derived client subnet is truncated to; if nil, the defaults are used. A
+	// length of zero sends no bits of the address, asking upstreams not to use
+	// it.
+	ClientSubnetPrefixV4 *int
+	ClientSubnetPrefixV6 *int
+	// PaddingBlockSize pads responses to a multiple of this many bytes, so
+	// that their length doesn't reveal the name queried; zero disables it.
+	// Responses are only padded when the request was: wire-format queries by
+	// an EDNS padding option, and JSON requests by a random_padding
+	// parameter.
+	PaddingBlockSize int
+}
+
+// Validate checks that the options are within range, returning an error
+// describing the first which isn't.
+func (o *HandlerOptions) Validate() error {
+	if v4 := o.ClientSubnetPrefixV4; v4 != nil && (*v4 < 0 || *v4 > net.IPv4len*8) {
+		return fmt.Errorf("IPv4 client subnet prefix length %v must be from 0 to %v", *v4, net.IPv4len*8)
+	}
+	if v6 := o.ClientSubnetPrefixV6; v6 != nil && (*v6 < 0 || *v6 > net.IPv6len*8) {
+		return fmt.Errorf("IPv6 client subnet prefix length %v must be from 0 to %v", *v6, net.IPv6len*8)
+	}
+
+	return nil
 }
 
 func NewHandler(provider secop.Provider, options *HandlerOptions) *Handler {
 	return &Handler{
 		options:  options,
-		provider: provider,
+		resolver: NewProviderResolver(provider),
 	}
 }
 
 type Handler struct {
 	options  *HandlerOptions
-	provider secop.Provider
+	resolver Resolver
 }
 
 func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
@@ -34,40 +88,258 @@ func (h *Handler) Handle(w http.ResponseWriter, r *http.Request) {
 		log.Error(err)
 	}
 
+	// the same url may be answered in different formats, so caches must
+	// take the accept header into account
+	w.Header().Set("vary", "accept")
+
+	ct, err := negotiateContentType(r, h.defaultContentType())
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+
 	q, err := urlToDNSQuestion(r.URL)
 	if err != nil {
 		fail(http.StatusBadRequest, err)
 		return
 	}
+	h.setClientSubnet(q, r)
 
-	resp, err := h.provider.Query(*q)
+	resp, err := h.resolver.Resolve(r.Context(), *q)
+	if err == ErrDropped {
+		drop(q)
+	}
 	if err != nil {
 		fail(http.StatusServiceUnavailable, err)
 		return
 	}
 
-	gdns := fromDNStoGDNS(resp)
+	if ct == dnsMessageContentType {
+		// there's no query message to reply to, so build the one we would
+		// have sent upstream
+		m, b, err := h.packReply(questionToMsg(*q), resp)
+		if err != nil {
+			fail(http.StatusInternalServerError, err)
+			return
+		}
 
-	// these headers match google's service, as off as they may seem; we allow
-	// some override to more standard headers, however
-	if h.options.ContentTypeJSON {
-		w.Header().Set("content-type", "application/json; charset=UTF-8")
-	} else {
-		// this is google's content type
-		w.Header().Set("content-type", "application/x-javascript; charset=UTF-8")
+		h.writeDNSMsg(w, m, b)
+		log.Infof("responded to request %v[%v]", q.Name, q.Type)
+		return
 	}
-	w.Header().Set("cache-control", "private")
-	w.Header().Set("x-xss-protection", "1; mode=block")
-	w.Header().Set("x-frame-options", "SAMEORIGIN")
-	if h.options.ServerHeader != "" {
-		w.Header().Set("server", h.options.ServerHeader)
+
+	gdns := fromDNStoGDNS(resp)
+	var body interface{} = gdns
+	if h.options.PaddingBlockSize > 0 && requestsGDNSPadding(r) {
+		padded, err := padGDNS(gdns, h.options.PaddingBlockSize)
+		if err != nil {
+			fail(http.StatusInternalServerError, err)
+			return
+		}
+		body = padded
 	}
 
+	w.Header().Set("content-type", ct+"; charset=UTF-8")
+	w.Header().Set("cache-control", "private")
+	h.setCommonHeaders(w)
+
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(gdns); err != nil {
+	if err := enc.Encode(body); err != nil {
 		fail(http.StatusInternalServerError, err)
 		return
 	}
 
 	log.Infof("responded to request %v[%v]", q.Name, q.Type)
 }
+
+// HandleDNSMessage serves RFC 8484 DNS-over-HTTPS requests, where the query is
+// a wire-format DNS message; either passed base64url encoded in the `dns`
+// parameter of a GET request, or as the body of a POST request.
+func (h *Handler) HandleDNSMessage(w http.ResponseWriter, r *http.Request) {
+	// unlike the JSON API, clients of this endpoint expect DNS messages, so
+	// don't leak error details into the response body
+	fail := func(status int, err error) {
+		http.Error(w, http.StatusText(status), status)
+		log.Error(err)
+	}
+
+	var req *dns.Msg
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		req, err = urlToDNSMsg(r.URL)
+	case http.MethodPost:
+		var status int
+		if req, status, err = h.bodyToDNSMsg(r); err != nil && err != errDNSFormat {
+			fail(status, err)
+			return
+		}
+	default:
+		w.Header().Set("allow", http.MethodGet+", "+http.MethodPost)
+		fail(http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+		return
+	}
+	if err == errDNSFormat {
+		h.writeFormatError(w, req, err)
+		return
+	}
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+
+	q, err := dnsMsgToQuestion(req)
+	if err != nil {
+		h.writeFormatError(w, req, err)
+		return
+	}
+	h.setClientSubnet(q, r)
+	resp, err := h.resolver.Resolve(r.Context(), *q)
+	if err == ErrDropped {
+		drop(q)
+	}
+	if err != nil {
+		fail(http.StatusServiceUnavailable, err)
+		return
+	}
+
+	m, b, err := h.packReply(req, resp)
+	if err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+
+	h.writeDNSMsg(w, m, b)
+	log.Infof("responded to request %v[%v]", q.Name, q.Type)
+}
+
+// defaultContentType is the content type of JSON API responses, when the
+// client doesn't ask for one in particular.
+func (h *Handler) defaultContentType() string {
+	// google's content type is as off as it may seem; we allow some override
+	// to a more standard one, however
+	if h.options.ContentTypeJSON {
+		return jsonContentType
+	}
+	return javascriptContentType
+}
+
+// packReply builds the wire-format reply to a request message, padding it if
+// required, and returns it along with its packed form.
+func (h *Handler) packReply(req *dns.Msg, resp *Response) (*dns.Msg, []byte, error) {
+	m, err := fromDNStoDNSMsg(req, resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if h.options.PaddingBlockSize > 0 && requestsPadding(req) {
+		if err := padDNSMsg(m, h.options.PaddingBlockSize); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	b, err := m.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return m, b, nil
+}
+
+func (h *Handler) writeDNSMsg(w http.ResponseWriter, m *dns.Msg, b []byte) {
+	w.Header().Set("content-type", dnsMessageContentType)
+	// RFC 8484 asks that the freshness lifetime not exceed the smallest TTL
+	// in the response
+	if ttl, ok := minTTL(m); ok {
+		w.Header().Set("cache-control", fmt.Sprintf("max-age=%v", ttl))
+	}
+	h.setCommonHeaders(w)
+
+	if _, err := w.Write(b); err != nil {
+		log.Error(err)
+	}
+}
+
+// writeFormatError answers a request whose question could be read, but which
+// is otherwise malformed, with FORMERR; RFC 7871 asks this of an invalid
+// client subnet option in particular.
+func (h *Handler) writeFormatError(w http.ResponseWriter, req *dns.Msg, reason error) {
+	log.Errorf("malformed request for %v: %v", req.Question[0].Name, reason)
+
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeFormatError)
+	b, err := m.Pack()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	h.writeDNSMsg(w, m, b)
+}
+
+// bodyToDNSMsg reads a DNS message from the body of a POST request, returning
+// the HTTP status appropriate to any error encountered.
+func (h *Handler) bodyToDNSMsg(r *http.Request) (*dns.Msg, int, error) {
+	ct, _, err := mime.ParseMediaType(r.Header.Get("content-type"))
+	if err != nil || ct != dnsMessageContentType {
+		return nil, http.StatusUnsupportedMediaType, errContentTypeInvalid
+	}
+
+	max := h.options.MaxBodySize
+	if max <= 0 {
+		max = DefaultMaxBodySize
+	}
+	if r.ContentLength > max {
+		return nil, http.StatusRequestEntityTooLarge, errBodyTooLarge
+	}
+
+	// read one byte past the maximum, so that we can tell if it was exceeded
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if int64(len(b)) > max {
+		return nil, http.StatusRequestEntityTooLarge, errBodyTooLarge
+	}
+
+	m, err := bytesToDNSMsg(b)
+	if err != nil {
+		return m, http.StatusBadRequest, err
+	}
+
+	return m, http.StatusOK, nil
+}
+
+// setClientSubnet derives the client subnet of a question from the request's
+// remote address, if configured and the client didn't specify one.
+func (h *Handler) setClientSubnet(q *Question, r *http.Request) {
+	if !h.options.ClientSubnetFromRemote || q.ClientSubnet != nil {
+		return
+	}
+
+	v4, v6 := DefaultClientSubnetPrefixV4, DefaultClientSubnetPrefixV6
+	if h.options.ClientSubnetPrefixV4 != nil {
+		v4 = *h.options.ClientSubnetPrefixV4
+	}
+	if h.options.ClientSubnetPrefixV6 != nil {
+		v6 = *h.options.ClientSubnetPrefixV6
+	}
+
+	q.ClientSubnet = clientSubnetFromAddr(r.RemoteAddr, v4, v6)
+}
+
+func (h *Handler) setCommonHeaders(w http.ResponseWriter) {
+	w.Header().Set("x-xss-protection", "1; mode=block")
+	w.Header().Set("x-frame-options", "SAMEORIGIN")
+	if h.options.ServerHeader != "" {
+		w.Header().Set("server", h.options.ServerHeader)
+	}
+}
+
+// drop abandons the response to a question which a policy says to drop, so
+// that the client is left without an answer, as it would be over UDP.
+func drop(q *Question) {
+	log.Debugf("dropping question for %v", q.Name)
+	panic(http.ErrAbortHandler)
+}
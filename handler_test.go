@@ -1,13 +1,21 @@
 package reverseoperator
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
+	"github.com/miekg/dns"
+
 	secop "github.com/fardog/secureoperator"
 )
 
@@ -75,6 +83,241 @@ func TestHandleGoodResponse(t *testing.T) {
 	}
 }
 
+func TestHandleFlags(t *testing.T) {
+	dnsresp := &secop.DNSResponse{CheckingDisabled: true}
+	provider := newFakeProvider(dnsresp, nil)
+	h := NewHandler(provider, &HandlerOptions{})
+
+	ts := httptest.NewServer(http.HandlerFunc(h.Handle))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?name=example.com&cd=1&do=true")
+	if err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %v", resp.StatusCode)
+	}
+
+	if !provider.question.CheckingDisabled || !provider.question.DNSSECOK {
+		t.Errorf("flags were not passed to provider: %+v", provider.question)
+	}
+
+	body := secop.GDNSResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("unable to parse response body: %v", err)
+	}
+	if !body.CD {
+		t.Error("expected CD to be set in response")
+	}
+}
+
+func TestHandleClientSubnet(t *testing.T) {
+	provider := newFakeProvider(&secop.DNSResponse{}, nil)
+	provider.subnet = &net.IPNet{
+		IP: net.ParseIP("192.0.2.0").To4(), Mask: net.CIDRMask(20, 32)}
+	h := NewHandler(provider, &HandlerOptions{})
+
+	ts := httptest.NewServer(http.HandlerFunc(h.Handle))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?name=example.com&edns_client_subnet=192.0.2.1/24")
+	if err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %v", resp.StatusCode)
+	}
+
+	if s := clientSubnetString(provider.question.ClientSubnet); s != "192.0.2.0/24" {
+		t.Errorf("unexpected client subnet passed to provider: %v", s)
+	}
+
+	body := secop.GDNSResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("unable to parse response body: %v", err)
+	}
+	if s := body.EDNSClientSubnet; s != "192.0.2.0/20" {
+		t.Errorf("unexpected client subnet in response: %v", s)
+	}
+}
+
+func TestHandleClientSubnetFromRemote(t *testing.T) {
+	provider := newFakeProvider(&secop.DNSResponse{}, nil)
+	h := NewHandler(provider, &HandlerOptions{
+		ClientSubnetFromRemote: true,
+		ClientSubnetPrefixV4:   prefixLength(16),
+	})
+
+	ts := httptest.NewServer(http.HandlerFunc(h.Handle))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?name=example.com")
+	if err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %v", resp.StatusCode)
+	}
+
+	if s := clientSubnetString(provider.question.ClientSubnet); s != "127.0.0.0/16" {
+		t.Errorf("unexpected client subnet passed to provider: %v", s)
+	}
+
+	// a client's explicit choice must be respected
+	resp, err = http.Get(ts.URL + "?name=example.com&edns_client_subnet=0.0.0.0/0")
+	if err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+
+	if s := clientSubnetString(provider.question.ClientSubnet); s != "0.0.0.0/0" {
+		t.Errorf("unexpected client subnet passed to provider: %v", s)
+	}
+}
+
+func TestHandleClientSubnetFromRemoteZero(t *testing.T) {
+	provider := newFakeProvider(&secop.DNSResponse{}, nil)
+	h := NewHandler(provider, &HandlerOptions{
+		ClientSubnetFromRemote: true,
+		ClientSubnetPrefixV4:   prefixLength(0),
+	})
+
+	ts := httptest.NewServer(http.HandlerFunc(h.Handle))
+	defer ts.Close()
+
+	if _, err := http.Get(ts.URL + "?name=example.com"); err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+
+	// a zero length is kept, rather than taken to mean the default
+	if s := clientSubnetString(provider.question.ClientSubnet); s != "0.0.0.0/0" {
+		t.Errorf("unexpected client subnet passed to provider: %v", s)
+	}
+}
+
+func prefixLength(n int) *int {
+	return &n
+}
+
+func TestHandlePadding(t *testing.T) {
+	provider := newFakeProvider(&secop.DNSResponse{}, nil)
+	h := NewHandler(provider, &HandlerOptions{PaddingBlockSize: 64})
+
+	ts := httptest.NewServer(http.HandlerFunc(h.Handle))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?name=example.com&random_padding=abcdef")
+	if err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %v", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response body: %v", err)
+	}
+	if l := len(body); l%64 != 0 {
+		t.Errorf("expected padded response, got length %v", l)
+	}
+
+	// a request which isn't padded gets a response without the field
+	resp, err = http.Get(ts.URL + "?name=example.com")
+	if err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response body: %v", err)
+	}
+	if bytes.Contains(body, []byte("random_padding")) {
+		t.Errorf("expected no padding, got %s", body)
+	}
+}
+
+func TestHandleContentTypeDNSMessage(t *testing.T) {
+	name := "example.com."
+	dnsresp := &secop.DNSResponse{
+		Answer: []secop.DNSRR{
+			secop.DNSRR{Name: name, Type: 1, TTL: 100, Data: "127.0.0.1"}},
+	}
+	provider := newFakeProvider(dnsresp, nil)
+	h := NewHandler(provider, &HandlerOptions{})
+
+	ts := httptest.NewServer(http.HandlerFunc(h.Handle))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"?name=example.com", nil)
+	if err != nil {
+		t.Fatalf("unable to create request: %v", err)
+	}
+	req.Header.Set("accept", "application/dns-message")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %v", resp.StatusCode)
+	}
+	if c := resp.Header.Get("content-type"); c != "application/dns-message" {
+		t.Errorf("unexpected content type: %v", c)
+	}
+	if v := resp.Header.Get("vary"); v != "accept" {
+		t.Errorf("unexpected vary: %v", v)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response body: %v", err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil {
+		t.Fatalf("unable to parse response body: %v", err)
+	}
+	if l := len(m.Answer); l != 1 {
+		t.Fatalf("expected exactly one answer, got %v", l)
+	}
+	if n := m.Question[0].Name; n != name {
+		t.Errorf("unexpected question name: %v", n)
+	}
+}
+
+func TestHandleContentTypeParam(t *testing.T) {
+	provider := newFakeProvider(&secop.DNSResponse{}, nil)
+	h := NewHandler(provider, &HandlerOptions{})
+
+	ts := httptest.NewServer(http.HandlerFunc(h.Handle))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?name=example.com&ct=application/dns-json")
+	if err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %v", resp.StatusCode)
+	}
+	if c := resp.Header.Get("content-type"); c != "application/dns-json; charset=UTF-8" {
+		t.Errorf("unexpected content type: %v", c)
+	}
+
+	resp, err = http.Get(ts.URL + "?name=example.com&ct=text/html")
+	if err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status code %v", resp.StatusCode)
+	}
+}
+
 func TestHandleBadQuery(t *testing.T) {
 	provider := newFakeProvider(nil, nil)
 	h := NewHandler(provider, &HandlerOptions{})
@@ -117,6 +360,304 @@ func TestHandleBadProvider(t *testing.T) {
 	}
 }
 
+func TestHandleDNSMessageGoodResponse(t *testing.T) {
+	name := "example.com."
+	ttl := uint32(100)
+	data := "127.0.0.1"
+	dnsresp := &secop.DNSResponse{
+		Question: []secop.DNSQuestion{
+			secop.DNSQuestion{Name: name, Type: 1}},
+		Answer: []secop.DNSRR{
+			secop.DNSRR{Name: name, Type: 1, TTL: ttl, Data: data}},
+		RecursionAvailable: true,
+	}
+	provider := newFakeProvider(dnsresp, nil)
+	h := NewHandler(provider, &HandlerOptions{})
+
+	ts := httptest.NewServer(http.HandlerFunc(h.HandleDNSMessage))
+	defer ts.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	req.Id = 0
+	b, err := req.Pack()
+	if err != nil {
+		t.Fatalf("unable to pack request: %v", err)
+	}
+
+	resp, err := http.Get(ts.URL + "?dns=" + base64.RawURLEncoding.EncodeToString(b))
+	if err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %v", resp.StatusCode)
+	}
+	if c := resp.Header.Get("content-type"); c != "application/dns-message" {
+		t.Errorf("unexpected content type: %v", c)
+	}
+	if c := resp.Header.Get("cache-control"); c != "max-age=100" {
+		t.Errorf("unexpected cache control: %v", c)
+	}
+
+	if provider.req.Name != name || provider.req.Type != dns.TypeA {
+		t.Errorf("unexpected provider question: %v", provider.req)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response body: %v", err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil {
+		t.Fatalf("unable to parse response body: %v", err)
+	}
+
+	if !m.Response || !m.RecursionAvailable {
+		t.Errorf("unexpected response flags: %v", m.MsgHdr)
+	}
+	if l := len(m.Answer); l != 1 {
+		t.Fatalf("expected exactly one answer, got %v", l)
+	}
+	a, ok := m.Answer[0].(*dns.A)
+	if !ok {
+		t.Fatalf("unexpected answer record: %v", m.Answer[0])
+	}
+	if a.Hdr.Name != name {
+		t.Errorf("unexpected answer name: %v", a.Hdr.Name)
+	}
+	if a.Hdr.Ttl != ttl {
+		t.Errorf("unexpected answer ttl: %v", a.Hdr.Ttl)
+	}
+	if d := a.A.String(); d != data {
+		t.Errorf("unexpected answer data: %v", d)
+	}
+}
+
+func TestHandleDNSMessageBadQuery(t *testing.T) {
+	provider := newFakeProvider(nil, nil)
+	h := NewHandler(provider, &HandlerOptions{})
+
+	ts := httptest.NewServer(http.HandlerFunc(h.HandleDNSMessage))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "?dns=notadnsmessage")
+	if err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status code %v", resp.StatusCode)
+	}
+}
+
+func TestHandleDNSMessagePost(t *testing.T) {
+	name := "example.com."
+	dnsresp := &secop.DNSResponse{
+		Question: []secop.DNSQuestion{
+			secop.DNSQuestion{Name: name, Type: 1}},
+		Answer: []secop.DNSRR{
+			secop.DNSRR{Name: name, Type: 1, TTL: 100, Data: "127.0.0.1"}},
+	}
+	provider := newFakeProvider(dnsresp, nil)
+	provider.subnet = &net.IPNet{
+		IP: net.ParseIP("192.0.2.0").To4(), Mask: net.CIDRMask(20, 32)}
+	h := NewHandler(provider, &HandlerOptions{})
+
+	ts := httptest.NewServer(http.HandlerFunc(h.HandleDNSMessage))
+	defer ts.Close()
+
+	ecs, _ := parseClientSubnet("192.0.2.0/24")
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	req.Id = 1234
+	req.SetEdns0(4096, true)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, clientSubnetToOption(ecs))
+	b, err := req.Pack()
+	if err != nil {
+		t.Fatalf("unable to pack request: %v", err)
+	}
+
+	resp, err := http.Post(ts.URL, "application/dns-message", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unable to request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %v", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response body: %v", err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil {
+		t.Fatalf("unable to parse response body: %v", err)
+	}
+
+	if !provider.question.DNSSECOK {
+		t.Error("expected DO bit to be passed to provider")
+	}
+	if m.Id != 1234 {
+		t.Errorf("unexpected message id: %v", m.Id)
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		t.Fatal("expected EDNS0 in response")
+	}
+	if opt.UDPSize() != 4096 || !opt.Do() {
+		t.Errorf("unexpected EDNS0 options: %v", opt)
+	}
+	if e := clientSubnetOption(opt); e == nil || e.SourceNetmask != 24 || e.SourceScope != 20 {
+		t.Errorf("unexpected client subnet option: %v", e)
+	}
+	if l := len(m.Answer); l != 1 {
+		t.Fatalf("expected exactly one answer, got %v", l)
+	}
+}
+
+func TestHandleDNSMessagePostErrors(t *testing.T) {
+	provider := newFakeProvider(nil, nil)
+	h := NewHandler(provider, &HandlerOptions{MaxBodySize: 64})
+
+	ts := httptest.NewServer(http.HandlerFunc(h.HandleDNSMessage))
+	defer ts.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	valid, err := req.Pack()
+	if err != nil {
+		t.Fatalf("unable to pack request: %v", err)
+	}
+
+	tests := []struct {
+		contentType string
+		body        []byte
+		status      int
+	}{
+		{"application/json", valid, http.StatusUnsupportedMediaType},
+		{"", valid, http.StatusUnsupportedMediaType},
+		{"application/dns-message", make([]byte, 65), http.StatusRequestEntityTooLarge},
+		{"application/dns-message", []byte("wut"), http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Post(ts.URL, tt.contentType, bytes.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("unable to request: %v", err)
+		}
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("expected status code %v for %v, got %v", tt.status, tt.contentType, resp.StatusCode)
+		}
+	}
+}
+
+func TestHandleDNSMessageBadClientSubnet(t *testing.T) {
+	provider := newFakeProvider(nil, nil)
+	h := NewHandler(provider, &HandlerOptions{})
+
+	ts := httptest.NewServer(http.HandlerFunc(h.HandleDNSMessage))
+	defer ts.Close()
+
+	ecs, _ := parseClientSubnet("192.0.2.0/24")
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.Id = 1234
+	req.SetEdns0(4096, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, clientSubnetToOption(ecs))
+	b, err := req.Pack()
+	if err != nil {
+		t.Fatalf("unable to pack request: %v", err)
+	}
+	// the option can't be packed with a prefix too long for its family, so
+	// its source prefix length is altered after packing
+	option := []byte{0, 8, 0, 7, 0, 1, 24}
+	i := bytes.Index(b, option)
+	if i < 0 {
+		t.Fatal("unable to find client subnet option")
+	}
+	b[i+len(option)-1] = 40
+
+	get := func() (*http.Response, error) {
+		return http.Get(ts.URL + "?dns=" + base64.RawURLEncoding.EncodeToString(b))
+	}
+	post := func() (*http.Response, error) {
+		return http.Post(ts.URL, dnsMessageContentType, bytes.NewReader(b))
+	}
+	for _, do := range []func() (*http.Response, error){get, post} {
+		resp, err := do()
+		if err != nil {
+			t.Fatalf("unable to request: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code %v", resp.StatusCode)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unable to read response body: %v", err)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(body); err != nil {
+			t.Fatalf("unable to parse response body: %v", err)
+		}
+		if m.Rcode != dns.RcodeFormatError || m.Id != 1234 || len(m.Question) != 1 {
+			t.Errorf("expected FORMERR for the question, got %v", m)
+		}
+	}
+
+	if provider.question != nil {
+		t.Errorf("expected no question to be resolved, got %v", provider.question.Name)
+	}
+}
+
+func TestHandlerOptionsValidate(t *testing.T) {
+	for _, c := range []struct {
+		options HandlerOptions
+		valid   bool
+	}{
+		{HandlerOptions{}, true},
+		{HandlerOptions{ClientSubnetPrefixV4: prefixLength(0), ClientSubnetPrefixV6: prefixLength(0)}, true},
+		{HandlerOptions{ClientSubnetPrefixV4: prefixLength(32), ClientSubnetPrefixV6: prefixLength(128)}, true},
+		{HandlerOptions{ClientSubnetPrefixV4: prefixLength(33)}, false},
+		{HandlerOptions{ClientSubnetPrefixV4: prefixLength(-1)}, false},
+		{HandlerOptions{ClientSubnetPrefixV6: prefixLength(129)}, false},
+	} {
+		if err := c.options.Validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got %v", c.options, c.valid, err)
+		}
+	}
+}
+
+type testContextKey struct{}
+
+func TestHandleRequestContext(t *testing.T) {
+	for _, target := range []string{
+		"/resolve?name=example.com",
+		"/dns-query?dns=AAABAAABAAAAAAAAB2V4YW1wbGUDY29tAAABAAE",
+	} {
+		provider := newFakeProvider(&secop.DNSResponse{}, nil)
+		h := NewHandler(provider, &HandlerOptions{})
+
+		ctx := context.WithValue(context.Background(), testContextKey{}, target)
+		r := httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		if strings.HasPrefix(target, "/resolve") {
+			h.Handle(w, r)
+		} else {
+			h.HandleDNSMessage(w, r)
+		}
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: unexpected status %v", target, w.Code)
+		}
+		if provider.ctx == nil || provider.ctx.Value(testContextKey{}) != target {
+			t.Errorf("%v: expected the request's context to be passed to the provider", target)
+		}
+	}
+}
+
 func newFakeProvider(resp *secop.DNSResponse, err error) *fakeProvider {
 	return &fakeProvider{
 		resp: resp,
@@ -125,12 +666,30 @@ func newFakeProvider(resp *secop.DNSResponse, err error) *fakeProvider {
 }
 
 type fakeProvider struct {
-	req  *secop.DNSQuestion
-	resp *secop.DNSResponse
-	err  error
+	ctx      context.Context
+	req      *secop.DNSQuestion
+	question *Question
+	subnet   *net.IPNet
+	resp     *secop.DNSResponse
+	err      error
 }
 
 func (f *fakeProvider) Query(q secop.DNSQuestion) (*secop.DNSResponse, error) {
 	f.req = &q
 	return f.resp, f.err
 }
+
+func (f *fakeProvider) Resolve(ctx context.Context, q Question) (*Response, error) {
+	f.ctx = ctx
+	f.req = &q.DNSQuestion
+	f.question = &q
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	resp := &Response{ClientSubnet: f.subnet}
+	if f.resp != nil {
+		resp.DNSResponse = *f.resp
+	}
+	return resp, nil
+}
@@ -0,0 +1,184 @@
+package reverseoperator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+const (
+	// DefaultMaxFailures is the number of consecutive failed queries after
+	// which a server is considered unhealthy.
+	DefaultMaxFailures = 3
+	// DefaultEjectBackoff is how long an unhealthy server is first ejected
+	// for; it doubles each time the server fails again on its return.
+	DefaultEjectBackoff = 5 * time.Second
+	// DefaultMaxEjectBackoff is the longest a server will be ejected for.
+	DefaultMaxEjectBackoff = 5 * time.Minute
+	// DefaultProbeName is the name queried by active health probes.
+	DefaultProbeName = "."
+)
+
+// HealthOptions configures how a DNSProvider tracks the health of its
+// servers.
+type HealthOptions struct {
+	// MaxFailures is the number of consecutive failures after which a server
+	// is ejected; if zero, DefaultMaxFailures is used.
+	MaxFailures int
+	// Backoff is how long a server is first ejected for; if zero,
+	// DefaultEjectBackoff is used.
+	Backoff time.Duration
+	// MaxBackoff caps the ejection backoff; if zero, DefaultMaxEjectBackoff
+	// is used.
+	MaxBackoff time.Duration
+	// ProbeInterval is how often every server is sent a probe query, so that
+	// failing servers are found, and recovered servers returned, without
+	// waiting on client queries; if zero, no probes are sent.
+	ProbeInterval time.Duration
+	// ProbeName is the canary name probes ask for the NS records of; if
+	// empty, DefaultProbeName is used.
+	ProbeName string
+}
+
+func (o *HealthOptions) maxFailures() int {
+	if o.MaxFailures > 0 {
+		return o.MaxFailures
+	}
+	return DefaultMaxFailures
+}
+
+func (o *HealthOptions) backoff() time.Duration {
+	if o.Backoff > 0 {
+		return o.Backoff
+	}
+	return DefaultEjectBackoff
+}
+
+func (o *HealthOptions) maxBackoff() time.Duration {
+	if o.MaxBackoff > 0 {
+		return o.MaxBackoff
+	}
+	return DefaultMaxEjectBackoff
+}
+
+func (o *HealthOptions) probeName() string {
+	if o.ProbeName != "" {
+		return dns.Fqdn(o.ProbeName)
+	}
+	return DefaultProbeName
+}
+
+// upstream is a server queried by a DNSProvider, along with its health.
+type upstream struct {
+	address string
+	// index is the server's position in the order configured
+	index int
+
+	mutex    sync.Mutex
+	failures int
+	backoff  time.Duration
+	// ejected is when the server may next be sent queries, if it has been
+	// ejected
+	ejected time.Time
+	// rtt is the moving average of the server's response times
+	rtt time.Duration
+}
+
+func newUpstreams(servers secop.Endpoints) []*upstream {
+	us := make([]*upstream, len(servers))
+	for i, s := range servers {
+		us[i] = &upstream{address: s.String(), index: i}
+	}
+
+	return us
+}
+
+// healthy reports whether the server may be sent queries at time t.
+func (u *upstream) healthy(t time.Time) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return !t.Before(u.ejected)
+}
+
+// success records that the server answered a query, restoring its health.
+func (u *upstream) success() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if !u.ejected.IsZero() {
+		log.Infof("upstream %v is healthy again", u.address)
+	}
+	u.failures = 0
+	u.backoff = 0
+	u.ejected = time.Time{}
+}
+
+// failure records that the server failed to answer a query, ejecting it once
+// it has failed too many times in a row. A server which fails again when its
+// ejection ends is ejected for twice as long.
+func (u *upstream) failure(o *HealthOptions) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.failures++
+	t := now()
+	if u.failures < o.maxFailures() || t.Before(u.ejected) {
+		return
+	}
+
+	if u.backoff == 0 {
+		u.backoff = o.backoff()
+	} else if u.backoff *= 2; u.backoff > o.maxBackoff() {
+		u.backoff = o.maxBackoff()
+	}
+	u.ejected = t.Add(u.backoff)
+	log.Warnf("upstream %v failed %v times, ejecting for %v", u.address, u.failures, u.backoff)
+}
+
+// probe sends every server a query for the canary name each interval until
+// stop is closed, recording whether each answered.
+func (c *DNSProvider) probe(stop chan struct{}) {
+	defer c.probes.Done()
+
+	ticker := time.NewTicker(c.health.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		for _, u := range c.upstreams {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+
+				m := new(dns.Msg)
+				m.SetQuestion(c.health.probeName(), dns.TypeNS)
+				// any response at all shows the server is answering; only
+				// a failure to respond counts against it
+				ctx, cancel := context.WithTimeout(context.Background(), c.timeout())
+				defer cancel()
+
+				start := now()
+				if _, err := c.exchange(ctx, m, u.address); err != nil {
+					log.Debugf("probe of %v failed: %v", u.address, err)
+					u.failure(c.health)
+					return
+				}
+				u.observe(now().Sub(start))
+				u.success()
+			}(u)
+		}
+		wg.Wait()
+	}
+}
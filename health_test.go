@@ -0,0 +1,263 @@
+package reverseoperator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+var errTestUpstream = errors.New("upstream unreachable")
+
+// mockExchangeAddr mocks exchange with a function which may fail, and which
+// knows the server being queried.
+func mockExchangeAddr(answer func(m *dns.Msg, address string) (*dns.Msg, error)) func() {
+	orig := exchange
+	exchange = func(ctx context.Context, m *dns.Msg, network, address string) (*dns.Msg, error) {
+		return answer(m, address)
+	}
+
+	return func() {
+		exchange = orig
+	}
+}
+
+func testEndpoints(ips ...string) secop.Endpoints {
+	var eps secop.Endpoints
+	for _, ip := range ips {
+		eps = append(eps, secop.Endpoint{IP: net.ParseIP(ip), Port: 53})
+	}
+	return eps
+}
+
+func reply(m *dns.Msg, rcode int) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetRcode(m, rcode)
+	return r
+}
+
+func TestDNSProviderFailover(t *testing.T) {
+	var (
+		mutex sync.Mutex
+		calls = make(map[string]int)
+	)
+	defer mockExchangeAddr(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		calls[address]++
+		if address == "10.0.0.1:53" {
+			return nil, errTestUpstream
+		}
+		return reply(m, dns.RcodeSuccess), nil
+	})()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+		Health: &HealthOptions{MaxFailures: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if _, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != nil {
+			t.Fatalf("expected query to fail over, got %v", err)
+		}
+	}
+
+	// once ejected, the failing server is no longer queried
+	if c := calls["10.0.0.1:53"]; c != 2 {
+		t.Errorf("expected failing server to be tried 2 times, got %v", c)
+	}
+	if u := p.Stats().Unhealthy; len(u) != 1 || u[0] != "10.0.0.1:53" {
+		t.Errorf("unexpected unhealthy servers %v", u)
+	}
+	if r := p.Stats().Retried; r != 2 {
+		t.Errorf("expected 2 retries, got %v", r)
+	}
+}
+
+func TestDNSProviderAllFailing(t *testing.T) {
+	defer mockExchangeAddr(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		return nil, errTestUpstream
+	})()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+		Health: &HealthOptions{MaxFailures: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != errTestUpstream {
+			t.Errorf("expected upstream error, got %v", err)
+		}
+	}
+}
+
+func TestDNSProviderRetryServFail(t *testing.T) {
+	var (
+		mutex sync.Mutex
+		calls = make(map[string]int)
+	)
+	defer mockExchangeAddr(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		calls[address]++
+		if address == "10.0.0.1:53" {
+			return reply(m, dns.RcodeServerFailure), nil
+		}
+		return reply(m, dns.RcodeSuccess), nil
+	})()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+		Health: &HealthOptions{MaxFailures: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		resp, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ResponseCode != dns.RcodeSuccess {
+			t.Errorf("expected NOERROR from the other server, got %v", resp.ResponseCode)
+		}
+	}
+
+	// SERVFAIL may be the correct answer, so doesn't make a server unhealthy
+	if u := p.Stats().Unhealthy; len(u) != 0 {
+		t.Errorf("expected no unhealthy servers, got %v", u)
+	}
+	if calls["10.0.0.1:53"] == 0 {
+		t.Error("expected the SERVFAIL server to remain in use")
+	}
+}
+
+func TestDNSProviderNoRetries(t *testing.T) {
+	calls := 0
+	defer mockExchangeAddr(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		calls++
+		return nil, errTestUpstream
+	})()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+		Retries: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA}); err == nil {
+		t.Error("expected an error")
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 query, got %v", calls)
+	}
+}
+
+func TestUpstreamEjectBackoff(t *testing.T) {
+	advance, restore := mockNow(time.Unix(0, 0))
+	defer restore()
+
+	o := &HealthOptions{MaxFailures: 2, Backoff: time.Second, MaxBackoff: 3 * time.Second}
+	u := &upstream{address: "10.0.0.1:53"}
+
+	u.failure(o)
+	if !u.healthy(now()) {
+		t.Fatal("expected upstream to be healthy after one failure")
+	}
+
+	for _, backoff := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		u.failure(o)
+		if u.healthy(now()) {
+			t.Fatal("expected upstream to be ejected")
+		}
+
+		// failures while ejected, such as from probes, don't extend it
+		u.failure(o)
+
+		advance(backoff - time.Millisecond)
+		if u.healthy(now()) {
+			t.Fatalf("expected upstream to be ejected for %v", backoff)
+		}
+		advance(time.Millisecond)
+		if !u.healthy(now()) {
+			t.Fatalf("expected upstream to return after %v", backoff)
+		}
+	}
+
+	u.success()
+	u.failure(o)
+	u.failure(o)
+	advance(time.Second)
+	if !u.healthy(now()) {
+		t.Error("expected backoff to reset after a success")
+	}
+}
+
+func TestDNSProviderProbes(t *testing.T) {
+	var (
+		mutex   sync.Mutex
+		failing = true
+		probed  []string
+	)
+	defer mockExchangeAddr(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if address == "10.0.0.1:53" {
+			probed = append(probed, m.Question[0].Name)
+			if failing {
+				return nil, errTestUpstream
+			}
+		}
+		return reply(m, dns.RcodeNameError), nil
+	})()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+		Health: &HealthOptions{
+			MaxFailures:   2,
+			ProbeInterval: 5 * time.Millisecond,
+			ProbeName:     "canary.example",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	waitFor := func(unhealthy int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(p.Stats().Unhealthy) != unhealthy {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %v unhealthy servers", unhealthy)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitFor(1)
+
+	mutex.Lock()
+	failing = false
+	name := probed[0]
+	mutex.Unlock()
+
+	// the backoff is far longer than the test, so only a probe can return it
+	waitFor(0)
+
+	if name != "canary.example." {
+		t.Errorf("expected canary name to be probed, got %v", name)
+	}
+}
@@ -0,0 +1,305 @@
+package reverseoperator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultHostsTTL is the TTL of records answered from hosts files when no
+	// other TTL is configured.
+	DefaultHostsTTL = 60
+	// DefaultHostsReloadInterval is how often hosts files are checked for
+	// changes when no other interval is configured.
+	DefaultHostsReloadInterval = 5 * time.Second
+)
+
+// HostsOptions is a configuration object for optional HostsResolver
+// configuration
+type HostsOptions struct {
+	// TTL is the TTL of answered records; if zero, DefaultHostsTTL is used.
+	TTL uint32
+	// ReloadInterval is how often hosts files are checked for changes, and
+	// reloaded if changed; if zero, DefaultHostsReloadInterval is used, and if
+	// negative, files are never reloaded.
+	ReloadInterval time.Duration
+}
+
+// NewHostsResolver creates a HostsResolver, loading each of the files, which
+// are in the format of /etc/hosts. Where files list the same name, the
+// addresses of each are answered.
+func NewHostsResolver(fallback Resolver, paths []string, opts *HostsOptions) (*HostsResolver, error) {
+	if opts == nil {
+		opts = &HostsOptions{}
+	}
+
+	h := &HostsResolver{
+		fallback: fallback,
+		ttl:      opts.TTL,
+	}
+	if h.ttl == 0 {
+		h.ttl = DefaultHostsTTL
+	}
+	for _, p := range paths {
+		f := &hostsFile{path: p}
+		if err := f.load(); err != nil {
+			return nil, err
+		}
+		h.files = append(h.files, f)
+	}
+	h.hosts = mergeHosts(h.files)
+
+	interval := opts.ReloadInterval
+	if interval == 0 {
+		interval = DefaultHostsReloadInterval
+	}
+	h.watcher = newWatcher(interval, h.reload)
+
+	return h, nil
+}
+
+// HostsResolver answers A, AAAA and PTR questions for the names and
+// addresses listed in hosts files, and passes all others to another
+// Resolver. Files are reloaded when they change on disk.
+type HostsResolver struct {
+	fallback Resolver
+	ttl      uint32
+	files    []*hostsFile
+
+	mutex sync.RWMutex
+	hosts *hosts
+
+	watcher *watcher
+}
+
+type hostsFile struct {
+	path  string
+	stamp fileStamp
+	hosts *hosts
+}
+
+// hosts holds the entries of hosts files
+type hosts struct {
+	// addresses holds the addresses of each name, keyed by its canonical form
+	addresses map[string][]net.IP
+	// names holds the names of each address, keyed by its reverse name
+	names map[string][]string
+}
+
+// Resolve answers a question from the hosts files if it is for the address
+// of a listed name or the name of a listed address, or otherwise from the
+// fallback; it implements Resolver. A listed name has no addresses but those
+// listed, so an AAAA question for a name with only IPv4 addresses has an
+// empty answer, rather than that of the fallback.
+func (h *HostsResolver) Resolve(ctx context.Context, q Question) (*Response, error) {
+	name := canonicalName(q.Name)
+
+	h.mutex.RLock()
+	hosts := h.hosts
+	h.mutex.RUnlock()
+
+	m := new(dns.Msg)
+	m.Question = []dns.Question{{Name: dns.Fqdn(q.Name), Qtype: q.Type, Qclass: dns.ClassINET}}
+	m.RecursionDesired = true
+	m.RecursionAvailable = true
+	hdr := dns.RR_Header{Name: dns.Fqdn(q.Name), Class: dns.ClassINET, Ttl: h.ttl}
+
+	switch q.Type {
+	case dns.TypeA, dns.TypeAAAA:
+		addresses, ok := hosts.addresses[name]
+		if !ok {
+			break
+		}
+		for _, ip := range addresses {
+			if ip4 := ip.To4(); ip4 != nil && q.Type == dns.TypeA {
+				hdr.Rrtype = dns.TypeA
+				m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+			} else if ip4 == nil && q.Type == dns.TypeAAAA {
+				hdr.Rrtype = dns.TypeAAAA
+				m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		log.Debugf("answering %v from hosts files", name)
+		return msgToResponse(q, m), nil
+	case dns.TypePTR:
+		names, ok := hosts.names[name]
+		if !ok {
+			break
+		}
+		hdr.Rrtype = dns.TypePTR
+		for _, n := range names {
+			m.Answer = append(m.Answer, &dns.PTR{Hdr: hdr, Ptr: n})
+		}
+		log.Debugf("answering %v from hosts files", name)
+		return msgToResponse(q, m), nil
+	}
+
+	return h.fallback.Resolve(ctx, q)
+}
+
+// Close stops watching hosts files for changes.
+func (h *HostsResolver) Close() error {
+	h.watcher.close()
+
+	return nil
+}
+
+// reload reloads any hosts files which have changed; a file which fails to
+// load keeps its previous entries.
+func (h *HostsResolver) reload() {
+	var reloaded bool
+	for _, f := range h.files {
+		changed, err := f.stamp.changed(f.path)
+		if err != nil {
+			log.Errorf("error checking hosts file %v: %v", f.path, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		if err := f.load(); err != nil {
+			log.Errorf("error reloading hosts file, keeping previous entries: %v", err)
+			continue
+		}
+		reloaded = true
+		log.Infof("reloaded hosts file %v", f.path)
+	}
+	if !reloaded {
+		return
+	}
+
+	hosts := mergeHosts(h.files)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.hosts = hosts
+}
+
+// load loads the entries of the file, recording the file's modification time
+// and size to tell when it has changed.
+func (f *hostsFile) load() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	hosts, err := parseHosts(file)
+	if err != nil {
+		return fmt.Errorf("%v: %v", f.path, err)
+	}
+
+	f.hosts, f.stamp = hosts, newFileStamp(info)
+	return nil
+}
+
+// parseHosts parses the entries of a hosts file, one per line in the form
+// "address name [name...]". Anything following a "#" is a comment.
+func parseHosts(r io.Reader) (*hosts, error) {
+	h := &hosts{
+		addresses: make(map[string][]net.IP),
+		names:     make(map[string][]string),
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %v: entry must be given as address name [name...]", line)
+		}
+
+		// link-local addresses may carry a zone, which means nothing to
+		// anyone else
+		address := fields[0]
+		if i := strings.Index(address, "%"); i >= 0 {
+			address = address[:i]
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("line %v: invalid address %v", line, fields[0])
+		}
+
+		reverse, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		for _, n := range fields[1:] {
+			if _, ok := dns.IsDomainName(n); !ok {
+				return nil, fmt.Errorf("line %v: invalid name %v", line, n)
+			}
+			name := canonicalName(n)
+			h.addresses[name] = appendIP(h.addresses[name], ip)
+			h.names[reverse] = appendName(h.names[reverse], name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// mergeHosts merges the entries of hosts files, in order.
+func mergeHosts(files []*hostsFile) *hosts {
+	merged := &hosts{
+		addresses: make(map[string][]net.IP),
+		names:     make(map[string][]string),
+	}
+	for _, f := range files {
+		for name, addresses := range f.hosts.addresses {
+			for _, ip := range addresses {
+				merged.addresses[name] = appendIP(merged.addresses[name], ip)
+			}
+		}
+		for reverse, names := range f.hosts.names {
+			for _, n := range names {
+				merged.names[reverse] = appendName(merged.names[reverse], n)
+			}
+		}
+	}
+
+	return merged
+}
+
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return ips
+		}
+	}
+
+	return append(ips, ip)
+}
+
+func appendName(names []string, name string) []string {
+	for _, n := range names {
+		if n == name {
+			return names
+		}
+	}
+
+	return append(names, name)
+}
@@ -0,0 +1,123 @@
+package reverseoperator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func answerData(t *testing.T, r Resolver, name string, qtype uint16) []string {
+	resp, err := r.Resolve(context.Background(), question(name, qtype))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []string{}
+	for _, a := range resp.Answer {
+		data = append(data, a.Data)
+	}
+	return data
+}
+
+func TestHostsResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first")
+	writeZoneFile(t, first, `
+# pinned during the migration
+10.0.0.1       db.corp.example db   # the old primary
+10.0.0.2       DB.Corp.Example cache.corp.example
+fd00::1        db.corp.example
+fe80::1%eth0   router.corp.example
+`)
+	second := filepath.Join(dir, "second")
+	writeZoneFile(t, second, "10.0.0.3 db.corp.example\n10.0.0.1 primary.corp.example\n")
+
+	h, err := NewHostsResolver(answerResolver(60), []string{first, second}, &HostsOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for _, c := range []struct {
+		name     string
+		qtype    uint16
+		expected []string
+	}{
+		{"db.corp.example", dns.TypeA, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"DB.CORP.EXAMPLE.", dns.TypeAAAA, []string{"fd00::1"}},
+		{"db", dns.TypeA, []string{"10.0.0.1"}},
+		{"router.corp.example", dns.TypeAAAA, []string{"fe80::1"}},
+		// listed names have no other addresses
+		{"cache.corp.example", dns.TypeAAAA, []string{}},
+		{"1.0.0.10.in-addr.arpa", dns.TypePTR, []string{"db.corp.example.", "db.", "primary.corp.example."}},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR, []string{"db.corp.example."}},
+		// everything else goes to the fallback
+		{"db.corp.example", dns.TypeMX, []string{"127.0.0.1"}},
+		{"example.com", dns.TypeA, []string{"127.0.0.1"}},
+		{"9.0.0.10.in-addr.arpa", dns.TypePTR, []string{"127.0.0.1"}},
+	} {
+		if data := answerData(t, h, c.name, c.qtype); !reflect.DeepEqual(data, c.expected) {
+			t.Errorf("%v[%v]: expected %v, got %v", c.name, c.qtype, c.expected, data)
+		}
+	}
+
+	resp, err := h.Resolve(context.Background(), question("db.corp.example", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Answer[0].TTL != DefaultHostsTTL {
+		t.Errorf("expected the default TTL, got %v", resp.Answer[0].TTL)
+	}
+}
+
+func TestHostsResolverReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	writeZoneFile(t, path, "10.0.0.1 db.corp.example\n")
+
+	h, err := NewHostsResolver(answerResolver(60), []string{path}, &HostsOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	writeZoneFile(t, path, "10.0.0.22 db.corp.example\n")
+	h.reload()
+	if data := answerData(t, h, "db.corp.example", dns.TypeA); !reflect.DeepEqual(data, []string{"10.0.0.22"}) {
+		t.Errorf("expected the new address after reloading, got %v", data)
+	}
+
+	// a broken file keeps its previous entries
+	writeZoneFile(t, path, "10.0.0.23 db.corp.example\nnot-an-ip db\n")
+	h.reload()
+	if data := answerData(t, h, "db.corp.example", dns.TypeA); !reflect.DeepEqual(data, []string{"10.0.0.22"}) {
+		t.Errorf("expected the previous address to remain, got %v", data)
+	}
+}
+
+func TestParseHostsErrors(t *testing.T) {
+	for _, input := range []string{
+		"10.0.0.1",
+		"not-an-ip db.corp.example",
+		"10.0.0.1 db..corp.example",
+	} {
+		if _, err := parseHosts(strings.NewReader(input)); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
@@ -0,0 +1,691 @@
+package reverseoperator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// DefaultRootHints are the root servers, as published by IANA, which
+// iterative resolution starts from when no other hints are configured.
+const DefaultRootHints = `
+.                    3600000  NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.  3600000  A     198.41.0.4
+A.ROOT-SERVERS.NET.  3600000  AAAA  2001:503:ba3e::2:30
+.                    3600000  NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.  3600000  A     170.247.170.2
+B.ROOT-SERVERS.NET.  3600000  AAAA  2801:1b8:10::b
+.                    3600000  NS    C.ROOT-SERVERS.NET.
+C.ROOT-SERVERS.NET.  3600000  A     192.33.4.12
+C.ROOT-SERVERS.NET.  3600000  AAAA  2001:500:2::c
+.                    3600000  NS    D.ROOT-SERVERS.NET.
+D.ROOT-SERVERS.NET.  3600000  A     199.7.91.13
+D.ROOT-SERVERS.NET.  3600000  AAAA  2001:500:2d::d
+.                    3600000  NS    E.ROOT-SERVERS.NET.
+E.ROOT-SERVERS.NET.  3600000  A     192.203.230.10
+E.ROOT-SERVERS.NET.  3600000  AAAA  2001:500:a8::e
+.                    3600000  NS    F.ROOT-SERVERS.NET.
+F.ROOT-SERVERS.NET.  3600000  A     192.5.5.241
+F.ROOT-SERVERS.NET.  3600000  AAAA  2001:500:2f::f
+.                    3600000  NS    G.ROOT-SERVERS.NET.
+G.ROOT-SERVERS.NET.  3600000  A     192.112.36.4
+G.ROOT-SERVERS.NET.  3600000  AAAA  2001:500:12::d0d
+.                    3600000  NS    H.ROOT-SERVERS.NET.
+H.ROOT-SERVERS.NET.  3600000  A     198.97.190.53
+H.ROOT-SERVERS.NET.  3600000  AAAA  2001:500:1::53
+.                    3600000  NS    I.ROOT-SERVERS.NET.
+I.ROOT-SERVERS.NET.  3600000  A     192.36.148.17
+I.ROOT-SERVERS.NET.  3600000  AAAA  2001:7fe::53
+.                    3600000  NS    J.ROOT-SERVERS.NET.
+J.ROOT-SERVERS.NET.  3600000  A     192.58.128.30
+J.ROOT-SERVERS.NET.  3600000  AAAA  2001:503:c27::2:30
+.                    3600000  NS    K.ROOT-SERVERS.NET.
+K.ROOT-SERVERS.NET.  3600000  A     193.0.14.129
+K.ROOT-SERVERS.NET.  3600000  AAAA  2001:7fd::1
+.                    3600000  NS    L.ROOT-SERVERS.NET.
+L.ROOT-SERVERS.NET.  3600000  A     199.7.83.42
+L.ROOT-SERVERS.NET.  3600000  AAAA  2001:500:9f::42
+.                    3600000  NS    M.ROOT-SERVERS.NET.
+M.ROOT-SERVERS.NET.  3600000  A     202.12.27.33
+M.ROOT-SERVERS.NET.  3600000  AAAA  2001:dc3::35
+`
+
+const (
+	// DefaultMaxQueries is the number of queries iterative resolution may
+	// send to resolve a question, including those to find the addresses of
+	// nameservers, when no other limit is configured.
+	DefaultMaxQueries = 100
+	// DefaultMaxDepth is how deeply the addresses of nameservers may be
+	// resolved while resolving other names, when no other limit is
+	// configured.
+	DefaultMaxDepth = 6
+	// DefaultIterativeTimeout is how long an authoritative server is given to
+	// respond to a query when no other timeout is configured.
+	DefaultIterativeTimeout = time.Second
+	// DefaultIterativeDeadline is how long iterative resolution of a question
+	// may take in all when no other deadline is configured.
+	DefaultIterativeDeadline = 10 * time.Second
+)
+
+// maxDelegationTTL is the longest a delegation is cached, however long the TTL
+// of its NS records
+const maxDelegationTTL = 24 * time.Hour
+
+// maxDelegations is the number of delegations cached before expired ones are
+// removed to make room
+const maxDelegations = 10000
+
+var (
+	// errMaxQueries is returned when a question can't be resolved within
+	// the limit on queries, as with a long chain of lame delegations
+	errMaxQueries = errors.New("too many queries needed to resolve question")
+	// errMaxDepth is returned when the nameservers of a zone can only be
+	// found through too many others
+	errMaxDepth = errors.New("nameservers nested too deeply")
+)
+
+// ParseRootHints parses the addresses of root servers from a master file,
+// such as IANA's named.root.
+func ParseRootHints(r io.Reader) ([]net.IP, error) {
+	var (
+		hints []net.IP
+		err   error
+	)
+	for t := range dns.ParseZone(r, ".", "") {
+		// the parser stops at its first error, but the channel must still
+		// be drained
+		if err != nil {
+			continue
+		}
+		if t.Error != nil {
+			err = t.Error
+			continue
+		}
+
+		switch rr := t.RR.(type) {
+		case *dns.A:
+			hints = append(hints, rr.A)
+		case *dns.AAAA:
+			hints = append(hints, rr.AAAA)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(hints) == 0 {
+		return nil, fmt.Errorf("no root server addresses found")
+	}
+
+	return hints, nil
+}
+
+// IterativeOptions is a configuration object for optional IterativeResolver
+// configuration.
+type IterativeOptions struct {
+	// RootHints are the addresses of the root servers; if empty, those of
+	// DefaultRootHints are used.
+	RootHints []net.IP
+	// IPv6 allows nameservers to be queried over IPv6; otherwise only their
+	// IPv4 addresses are used.
+	IPv6 bool
+	// DisableQNAMEMinimisation sends the full question to every server,
+	// rather than only as much of the name as each needs to refer onwards,
+	// as described by RFC 7816.
+	DisableQNAMEMinimisation bool
+	// MaxQueries is the number of queries which may be sent to resolve a
+	// question; if zero, DefaultMaxQueries is used.
+	MaxQueries int
+	// MaxDepth is how deeply the addresses of nameservers may be resolved
+	// while resolving other names; if zero, DefaultMaxDepth is used.
+	MaxDepth int
+	// Timeout is how long a server is given to respond to a query; if zero,
+	// DefaultIterativeTimeout is used.
+	Timeout time.Duration
+	// Deadline is how long resolving a question may take in all; if zero,
+	// DefaultIterativeDeadline is used.
+	Deadline time.Duration
+}
+
+// NewIterativeResolver creates an IterativeResolver.
+func NewIterativeResolver(opts *IterativeOptions) (*IterativeResolver, error) {
+	if opts == nil {
+		opts = &IterativeOptions{}
+	}
+
+	hints := opts.RootHints
+	if len(hints) == 0 {
+		var err error
+		if hints, err = ParseRootHints(strings.NewReader(DefaultRootHints)); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &IterativeResolver{
+		opts:        opts,
+		root:        &delegation{zone: "."},
+		delegations: make(map[string]*delegation),
+	}
+	for _, ip := range hints {
+		if r.usable(ip) {
+			r.root.addresses = append(r.root.addresses, ip)
+		}
+	}
+	if len(r.root.addresses) == 0 {
+		return nil, fmt.Errorf("no usable root server addresses")
+	}
+
+	return r, nil
+}
+
+// IterativeResolver resolves questions itself, starting from the root servers
+// and following referrals down to the servers authoritative for each name,
+// rather than asking another recursive server. Delegations are cached, so
+// that later questions start from the closest known zone.
+type IterativeResolver struct {
+	// counters are accessed atomically, so are kept first for alignment
+	queries  uint64
+	upstream uint64
+
+	opts    *IterativeOptions
+	flights flightGroup
+	root    *delegation
+
+	mutex sync.Mutex
+	// delegations holds the nameservers of each zone found, keyed by the
+	// canonical name of the zone
+	delegations map[string]*delegation
+}
+
+// IterativeStats are counters describing the questions an IterativeResolver
+// has resolved.
+type IterativeStats struct {
+	// Queries is the number of questions asked of the resolver
+	Queries uint64
+	// Upstream is the number of queries sent to authoritative servers
+	Upstream uint64
+	// Delegations is the number of zones whose nameservers are cached
+	Delegations int
+}
+
+// Stats returns the resolver's counters.
+func (r *IterativeResolver) Stats() IterativeStats {
+	r.mutex.Lock()
+	delegations := len(r.delegations)
+	r.mutex.Unlock()
+
+	return IterativeStats{
+		Queries:     atomic.LoadUint64(&r.queries),
+		Upstream:    atomic.LoadUint64(&r.upstream),
+		Delegations: delegations,
+	}
+}
+
+// delegation is the set of nameservers for a zone.
+type delegation struct {
+	zone    string
+	expires time.Time
+
+	mutex sync.Mutex
+	// addresses holds the known addresses of the zone's nameservers, from
+	// glue or found since
+	addresses []net.IP
+	// unresolved holds the names of the zone's nameservers whose addresses
+	// haven't been found
+	unresolved []string
+}
+
+// servers returns the known addresses of the zone's nameservers, and the
+// names of those whose addresses aren't yet known, each in random order.
+func (d *delegation) servers() ([]net.IP, []string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	addresses := make([]net.IP, len(d.addresses))
+	for i, j := range rand.Perm(len(d.addresses)) {
+		addresses[i] = d.addresses[j]
+	}
+	unresolved := make([]string, len(d.unresolved))
+	for i, j := range rand.Perm(len(d.unresolved)) {
+		unresolved[i] = d.unresolved[j]
+	}
+
+	return addresses, unresolved
+}
+
+// resolved records the addresses found for one of the zone's nameservers.
+func (d *delegation) resolved(name string, addresses []net.IP) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for i, n := range d.unresolved {
+		if n == name {
+			d.unresolved = append(d.unresolved[:i:i], d.unresolved[i+1:]...)
+			d.addresses = append(d.addresses, addresses...)
+			return
+		}
+	}
+}
+
+// iteration is the state of resolving a single question, shared by the
+// resolutions of the names it depends on.
+type iteration struct {
+	// queries is the number of queries which may still be sent
+	queries int
+	// resolving holds the questions being resolved, so that one which
+	// depends on itself is found
+	resolving map[string]bool
+}
+
+// Resolve resolves a question iteratively; it implements Resolver. If an
+// identical question is already being resolved, its response is shared.
+// DNSSEC records and client subnets aren't asked for.
+func (r *IterativeResolver) Resolve(ctx context.Context, q Question) (*Response, error) {
+	atomic.AddUint64(&r.queries, 1)
+
+	resp, err, _ := r.flights.do(ctx, newQuestionKey(q), func(ctx context.Context) (*Response, error) {
+		ctx, cancel := context.WithTimeout(ctx, r.deadline())
+		defer cancel()
+
+		it := &iteration{queries: r.maxQueries(), resolving: make(map[string]bool)}
+		m, err := r.resolve(ctx, it, canonicalName(q.Name), q.Type, 0)
+		if err != nil {
+			return nil, err
+		}
+		m.Question[0].Name = dns.Fqdn(q.Name)
+
+		return msgToResponse(q, m), nil
+	})
+
+	return resp, err
+}
+
+// resolve resolves a question from the closest known zone above its name,
+// following any CNAMEs in the answer.
+func (r *IterativeResolver) resolve(ctx context.Context, it *iteration, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > r.maxDepth() {
+		return nil, errMaxDepth
+	}
+	key := rrsetKeyOf(name, qtype)
+	if it.resolving[key] {
+		return nil, fmt.Errorf("resolving %v[%v] depends on itself", name, dns.TypeToString[qtype])
+	}
+	it.resolving[key] = true
+	defer delete(it.resolving, key)
+
+	result := new(dns.Msg)
+	result.SetQuestion(name, qtype)
+	result.Response = true
+	result.RecursionAvailable = true
+
+	for i := 0; i < maxCNAMEChain; i++ {
+		m, zone, err := r.lookup(ctx, it, name, qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		answer, target := answerChain(m, zone, name, qtype)
+		result.Answer = append(result.Answer, answer...)
+		result.Ns = m.Ns
+		result.Rcode = m.Rcode
+		if target == "" {
+			return result, nil
+		}
+		name = target
+	}
+
+	// the chain is too long, so is likely a loop
+	result.Rcode = dns.RcodeServerFailure
+	result.Answer, result.Ns = nil, nil
+	return result, nil
+}
+
+// answerChain returns the records of a response which answer the question,
+// following CNAMEs, from those within the zone which gave it; records from
+// outside the zone can't be trusted. If a CNAME leads to a name whose
+// records the response doesn't give or deny, such as one outside the zone,
+// that name is returned to be resolved in turn.
+func answerChain(m *dns.Msg, zone, name string, qtype uint16) ([]dns.RR, string) {
+	negative := m.Rcode == dns.RcodeNameError || len(filterRRs(m.Ns, dns.TypeSOA)) > 0
+
+	var chain []dns.RR
+	for i := 0; i < maxCNAMEChain; i++ {
+		var found, cname []dns.RR
+		for _, rr := range m.Answer {
+			h := rr.Header()
+			if canonicalName(h.Name) != name || !dns.IsSubDomain(zone, name) {
+				continue
+			}
+			if h.Rrtype == qtype || qtype == dns.TypeANY {
+				found = append(found, rr)
+			} else if h.Rrtype == dns.TypeCNAME {
+				cname = append(cname, rr)
+			}
+		}
+
+		switch {
+		case len(found) > 0:
+			return append(chain, found...), ""
+		case len(cname) > 0:
+			chain = append(chain, cname[0])
+			name = canonicalName(cname[0].(*dns.CNAME).Target)
+		case len(chain) > 0 && !negative:
+			return chain, name
+		default:
+			return chain, ""
+		}
+	}
+
+	return chain, name
+}
+
+// lookup asks the servers of the closest known zone above name, following
+// referrals down towards it, and returns the final response along with the
+// zone which gave it. With QNAME minimisation, each zone is asked only for
+// the NS records of the name one label below it, until the zone which holds
+// the name is found.
+func (r *IterativeResolver) lookup(ctx context.Context, it *iteration, name string, qtype uint16, depth int) (*dns.Msg, string, error) {
+	d := r.closest(name)
+	minimise := !r.opts.DisableQNAMEMinimisation
+	labels := dns.CountLabel(d.zone)
+
+	for {
+		qname, qt := name, qtype
+		minimised := minimise && labels+1 < dns.CountLabel(name)
+		if minimised {
+			qname, qt = ancestor(name, labels+1), dns.TypeNS
+		}
+
+		m, err := r.ask(ctx, it, d, qname, qt, depth)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if zone, ok := referral(m); ok {
+			d = r.delegate(m, zone, d.zone)
+			labels = dns.CountLabel(d.zone)
+			continue
+		}
+		if !minimised {
+			return m, d.zone, nil
+		}
+
+		switch m.Rcode {
+		case dns.RcodeSuccess:
+			// the name isn't delegated elsewhere, so the same servers are
+			// asked for the next label
+			labels++
+		case dns.RcodeNameError:
+			// nothing exists below a name which doesn't exist, per RFC 8020
+			return m, d.zone, nil
+		default:
+			// some servers mishandle questions for parts of names, so the
+			// whole name is asked instead
+			minimise = false
+		}
+	}
+}
+
+// ask sends a question to the servers of a zone until one gives a useful
+// response, finding the addresses of nameservers without glue as needed. If
+// every server fails, the last failed response is returned, if any.
+func (r *IterativeResolver) ask(ctx context.Context, it *iteration, d *delegation, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.RecursionDesired = false
+	msg.SetEdns0(ednsUDPSize, false)
+
+	var failed *dns.Msg
+	try := func(ip net.IP) (*dns.Msg, error) {
+		if it.queries <= 0 {
+			return nil, errMaxQueries
+		}
+		it.queries--
+		atomic.AddUint64(&r.upstream, 1)
+
+		qctx, cancel := context.WithTimeout(ctx, r.timeout())
+		defer cancel()
+
+		address := net.JoinHostPort(ip.String(), "53")
+		m, err := r.exchange(qctx, msg.Copy(), address)
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case err != nil:
+			log.Debugf("nameserver %v of %v failed for %v[%v]: %v", address, d.zone, name, dns.TypeToString[qtype], err)
+			return nil, nil
+		case len(m.Question) != 1 || !strings.EqualFold(m.Question[0].Name, name) || m.Question[0].Qtype != qtype:
+			log.Debugf("nameserver %v of %v answered another question than %v[%v]", address, d.zone, name, dns.TypeToString[qtype])
+			return nil, nil
+		case !isUsefulResponse(m):
+			failed = m
+			return nil, nil
+		}
+
+		// a referral must lead closer to the name, or the server is lame
+		if zone, ok := referral(m); ok && (zone == d.zone || !dns.IsSubDomain(d.zone, zone) || !dns.IsSubDomain(zone, name)) {
+			log.Debugf("nameserver %v of %v is lame for %v[%v], referring to %v", address, d.zone, name, dns.TypeToString[qtype], zone)
+			return nil, nil
+		}
+		return m, nil
+	}
+
+	addresses, unresolved := d.servers()
+	for _, ip := range addresses {
+		if m, err := try(ip); m != nil || err != nil {
+			return m, err
+		}
+	}
+	for _, ns := range unresolved {
+		ips, err := r.nameserverAddresses(ctx, it, ns, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		d.resolved(ns, ips)
+		for _, ip := range ips {
+			if m, err := try(ip); m != nil || err != nil {
+				return m, err
+			}
+		}
+	}
+
+	if failed != nil {
+		return failed, nil
+	}
+	return nil, fmt.Errorf("no nameserver of %v answered %v[%v]", d.zone, name, dns.TypeToString[qtype])
+}
+
+// nameserverAddresses resolves the addresses of a nameserver. Failing to
+// find them only fails the question if its limits have been reached, as
+// other nameservers may answer.
+func (r *IterativeResolver) nameserverAddresses(ctx context.Context, it *iteration, name string, depth int) ([]net.IP, error) {
+	qtypes := []uint16{dns.TypeA}
+	if r.opts.IPv6 {
+		qtypes = append(qtypes, dns.TypeAAAA)
+	}
+
+	var ips []net.IP
+	for _, qtype := range qtypes {
+		m, err := r.resolve(ctx, it, name, qtype, depth)
+		switch {
+		case err == errMaxQueries || err == errMaxDepth || ctx.Err() != nil:
+			return nil, err
+		case err != nil:
+			log.Debugf("failed to resolve nameserver %v: %v", name, err)
+			continue
+		}
+
+		for _, rr := range m.Answer {
+			switch a := rr.(type) {
+			case *dns.A:
+				ips = append(ips, a.A)
+			case *dns.AAAA:
+				ips = append(ips, a.AAAA)
+			}
+		}
+	}
+
+	return ips, nil
+}
+
+// exchange sends a message to a server over UDP, falling back to TCP if the
+// response was truncated.
+func (r *IterativeResolver) exchange(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, error) {
+	resp, err := exchange(ctx, m, "udp", address)
+	if err != nil || !resp.Truncated {
+		return resp, err
+	}
+
+	return exchange(ctx, m, "tcp", address)
+}
+
+// referral returns the zone a response refers to, if it is a referral: it has
+// no answer, and NS records rather than a SOA record in its authority.
+func referral(m *dns.Msg) (string, bool) {
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) > 0 {
+		return "", false
+	}
+
+	var zone string
+	for _, rr := range m.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			return "", false
+		case dns.TypeNS:
+			zone = canonicalName(rr.Header().Name)
+		}
+	}
+
+	return zone, zone != ""
+}
+
+// delegate records the delegation a referral from parent gives to zone,
+// caching it for later questions. Glue is only used for nameservers within
+// parent, as the parent's servers can't speak for addresses elsewhere.
+func (r *IterativeResolver) delegate(m *dns.Msg, zone, parent string) *delegation {
+	d := &delegation{zone: zone}
+	ttl := maxDelegationTTL
+	for _, rr := range m.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok || canonicalName(ns.Hdr.Name) != zone {
+			continue
+		}
+		if t := time.Duration(ns.Hdr.Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+
+		name := canonicalName(ns.Ns)
+		var glue []net.IP
+		if dns.IsSubDomain(parent, name) {
+			for _, rr := range m.Extra {
+				if canonicalName(rr.Header().Name) != name {
+					continue
+				}
+				switch a := rr.(type) {
+				case *dns.A:
+					glue = append(glue, a.A)
+				case *dns.AAAA:
+					glue = append(glue, a.AAAA)
+				}
+			}
+		}
+
+		var usable bool
+		for _, ip := range glue {
+			if r.usable(ip) {
+				d.addresses = append(d.addresses, ip)
+				usable = true
+			}
+		}
+		if !usable {
+			d.unresolved = append(d.unresolved, name)
+		}
+	}
+	d.expires = now().Add(ttl)
+
+	if ttl > 0 {
+		r.mutex.Lock()
+		if len(r.delegations) >= maxDelegations {
+			r.prune()
+		}
+		r.delegations[zone] = d
+		r.mutex.Unlock()
+	}
+
+	return d
+}
+
+// prune removes expired delegations from the cache, or if none have, an
+// arbitrary one; the mutex must be held.
+func (r *IterativeResolver) prune() {
+	t := now()
+	for zone, d := range r.delegations {
+		if !t.Before(d.expires) {
+			delete(r.delegations, zone)
+		}
+	}
+	for zone := range r.delegations {
+		if len(r.delegations) < maxDelegations {
+			break
+		}
+		delete(r.delegations, zone)
+	}
+}
+
+// closest returns the cached delegation of the closest zone at or above name,
+// or the root's.
+func (r *IterativeResolver) closest(name string) *delegation {
+	t := now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if d, ok := r.delegations[name[off:]]; ok && t.Before(d.expires) {
+			return d
+		}
+	}
+
+	return r.root
+}
+
+// usable returns whether a nameserver address may be queried.
+func (r *IterativeResolver) usable(ip net.IP) bool {
+	return ip.To4() != nil || r.opts.IPv6
+}
+
+func (r *IterativeResolver) maxQueries() int {
+	if r.opts.MaxQueries > 0 {
+		return r.opts.MaxQueries
+	}
+	return DefaultMaxQueries
+}
+
+func (r *IterativeResolver) maxDepth() int {
+	if r.opts.MaxDepth > 0 {
+		return r.opts.MaxDepth
+	}
+	return DefaultMaxDepth
+}
+
+func (r *IterativeResolver) timeout() time.Duration {
+	if r.opts.Timeout > 0 {
+		return r.opts.Timeout
+	}
+	return DefaultIterativeTimeout
+}
+
+func (r *IterativeResolver) deadline() time.Duration {
+	if r.opts.Deadline > 0 {
+		return r.opts.Deadline
+	}
+	return DefaultIterativeDeadline
+}
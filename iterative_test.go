@@ -0,0 +1,419 @@
+package reverseoperator
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// the stand-in authoritative servers of a small hierarchy, keyed by the
+// address they are known by in its zones
+var testAuthorityZones = map[string][]string{
+	"10.0.0.1": {`
+. 86400 IN SOA a.root. hostmaster.root. 1 3600 600 86400 60
+. 86400 IN NS a.root.
+a.root. 86400 IN A 10.0.0.1
+test. 86400 IN NS ns1.test.
+test. 86400 IN NS ns2.test.
+ns1.test. 86400 IN A 10.0.1.1
+ns2.test. 86400 IN A 10.0.1.2
+other. 86400 IN NS ns.other.
+ns.other. 86400 IN A 10.0.2.1
+a. 86400 IN NS ns.b.
+b. 86400 IN NS ns.a.
+d1. 86400 IN NS ns.d2.
+d2. 86400 IN NS ns.x.d3.
+d3. 86400 IN NS ns.d3.
+ns.d3. 86400 IN A 10.0.4.1
+`},
+	"10.0.1.1": {`
+test. 3600 IN SOA ns1.test. hostmaster.test. 1 3600 600 86400 60
+test. 3600 IN NS ns1.test.
+test. 3600 IN NS ns2.test.
+ns1.test. 3600 IN A 10.0.1.1
+ns2.test. 3600 IN A 10.0.1.2
+www.test. 300 IN A 192.0.2.10
+mail.test. 300 IN A 192.0.2.11
+alias.test. 300 IN CNAME www.sub.test.
+x.test. 300 IN CNAME y.other.
+sub.test. 3600 IN NS ns.elsewhere.other.
+evil.test. 3600 IN NS ns.other.
+`},
+	// a lame server, which only knows the root zone
+	"10.0.1.2": {`
+. 86400 IN SOA a.root. hostmaster.root. 1 3600 600 86400 60
+. 86400 IN NS a.root.
+test. 86400 IN NS ns1.test.
+ns1.test. 86400 IN A 10.0.1.1
+`},
+	"10.0.2.1": {`
+other. 3600 IN SOA ns.other. hostmaster.other. 1 3600 600 86400 60
+other. 3600 IN NS ns.other.
+ns.other. 3600 IN A 10.0.2.1
+ns.elsewhere.other. 3600 IN A 10.0.3.1
+y.other. 300 IN CNAME x.test.
+`, `
+evil.test. 3600 IN SOA ns.other. hostmaster.other. 1 3600 600 86400 60
+evil.test. 3600 IN NS ns.other.
+www.evil.test. 300 IN A 192.0.2.40
+`},
+	"10.0.3.1": {`
+sub.test. 3600 IN SOA ns.elsewhere.other. hostmaster.other. 1 3600 600 86400 60
+sub.test. 3600 IN NS ns.elsewhere.other.
+www.sub.test. 300 IN A 192.0.2.30
+`},
+	"10.0.4.1": {`
+d1. 3600 IN SOA ns.d2. hostmaster.d2. 1 3600 600 86400 60
+d1. 3600 IN NS ns.d2.
+www.d1. 300 IN A 192.0.2.50
+`, `
+d2. 3600 IN SOA ns.d3. hostmaster.d3. 1 3600 600 86400 60
+d2. 3600 IN NS ns.x.d3.
+ns.d2. 3600 IN A 10.0.4.1
+`, `
+d3. 3600 IN SOA ns.d3. hostmaster.d3. 1 3600 600 86400 60
+d3. 3600 IN NS ns.d3.
+ns.d3. 3600 IN A 10.0.4.1
+ns.x.d3. 3600 IN A 10.0.4.1
+`},
+}
+
+// testAuthorities runs a stand-in authoritative server for each address of
+// testAuthorityZones, and routes queries to those addresses to them; queries
+// to any other address fail. The queries each server receives are recorded.
+type testAuthorities struct {
+	mutex   sync.Mutex
+	queries map[string][]string
+	// tamper, if set, may change the responses of the server at an address
+	tamper map[string]func(*dns.Msg)
+}
+
+func startTestAuthorities(t *testing.T) (*testAuthorities, func()) {
+	a := &testAuthorities{
+		queries: make(map[string][]string),
+		tamper:  make(map[string]func(*dns.Msg)),
+	}
+
+	var shutdowns []func()
+	routes := make(map[string]string)
+	for ip, texts := range testAuthorityZones {
+		zones := make(map[string]*Zone)
+		for _, text := range texts {
+			z, err := ParseZone(strings.NewReader(text), "", ip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zones[z.Origin()] = z
+		}
+
+		ip := ip
+		ep, shutdown := startTestServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+			q := req.Question[0]
+			a.mutex.Lock()
+			a.queries[ip] = append(a.queries[ip], canonicalName(q.Name)+"/"+dns.TypeToString[q.Qtype])
+			tamper := a.tamper[ip]
+			a.mutex.Unlock()
+
+			z := zoneFor(zones, q.Name)
+			if z == nil {
+				w.WriteMsg(reply(req, dns.RcodeRefused))
+				return
+			}
+			m, _ := z.lookup(q.Name, q.Qtype)
+			rcode, aa := m.Rcode, m.Authoritative
+			m.SetReply(req)
+			m.Rcode, m.Authoritative = rcode, aa
+			if tamper != nil {
+				tamper(m)
+			}
+			w.WriteMsg(m)
+		})
+		shutdowns = append(shutdowns, shutdown)
+		routes[net.JoinHostPort(ip, "53")] = ep.String()
+	}
+
+	orig := exchange
+	exchange = func(ctx context.Context, m *dns.Msg, network, address string) (*dns.Msg, error) {
+		route, ok := routes[address]
+		if !ok {
+			a.mutex.Lock()
+			a.queries[address] = append(a.queries[address], m.Question[0].Name)
+			a.mutex.Unlock()
+			return nil, errTestUpstream
+		}
+		return orig(ctx, m, network, route)
+	}
+
+	return a, func() {
+		exchange = orig
+		for _, shutdown := range shutdowns {
+			shutdown()
+		}
+	}
+}
+
+func (a *testAuthorities) received(ip string) []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]string(nil), a.queries[ip]...)
+}
+
+func (a *testAuthorities) setTamper(ip string, tamper func(*dns.Msg)) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.tamper[ip] = tamper
+}
+
+func (a *testAuthorities) reset() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.queries = make(map[string][]string)
+}
+
+func testIterativeResolver(t *testing.T, opts *IterativeOptions) *IterativeResolver {
+	if opts == nil {
+		opts = &IterativeOptions{}
+	}
+	opts.RootHints = []net.IP{net.ParseIP("10.0.0.1")}
+	r, err := NewIterativeResolver(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestIterativeResolve(t *testing.T) {
+	_, shutdown := startTestAuthorities(t)
+	defer shutdown()
+
+	for _, minimise := range []bool{true, false} {
+		r := testIterativeResolver(t, &IterativeOptions{DisableQNAMEMinimisation: !minimise})
+
+		for _, c := range []struct {
+			name     string
+			qtype    uint16
+			rcode    int
+			expected []string
+		}{
+			{"www.test", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.10"}},
+			{"WWW.test.", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.10"}},
+			// the nameserver of sub.test. is found by resolving its name
+			{"www.sub.test", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.30"}},
+			{"alias.test", dns.TypeA, dns.RcodeSuccess, []string{"www.sub.test.", "192.0.2.30"}},
+			{"www.evil.test", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.40"}},
+			{"www.d1", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.50"}},
+			{"nope.test", dns.TypeA, dns.RcodeNameError, []string{}},
+			{"a.b.nope.test", dns.TypeA, dns.RcodeNameError, []string{}},
+			{"www.test", dns.TypeTXT, dns.RcodeSuccess, []string{}},
+			// a loop of CNAMEs across zones
+			{"x.test", dns.TypeA, dns.RcodeServerFailure, []string{}},
+		} {
+			resp, err := r.Resolve(context.Background(), question(c.name, c.qtype))
+			if err != nil {
+				t.Fatalf("%v[%v], minimise %v: %v", c.name, c.qtype, minimise, err)
+			}
+			if resp.ResponseCode != c.rcode {
+				t.Errorf("%v[%v], minimise %v: expected rcode %v, got %v", c.name, c.qtype, minimise, c.rcode, resp.ResponseCode)
+			}
+			data := []string{}
+			for _, a := range resp.Answer {
+				data = append(data, a.Data)
+			}
+			if !reflect.DeepEqual(data, c.expected) {
+				t.Errorf("%v[%v], minimise %v: expected %v, got %v", c.name, c.qtype, minimise, c.expected, data)
+			}
+			if len(resp.Question) != 1 || resp.Question[0].Name != dns.Fqdn(c.name) {
+				t.Errorf("%v[%v]: expected the question to be kept, got %v", c.name, c.qtype, resp.Question)
+			}
+			if c.rcode == dns.RcodeNameError && (len(resp.Authority) == 0 || resp.Authority[0].Type != dns.TypeSOA) {
+				t.Errorf("%v[%v]: expected the SOA in the authority, got %v", c.name, c.qtype, resp.Authority)
+			}
+		}
+	}
+}
+
+func TestIterativeQNAMEMinimisation(t *testing.T) {
+	a, shutdown := startTestAuthorities(t)
+	defer shutdown()
+
+	r := testIterativeResolver(t, nil)
+	if _, err := r.Resolve(context.Background(), question("www.sub.test", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the root only learns the top level domains, and test. only the name
+	// delegated from it
+	for _, q := range a.received("10.0.0.1") {
+		if q != "test./NS" && q != "other./NS" {
+			t.Errorf("expected the root to be asked only for delegations, got %v", q)
+		}
+	}
+	for _, q := range a.received("10.0.1.1") {
+		if q != "sub.test./NS" {
+			t.Errorf("expected test. to be asked only for sub.test., got %v", q)
+		}
+	}
+	if q := a.received("10.0.3.1"); !reflect.DeepEqual(q, []string{"www.sub.test./A"}) {
+		t.Errorf("expected sub.test. to be asked the question, got %v", q)
+	}
+
+	a.reset()
+	r = testIterativeResolver(t, &IterativeOptions{DisableQNAMEMinimisation: true})
+	if _, err := r.Resolve(context.Background(), question("www.sub.test", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if q := a.received("10.0.0.1"); len(q) == 0 || q[0] != "www.sub.test./A" {
+		t.Errorf("expected the root to be asked the whole question, got %v", q)
+	}
+}
+
+func TestIterativeDelegationCache(t *testing.T) {
+	a, shutdown := startTestAuthorities(t)
+	defer shutdown()
+
+	r := testIterativeResolver(t, nil)
+	if _, err := r.Resolve(context.Background(), question("www.sub.test", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Stats(); s.Delegations != 3 {
+		t.Errorf("expected test., other. and sub.test. to be cached, got %v", s.Delegations)
+	}
+
+	a.reset()
+	for _, name := range []string{"mail.test", "www.sub.test"} {
+		if _, err := r.Resolve(context.Background(), question(name, dns.TypeA)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q := a.received("10.0.0.1"); len(q) != 0 {
+		t.Errorf("expected the root not to be asked again, got %v", q)
+	}
+	if q := a.received("10.0.2.1"); len(q) != 0 {
+		t.Errorf("expected the address of the nameserver of sub.test. to be kept, got %v", q)
+	}
+
+	// once expired, delegations are found again
+	advance, restore := mockNow(now())
+	defer restore()
+	advance(maxDelegationTTL)
+	if _, err := r.Resolve(context.Background(), question("mail.test", dns.TypeTXT)); err != nil {
+		t.Fatal(err)
+	}
+	if q := a.received("10.0.0.1"); len(q) == 0 {
+		t.Error("expected the root to be asked once the delegation expired")
+	}
+}
+
+func TestIterativeGlue(t *testing.T) {
+	a, shutdown := startTestAuthorities(t)
+	defer shutdown()
+
+	// test. may not give addresses for names outside of itself
+	a.setTamper("10.0.1.1", func(m *dns.Msg) {
+		for _, rr := range m.Ns {
+			if ns, ok := rr.(*dns.NS); ok && ns.Ns == "ns.other." {
+				glue, _ := dns.NewRR("ns.other. 3600 IN A 10.66.66.66")
+				m.Extra = append(m.Extra, glue)
+				return
+			}
+		}
+	})
+
+	r := testIterativeResolver(t, nil)
+	if data := answerData(t, r, "www.evil.test", dns.TypeA); !reflect.DeepEqual(data, []string{"192.0.2.40"}) {
+		t.Errorf("expected the answer of the real nameserver, got %v", data)
+	}
+	if q := a.received("10.66.66.66:53"); len(q) != 0 {
+		t.Errorf("expected glue from outside the zone to be ignored, got queries %v", q)
+	}
+}
+
+func TestIterativeLimits(t *testing.T) {
+	_, shutdown := startTestAuthorities(t)
+	defer shutdown()
+
+	// the nameservers of a. and b. are each within the other
+	r := testIterativeResolver(t, nil)
+	if _, err := r.Resolve(context.Background(), question("www.a", dns.TypeA)); err == nil {
+		t.Error("expected a cycle of nameservers to fail")
+	}
+	if s := r.Stats(); s.Upstream > DefaultMaxQueries {
+		t.Errorf("expected at most %v queries, got %v", DefaultMaxQueries, s.Upstream)
+	}
+
+	r = testIterativeResolver(t, &IterativeOptions{MaxQueries: 3})
+	if _, err := r.Resolve(context.Background(), question("www.sub.test", dns.TypeA)); err != errMaxQueries {
+		t.Errorf("expected the query limit to be reached, got %v", err)
+	}
+	if s := r.Stats(); s.Upstream != 3 {
+		t.Errorf("expected 3 queries, got %v", s.Upstream)
+	}
+
+	// the nameserver of d1. is within d2., whose nameserver is within d3.,
+	// neither with glue
+	r = testIterativeResolver(t, &IterativeOptions{MaxDepth: 1})
+	if _, err := r.Resolve(context.Background(), question("www.d1", dns.TypeA)); err != errMaxDepth {
+		t.Errorf("expected the depth limit to be reached, got %v", err)
+	}
+}
+
+func TestIterativeUnreachable(t *testing.T) {
+	_, shutdown := startTestAuthorities(t)
+	defer shutdown()
+
+	r, err := NewIterativeResolver(&IterativeOptions{RootHints: []net.IP{net.ParseIP("10.9.9.9")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Resolve(context.Background(), question("www.test", dns.TypeA)); err == nil {
+		t.Error("expected an error when no root server answers")
+	}
+}
+
+func TestNewIterativeResolver(t *testing.T) {
+	r, err := NewIterativeResolver(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.root.addresses) != 13 {
+		t.Errorf("expected the IPv4 addresses of the 13 root servers, got %v", len(r.root.addresses))
+	}
+
+	r, err = NewIterativeResolver(&IterativeOptions{IPv6: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.root.addresses) != 26 {
+		t.Errorf("expected both addresses of the 13 root servers, got %v", len(r.root.addresses))
+	}
+
+	if _, err := NewIterativeResolver(&IterativeOptions{RootHints: []net.IP{net.ParseIP("2001:db8::1")}}); err == nil {
+		t.Error("expected an error without usable root hints")
+	}
+}
+
+func TestParseRootHints(t *testing.T) {
+	hints, err := ParseRootHints(strings.NewReader(`
+; a named.root excerpt
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hints) != 2 || !hints[0].Equal(net.ParseIP("198.41.0.4")) {
+		t.Errorf("unexpected hints %v", hints)
+	}
+
+	for _, content := range []string{"", ". 3600 NS a.root.", "a.root. A nope"} {
+		if _, err := ParseRootHints(strings.NewReader(content)); err == nil {
+			t.Errorf("%q: expected an error", content)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package reverseoperator
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	dnsMessageContentType = "application/dns-message"
+	dnsJSONContentType    = "application/dns-json"
+	jsonContentType       = "application/json"
+	// this is google's content type
+	javascriptContentType = "application/x-javascript"
+)
+
+var errCTInvalid = errors.New("ct parameter must be one of " + strings.Join(resolveContentTypes, ", "))
+
+// resolveContentTypes are the content types the JSON API endpoint may respond
+// with.
+var resolveContentTypes = []string{
+	javascriptContentType,
+	dnsJSONContentType,
+	jsonContentType,
+	dnsMessageContentType,
+}
+
+// negotiateContentType picks the content type of a JSON API response; the
+// `ct` parameter takes precedence, as in Google's API, followed by the accept
+// header. If neither names a supported type, the default is used.
+func negotiateContentType(r *http.Request, def string) (string, error) {
+	if ct := r.URL.Query().Get("ct"); ct != "" {
+		if !isResolveContentType(ct) {
+			return "", errCTInvalid
+		}
+		return ct, nil
+	}
+
+	best, bestQ, bestExplicit := def, 0.0, false
+	for _, a := range strings.Split(r.Header.Get("accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(a))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		// a quality of zero means the type is not acceptable at all
+		if q <= 0 {
+			continue
+		}
+
+		// wildcards are satisfied by the default, but an explicit type of
+		// equal quality is preferred
+		explicit := true
+		if mt == "*/*" || mt == "application/*" {
+			mt, explicit = def, false
+		} else if !isResolveContentType(mt) {
+			continue
+		}
+
+		if q > bestQ || (q == bestQ && explicit && !bestExplicit) {
+			best, bestQ, bestExplicit = mt, q, explicit
+		}
+	}
+
+	return best, nil
+}
+
+func isResolveContentType(ct string) bool {
+	for _, t := range resolveContentTypes {
+		if ct == t {
+			return true
+		}
+	}
+	return false
+}
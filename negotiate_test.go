@@ -0,0 +1,44 @@
+package reverseoperator
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+	tests := []struct {
+		url, accept, expected string
+	}{
+		{"/resolve", "", javascriptContentType},
+		{"/resolve?ct=application/dns-message", "", dnsMessageContentType},
+		{"/resolve?ct=application/dns-json", "application/dns-message", dnsJSONContentType},
+		{"/resolve", "application/dns-message", dnsMessageContentType},
+		{"/resolve", "text/html, */*;q=0.8", javascriptContentType},
+		{"/resolve", "*/*, application/dns-message", dnsMessageContentType},
+		{"/resolve", "application/json;q=0.5, application/dns-json", dnsJSONContentType},
+		{"/resolve", "application/dns-message;q=0", javascriptContentType},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		if tt.accept != "" {
+			r.Header.Set("accept", tt.accept)
+		}
+
+		ct, err := negotiateContentType(r, javascriptContentType)
+		if err != nil {
+			t.Errorf("unexpected error for %v %v: %v", tt.url, tt.accept, err)
+			continue
+		}
+		if ct != tt.expected {
+			t.Errorf("expected %v for %v %v, got %v", tt.expected, tt.url, tt.accept, ct)
+		}
+	}
+}
+
+func TestNegotiateContentTypeInvalid(t *testing.T) {
+	r := httptest.NewRequest("GET", "/resolve?ct=text/html", nil)
+	if _, err := negotiateContentType(r, javascriptContentType); err != errCTInvalid {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
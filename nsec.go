@@ -0,0 +1,266 @@
+package reverseoperator
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// The functions here check proofs of nonexistence given by NSEC (RFC 4035)
+// and NSEC3 (RFC 5155) records. They check only what the records prove; the
+// records must already have been validated.
+
+// nsecTypes returns the types at name, from an NSEC or NSEC3 record which
+// matches it, if any.
+func nsecTypes(rrs []dns.RR, name string) (map[uint16]bool, bool) {
+	for _, rr := range rrs {
+		var bitmap []uint16
+		switch n := rr.(type) {
+		case *dns.NSEC:
+			if canonicalCompare(n.Hdr.Name, name) != 0 {
+				continue
+			}
+			bitmap = n.TypeBitMap
+		case *dns.NSEC3:
+			if !n.Match(name) {
+				continue
+			}
+			bitmap = n.TypeBitMap
+		default:
+			continue
+		}
+
+		types := make(map[uint16]bool)
+		for _, t := range bitmap {
+			types[t] = true
+		}
+		return types, true
+	}
+
+	return nil, false
+}
+
+// nxdomainProven returns whether the records prove that name doesn't exist:
+// that neither it, nor a wildcard which would match it, exists.
+func nxdomainProven(rrs []dns.RR, name string) bool {
+	if nsec := nsecCovering(rrs, name); nsec != nil {
+		ce := nsecClosestEncloser(nsec, name)
+		return nsecCovering(rrs, "*."+ce) != nil
+	}
+
+	ce, ok := nsec3ClosestEncloser(rrs, name)
+	if !ok {
+		return false
+	}
+	return nsec3Covering(rrs, wildcardName(ce)) != nil
+}
+
+// nodataProven returns whether the records prove that name has no records
+// of type qtype, or of type CNAME; whether it exists, is an empty
+// non-terminal, or is matched by a wildcard.
+func nodataProven(rrs []dns.RR, name string, qtype uint16) bool {
+	lacks := func(types map[uint16]bool) bool {
+		return !types[qtype] && !types[dns.TypeCNAME]
+	}
+	if types, ok := nsecTypes(rrs, name); ok {
+		return lacks(types)
+	}
+	if emptyNonTerminal(rrs, name) {
+		return true
+	}
+	if qtype == dns.TypeDS && optOut(rrs, name) {
+		return true
+	}
+
+	// the name may be matched by a wildcard without records of the type
+	if nsec := nsecCovering(rrs, name); nsec != nil {
+		types, ok := nsecTypes(rrs, "*."+nsecClosestEncloser(nsec, name))
+		return ok && lacks(types)
+	}
+	if ce, ok := nsec3ClosestEncloser(rrs, name); ok {
+		types, ok := nsecTypes(rrs, wildcardName(ce))
+		return ok && lacks(types)
+	}
+
+	return false
+}
+
+// nsecDenies returns whether the records prove that name, which was answered
+// by a wildcard whose owner has labels labels beside the "*", doesn't itself
+// exist.
+func nsecDenies(rrs []dns.RR, name string, labels int) bool {
+	if nsecCovering(rrs, name) != nil {
+		return true
+	}
+
+	// with NSEC3, the name one label below the wildcard's parent is covered
+	return nsec3Covering(rrs, ancestor(name, labels+1)) != nil
+}
+
+// emptyNonTerminal returns whether the records prove that name exists only
+// as the parent of other names, by an NSEC record which covers it and whose
+// next name is below it. With NSEC3, empty non-terminals have records of
+// their own, so are matched by nsecTypes.
+func emptyNonTerminal(rrs []dns.RR, name string) bool {
+	n := nsecCovering(rrs, name)
+	return n != nil && canonicalCompare(n.NextDomain, name) != 0 && dns.IsSubDomain(name, n.NextDomain)
+}
+
+// optOut returns whether name is covered by an NSEC3 record with the opt-out
+// flag, below a proven closest encloser; such a name may be an unsigned
+// delegation.
+func optOut(rrs []dns.RR, name string) bool {
+	ce, ok := nsec3ClosestEncloser(rrs, name)
+	if !ok {
+		return false
+	}
+	n := nsec3Covering(rrs, ancestor(name, dns.CountLabel(ce)+1))
+	return n != nil && n.Flags&1 == 1
+}
+
+// nsecCovering returns the NSEC record which covers name, if any: whose owner
+// precedes name, and whose next name follows it, in canonical order.
+func nsecCovering(rrs []dns.RR, name string) *dns.NSEC {
+	for _, rr := range rrs {
+		n, ok := rr.(*dns.NSEC)
+		if !ok {
+			continue
+		}
+		if canonicalCompare(n.Hdr.Name, name) >= 0 {
+			continue
+		}
+		// the last NSEC of a zone points back to its apex, and covers every
+		// name following it within the zone
+		if canonicalCompare(n.NextDomain, n.Hdr.Name) <= 0 {
+			if dns.IsSubDomain(n.NextDomain, name) {
+				return n
+			}
+			continue
+		}
+		if canonicalCompare(name, n.NextDomain) < 0 {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// nsecClosestEncloser returns the closest encloser of a name covered by an
+// NSEC record: the longest ancestor of the name which exists, being an
+// ancestor of the record's owner or next name.
+func nsecClosestEncloser(n *dns.NSEC, name string) string {
+	common := dns.CompareDomainName(name, n.Hdr.Name)
+	if c := dns.CompareDomainName(name, n.NextDomain); c > common {
+		common = c
+	}
+
+	return ancestor(name, common)
+}
+
+// nsec3Covering returns the NSEC3 record which covers name, if any; a record
+// matching name doesn't cover it, though NSEC3.Cover says it does.
+func nsec3Covering(rrs []dns.RR, name string) *dns.NSEC3 {
+	for _, rr := range rrs {
+		if n, ok := rr.(*dns.NSEC3); ok && n.Cover(name) && !n.Match(name) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// nsec3ClosestEncloser finds the closest encloser of a name which doesn't
+// exist, as proven by NSEC3 records: an ancestor which is matched by a
+// record, whose child towards the name is covered by another.
+func nsec3ClosestEncloser(rrs []dns.RR, name string) (string, bool) {
+	labels := dns.CountLabel(name)
+	for l := labels - 1; l >= 0; l-- {
+		ce := ancestor(name, l)
+		if _, ok := nsecTypes(rrs, ce); !ok {
+			continue
+		}
+		if nsec3Covering(rrs, ancestor(name, l+1)) == nil {
+			return "", false
+		}
+		return ce, true
+	}
+
+	return "", false
+}
+
+// ancestor returns the ancestor of name with the given number of labels.
+func ancestor(name string, labels int) string {
+	name = dns.Fqdn(name)
+	indexes := dns.Split(name)
+	if labels <= 0 {
+		return "."
+	}
+	if labels >= len(indexes) {
+		return name
+	}
+
+	return name[indexes[len(indexes)-labels]:]
+}
+
+func wildcardName(ce string) string {
+	if ce == "." {
+		return "*."
+	}
+	return "*." + ce
+}
+
+// canonicalCompare compares names in the canonical order of RFC 4034
+// section 6.1, returning -1, 0 or 1 as a sorts before, the same as, or after
+// b.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(labelOctets(la[len(la)-i]), labelOctets(lb[len(lb)-i])); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(la) < len(lb):
+		return -1
+	case len(la) > len(lb):
+		return 1
+	}
+	return 0
+}
+
+// labelOctets returns the octets of a label in presentation format, in which
+// they may be escaped as \X or \DDD.
+func labelOctets(label string) string {
+	if !strings.Contains(label, "\\") {
+		return label
+	}
+
+	var b []byte
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' || i+1 >= len(label) {
+			b = append(b, label[i])
+			continue
+		}
+		if i+3 < len(label) && isDigits(label[i+1:i+4]) {
+			n := int(label[i+1]-'0')*100 + int(label[i+2]-'0')*10 + int(label[i+3]-'0')
+			b = append(b, byte(n))
+			i += 3
+			continue
+		}
+		b = append(b, label[i+1])
+		i++
+	}
+
+	return string(b)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
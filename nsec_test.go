@@ -0,0 +1,200 @@
+package reverseoperator
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCanonicalCompare(t *testing.T) {
+	// the example ordering of RFC 4034 section 6.1
+	ordered := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		"\\001.z.example.",
+		"*.z.example.",
+		"\\200.z.example.",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			if c := canonicalCompare(ordered[i], ordered[j]); c != expected {
+				t.Errorf("%v, %v: expected %v, got %v", ordered[i], ordered[j], expected, c)
+			}
+		}
+	}
+}
+
+func testNSECs(t *testing.T, records ...string) []dns.RR {
+	var rrs []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("%v: %v", s, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func TestNSECProofs(t *testing.T) {
+	rrs := testNSECs(t,
+		"example. 300 IN NSEC a.example. SOA NS NSEC RRSIG",
+		"a.example. 300 IN NSEC x.y.example. A NSEC RRSIG",
+		"x.y.example. 300 IN NSEC example. A NSEC RRSIG",
+	)
+
+	for name, expected := range map[string]bool{
+		"b.example.":     true,
+		"zz.example.":    true,
+		"a.example.":     false,
+		"example.":       false,
+		"b.a.example.":   true,
+		"other.":         false,
+		"y.example.":     true,
+		"x.y.example.":   false,
+		"z.x.y.example.": true,
+	} {
+		if nsecCovering(rrs, name) != nil != expected {
+			t.Errorf("%v: expected covered %v", name, expected)
+		}
+	}
+
+	if !emptyNonTerminal(rrs, "y.example.") {
+		t.Error("expected y.example. to be an empty non-terminal")
+	}
+	if emptyNonTerminal(rrs, "b.example.") {
+		t.Error("expected b.example. not to be an empty non-terminal")
+	}
+	if !nodataProven(rrs, "a.example.", dns.TypeTXT) {
+		t.Error("expected a.example. to have no TXT records")
+	}
+	if nodataProven(rrs, "a.example.", dns.TypeA) {
+		t.Error("expected a.example. to have A records")
+	}
+
+	// the wildcard *.example. is covered by the first record only
+	if !nxdomainProven(rrs, "b.example.") {
+		t.Error("expected b.example. not to exist")
+	}
+	if nxdomainProven(rrs, "a.example.") {
+		t.Error("expected a.example. to exist")
+	}
+	if nxdomainProven(rrs[1:], "b.example.") {
+		t.Error("expected no proof without the wildcard covered")
+	}
+}
+
+// testNSEC3Chain builds an NSEC3 chain for the names of a zone, with the
+// types of each; names in optOut are left out of the chain, and the records
+// covering them are given the opt-out flag.
+func testNSEC3Chain(zone string, names map[string][]uint16, optOut ...string) []dns.RR {
+	type hashed struct {
+		hash  string
+		types []uint16
+	}
+	var chain []hashed
+	for name, types := range names {
+		chain = append(chain, hashed{dns.HashName(name, dns.SHA1, 0, ""), types})
+	}
+	sort.Slice(chain, func(i, j int) bool { return chain[i].hash < chain[j].hash })
+
+	var rrs []dns.RR
+	for i, h := range chain {
+		n := &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: h.hash + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			NextDomain: chain[(i+1)%len(chain)].hash,
+			TypeBitMap: h.types,
+		}
+		for _, name := range optOut {
+			if n.Cover(name) {
+				n.Flags = 1
+			}
+		}
+		rrs = append(rrs, n)
+	}
+
+	return rrs
+}
+
+func TestNSEC3Proofs(t *testing.T) {
+	rrs := testNSEC3Chain("example.", map[string][]uint16{
+		"example.":        {dns.TypeNS, dns.TypeSOA},
+		"a.example.":      {dns.TypeA},
+		"*.w.example.":    {dns.TypeA},
+		"w.example.":      {},
+		"sub.example.":    {dns.TypeNS, dns.TypeDS},
+		"b.a.example.":    {dns.TypeTXT},
+		"ns.sub.example.": {dns.TypeA},
+	}, "unsigned.example.")
+
+	if types, ok := nsecTypes(rrs, "a.example."); !ok || !types[dns.TypeA] {
+		t.Errorf("expected a.example. to be matched with its types, got %v", types)
+	}
+	if !nodataProven(rrs, "a.example.", dns.TypeAAAA) {
+		t.Error("expected a.example. to have no AAAA records")
+	}
+	if !nodataProven(rrs, "w.example.", dns.TypeA) {
+		t.Error("expected the empty non-terminal w.example. to have no A records")
+	}
+	if nodataProven(rrs, "x.w.example.", dns.TypeA) {
+		t.Error("expected x.w.example. to have A records by its wildcard")
+	}
+	if !nodataProven(rrs, "x.w.example.", dns.TypeTXT) {
+		t.Error("expected x.w.example. to have no TXT records by its wildcard")
+	}
+
+	if !nxdomainProven(rrs, "nope.example.") {
+		t.Error("expected nope.example. not to exist")
+	}
+	if !nxdomainProven(rrs, "c.b.a.example.") {
+		t.Error("expected c.b.a.example. not to exist")
+	}
+	if nxdomainProven(rrs, "a.example.") {
+		t.Error("expected a.example. to exist")
+	}
+	if nxdomainProven(rrs, "x.w.example.") {
+		t.Error("expected x.w.example. to be matched by its wildcard")
+	}
+
+	if !nsecDenies(rrs, "x.w.example.", 2) {
+		t.Error("expected x.w.example. to be proven not to exist for its wildcard answer")
+	}
+	if nsecDenies(rrs, "a.example.", 1) {
+		t.Error("expected a.example. not to be denied")
+	}
+
+	if !optOut(rrs, "unsigned.example.") {
+		t.Error("expected unsigned.example. to be covered by an opt-out record")
+	}
+}
+
+func TestAncestor(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		labels   int
+		expected string
+	}{
+		{"a.b.example.", 0, "."},
+		{"a.b.example.", 1, "example."},
+		{"a.b.example.", 2, "b.example."},
+		{"a.b.example.", 3, "a.b.example."},
+		{"a.b.example.", 4, "a.b.example."},
+		{"a.b.example", 2, "b.example."},
+	} {
+		if a := ancestor(c.name, c.labels); a != c.expected {
+			t.Errorf("%v, %v: expected %v, got %v", c.name, c.labels, c.expected, a)
+		}
+	}
+}
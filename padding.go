@@ -0,0 +1,107 @@
+package reverseoperator
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// DefaultPaddingBlockSize is the block size responses are padded to, as
+// recommended for responses by RFC 8467.
+const DefaultPaddingBlockSize = 468
+
+var paddingLetters = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-._~")
+
+// paddedGDNSResponse is a GDNSResponse with padding, named to match the
+// parameter secureoperator clients use to pad their requests.
+type paddedGDNSResponse struct {
+	*secop.GDNSResponse
+	Padding string `json:"random_padding"`
+}
+
+// padGDNS pads a JSON response so that its encoding, including the newline
+// appended by json.Encoder, is a multiple of the block size.
+func padGDNS(g *secop.GDNSResponse, block int) (*paddedGDNSResponse, error) {
+	p := &paddedGDNSResponse{GDNSResponse: g}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Padding = randomPadding(paddingLength(len(b)+1, block))
+	return p, nil
+}
+
+// requestsPadding reports whether a query asked for its response to be
+// padded; per RFC 7830, responses are only padded if the query was.
+func requestsPadding(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_PADDING); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestsGDNSPadding reports whether a JSON API request asked for its
+// response to be padded, by padding itself with the random_padding
+// parameter; as with wire-format queries, responses are only padded if the
+// request was, so that clients which don't expect the field never see it.
+func requestsGDNSPadding(r *http.Request) bool {
+	_, ok := r.URL.Query()["random_padding"]
+	return ok
+}
+
+// padDNSMsg adds an EDNS0 padding option to a message, sized so that the
+// packed message is a multiple of the block size. The message must already
+// carry an OPT record, and any existing padding option is replaced.
+func padDNSMsg(m *dns.Msg, block int) error {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	var options []dns.EDNS0
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_PADDING); !ok {
+			options = append(options, o)
+		}
+	}
+	pad := &dns.EDNS0_PADDING{}
+	opt.Option = append(options, pad)
+
+	// the option code and length take four bytes, even when empty
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+
+	pad.Padding = make([]byte, paddingLength(len(b), block))
+	return nil
+}
+
+func paddingLength(l, block int) int {
+	if block <= 0 {
+		return 0
+	}
+	return (block - l%block) % block
+}
+
+func randomPadding(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = paddingLetters[rand.Intn(len(paddingLetters))]
+	}
+	return string(b)
+}
@@ -0,0 +1,92 @@
+package reverseoperator
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+func TestPadGDNS(t *testing.T) {
+	for _, name := range []string{"a.com", "a-much-longer-name.example.com"} {
+		g := &secop.GDNSResponse{
+			Question: secop.GDNSQuestions{secop.GDNSQuestion{Name: name, Type: 1}},
+		}
+
+		p, err := padGDNS(g, 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(p); err != nil {
+			t.Fatal(err)
+		}
+		if l := b.Len(); l%128 != 0 {
+			t.Errorf("expected padded length for %v, got %v", name, l)
+		}
+
+		// padding mustn't disturb the fields of the response itself
+		var body secop.GDNSResponse
+		if err := json.Unmarshal(b.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if n := body.Question[0].Name; n != name {
+			t.Errorf("unexpected question name %v", n)
+		}
+	}
+}
+
+func TestPadDNSMsg(t *testing.T) {
+	for _, name := range []string{"a.com.", "a-much-longer-name.example.com."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.SetEdns0(ednsUDPSize, false)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 7)})
+
+		if err := padDNSMsg(m, 468); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l := len(b); l != 468 {
+			t.Errorf("expected padded length for %v, got %v", name, l)
+		}
+
+		var pads int
+		for _, o := range m.IsEdns0().Option {
+			if _, ok := o.(*dns.EDNS0_PADDING); ok {
+				pads++
+			}
+		}
+		if pads != 1 {
+			t.Errorf("expected exactly one padding option, got %v", pads)
+		}
+	}
+}
+
+func TestRequestsPadding(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	if requestsPadding(m) {
+		t.Error("unexpected padding request without EDNS0")
+	}
+
+	m.SetEdns0(ednsUDPSize, false)
+	if requestsPadding(m) {
+		t.Error("unexpected padding request without padding option")
+	}
+
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{})
+	if !requestsPadding(m) {
+		t.Error("expected padding request")
+	}
+}
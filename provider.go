@@ -0,0 +1,145 @@
+package reverseoperator
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// Question is a DNS question, along with the flags from the client's request
+// which alter how it should be resolved.
+type Question struct {
+	secop.DNSQuestion
+	// CheckingDisabled asks that DNSSEC validation not be performed
+	CheckingDisabled bool
+	// DNSSECOK asks that DNSSEC records (RRSIG, NSEC, etc.) be returned
+	DNSSECOK bool
+	// ClientSubnet is the EDNS client subnet to send upstream, if any; a
+	// zero-length prefix asks the upstream not to use the client's address
+	ClientSubnet *net.IPNet
+}
+
+// Response is a secop.DNSResponse, along with the details of the resolution
+// which it has no room for.
+type Response struct {
+	secop.DNSResponse
+	// ClientSubnet is the EDNS client subnet the answer is valid for, if the
+	// upstream supports it; its mask is the scope returned by the upstream
+	ClientSubnet *net.IPNet
+	// Authoritative is set when the answer comes from the authority for the
+	// name, such as a local zone
+	Authoritative bool
+	// Comment explains the response, such as why a name was blocked; it is
+	// only returned to clients of the JSON API
+	Comment string
+}
+
+// questionKey identifies a question, along with everything about it which
+// may change the response, such that responses may be shared between
+// questions with equal keys.
+type questionKey struct {
+	name  string
+	qtype uint16
+	// questions are always of class IN, but keep the class in the key so
+	// that it's never ambiguous
+	qclass           uint16
+	dnssecOK         bool
+	checkingDisabled bool
+	clientSubnet     string
+}
+
+func newQuestionKey(q Question) questionKey {
+	k := questionKey{
+		name:             strings.ToLower(dns.Fqdn(q.Name)),
+		qtype:            q.Type,
+		qclass:           dns.ClassINET,
+		dnssecOK:         q.DNSSECOK,
+		checkingDisabled: q.CheckingDisabled,
+	}
+	// answers may be tailored to the client's subnet, so they can only be
+	// shared between clients in the same one
+	if q.ClientSubnet != nil {
+		k.clientSubnet = clientSubnetString(q.ClientSubnet)
+	}
+
+	return k
+}
+
+// Resolver is a servicer of DNS queries which, unlike secop.Provider,
+// receives the full Question rather than only its name and type, and stops
+// resolving once its context is done. Responses may be shared between
+// callers, so must not be modified.
+type Resolver interface {
+	Resolve(context.Context, Question) (*Response, error)
+}
+
+// NewProviderResolver adapts a secop.Provider to a Resolver. If the provider
+// already implements Resolver it is returned as-is; otherwise the flags of
+// each Question are discarded before it is passed to the provider. As
+// secop.Provider takes no context, a query can't be cancelled, but is
+// abandoned once the context is done.
+func NewProviderResolver(provider secop.Provider) Resolver {
+	if p, ok := provider.(*resolverProvider); ok {
+		return p.resolver
+	}
+	if r, ok := provider.(Resolver); ok {
+		return r
+	}
+
+	return &providerResolver{provider: provider}
+}
+
+type providerResolver struct {
+	provider secop.Provider
+}
+
+func (p *providerResolver) Resolve(ctx context.Context, q Question) (*Response, error) {
+	type result struct {
+		resp *secop.DNSResponse
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := p.provider.Query(q.DNSQuestion)
+		results <- result{resp, err}
+	}()
+
+	select {
+	case r := <-results:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &Response{DNSResponse: *r.resp}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// NewResolverProvider adapts a Resolver to a secop.Provider, such as for
+// NewHandler. Each question is resolved without flags or a deadline; but
+// NewProviderResolver unwraps the Resolver again, so that those which pass
+// the full Question keep its flags.
+func NewResolverProvider(resolver Resolver) secop.Provider {
+	if p, ok := resolver.(*providerResolver); ok {
+		return p.provider
+	}
+
+	return &resolverProvider{resolver: resolver}
+}
+
+type resolverProvider struct {
+	resolver Resolver
+}
+
+func (p *resolverProvider) Query(q secop.DNSQuestion) (*secop.DNSResponse, error) {
+	resp, err := p.resolver.Resolve(context.Background(), Question{DNSQuestion: q})
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp.DNSResponse, nil
+}
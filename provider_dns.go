@@ -1,47 +1,594 @@
 package reverseoperator
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	secop "github.com/fardog/secureoperator"
+	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// exchange is locally set to allow its mocking during testing
+var exchange = func(ctx context.Context, m *dns.Msg, network, address string) (*dns.Msg, error) {
+	d := &net.Dialer{}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	co := &dns.Conn{Conn: conn}
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	}
+	defer co.Close()
+
+	// dns.Client takes no context, so the exchange is done here, and
+	// interrupted by closing the connection once the context is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			co.Close()
+		case <-done:
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		co.SetDeadline(deadline)
+	}
+
+	if err := co.WriteMsg(m); err != nil {
+		return nil, exchangeErr(ctx, err)
+	}
+	r, err := co.ReadMsg()
+	// a truncated response is reported as an error, though the message is
+	// still usable; the caller decides what to do with it
+	if err != nil && !(err == dns.ErrTruncated && r != nil) {
+		return nil, exchangeErr(ctx, err)
+	}
+	if r.Id != m.Id {
+		return nil, dns.ErrId
+	}
+
+	return r, nil
+}
+
+// exchangeErr returns the context's error in place of err if the context is
+// done, as closing the connection will have caused it.
+func exchangeErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+const (
+	// DefaultRetries is the number of other servers a failed query is
+	// retried on when no other number is configured.
+	DefaultRetries = 1
+	// DefaultTimeout is how long a server is given to respond to a query
+	// when no other timeout is configured.
+	DefaultTimeout = 2 * time.Second
+	// DefaultDeadline is how long a query may take in all, across every
+	// server it is sent to, when no other deadline is configured.
+	DefaultDeadline = 5 * time.Second
 )
 
-var exchange = dns.Exchange
+// ednsUDPSize is the buffer size advertised to upstream servers whenever EDNS0
+// is required, such as when DNSSEC records are requested
+const ednsUDPSize = 4096
+
+// DNSProviderOptions is a configuration object for optional DNSProvider
+// configuration
+type DNSProviderOptions struct {
+	// TCPOnly sends every query over TCP; otherwise queries are sent over UDP,
+	// and retried over TCP if the response was truncated.
+	TCPOnly bool
+	// TLS, if set, sends every query over DNS-over-TLS instead, using a
+	// persistent connection to each server.
+	TLS *DNSTLSOptions
+	// Health configures how failing servers are detected and ejected; if
+	// nil, defaults are used, and no probes are sent.
+	Health *HealthOptions
+	// Retries is the number of other servers a query is retried on when a
+	// server fails to answer it, or answers with SERVFAIL or REFUSED; if
+	// zero, DefaultRetries is used, and if negative, queries aren't retried.
+	Retries int
+	// Strategy is how a server is chosen for each query; by default, it is
+	// chosen at random.
+	Strategy Strategy
+	// Weights holds the weight of each server for StrategyWeighted, keyed by
+	// its endpoint in `ip:port` form; servers without one have a weight of 1.
+	Weights map[string]int
+	// Race is the number of servers each query is sent to at once; the first
+	// useful response wins, and the queries to the rest are cancelled. If
+	// less than 2, queries are sent to one server at a time.
+	Race int
+	// HedgeDelay, if set, sends a query to another server when no useful
+	// response has arrived within the delay, in addition to those already
+	// sent; the first useful response wins.
+	HedgeDelay time.Duration
+	// Timeout is how long a server is given to respond to a query before it
+	// is considered failed; if zero, DefaultTimeout is used.
+	Timeout time.Duration
+	// Deadline is how long a query may take in all, including retries; if
+	// zero, DefaultDeadline is used. The caller's context may end it sooner.
+	Deadline time.Duration
+	// DNSSEC, if set, validates responses from the servers rather than
+	// trusting their AD bit: secure responses have the AD bit set, and bogus
+	// ones are answered with SERVFAIL, unless checking was disabled.
+	DNSSEC *DNSSECOptions
+}
+
+// NewDNSProvider creates a DNSProvider, which queries the given servers
+func NewDNSProvider(servers secop.Endpoints, opts *DNSProviderOptions) (*DNSProvider, error) {
+	if len(servers) < 1 {
+		return nil, fmt.Errorf("at least one endpoint server is required")
+	}
+	if opts == nil {
+		opts = &DNSProviderOptions{}
+	}
+
+	c := &DNSProvider{
+		servers:   servers,
+		opts:      opts,
+		upstreams: newUpstreams(servers),
+		health:    opts.Health,
+		stop:      make(chan struct{}),
+	}
+	if c.health == nil {
+		c.health = &HealthOptions{}
+	}
+	if opts.TLS != nil {
+		c.tls = newTLSPool(opts.TLS, c.timeout())
+	}
+	if opts.DNSSEC != nil {
+		v, err := newValidator(opts.DNSSEC, c.validationQuery)
+		if err != nil {
+			return nil, err
+		}
+		c.validator = v
+	}
+	if c.health.ProbeInterval > 0 {
+		c.probes.Add(1)
+		go c.probe(c.stop)
+	}
 
-func NewDNSProvider(servers secop.Endpoints) (*DNSProvider, error) {
-	return &DNSProvider{
-		servers: servers,
-	}, nil
+	return c, nil
 }
 
+// DNSProvider resolves questions against plain DNS servers; it implements
+// both Resolver and secop.Provider.
 type DNSProvider struct {
-	servers secop.Endpoints
+	// counters are accessed atomically, so are kept first for alignment
+	queries   uint64
+	coalesced uint64
+	retried   uint64
+	hedged    uint64
+	// next is the round-robin position
+	next uint64
+
+	servers   secop.Endpoints
+	opts      *DNSProviderOptions
+	flights   flightGroup
+	tls       *tlsPool
+	upstreams []*upstream
+	health    *HealthOptions
+	validator *validator
+
+	// probes tracks the health probe loop, which runs until stop is closed
+	probes    sync.WaitGroup
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// DNSProviderStats are counters describing the queries a DNSProvider has
+// serviced.
+type DNSProviderStats struct {
+	// Queries is the number of questions asked of the provider
+	Queries uint64
+	// Coalesced is the number of those questions which were answered by an
+	// identical upstream query already in flight, rather than their own
+	Coalesced uint64
+	// Retried is the number of queries retried on another server after a
+	// server failed
+	Retried uint64
+	// Hedged is the number of queries sent to another server because the
+	// first was slow to respond
+	Hedged uint64
+	// Unhealthy lists the servers currently ejected for failing
+	Unhealthy []string
+	// Latency is the moving average response time of each server which has
+	// responded, keyed by its endpoint
+	Latency map[string]time.Duration
+}
+
+// Stats returns the provider's counters.
+func (c *DNSProvider) Stats() DNSProviderStats {
+	return DNSProviderStats{
+		Queries:   atomic.LoadUint64(&c.queries),
+		Coalesced: atomic.LoadUint64(&c.coalesced),
+		Retried:   atomic.LoadUint64(&c.retried),
+		Hedged:    atomic.LoadUint64(&c.hedged),
+		Unhealthy: c.unhealthy(),
+		Latency:   c.latencies(),
+	}
+}
+
+func (c *DNSProvider) latencies() map[string]time.Duration {
+	l := make(map[string]time.Duration)
+	for _, u := range c.upstreams {
+		if rtt := u.latency(); rtt > 0 {
+			l[u.address] = rtt
+		}
+	}
+
+	return l
+}
+
+func (c *DNSProvider) unhealthy() []string {
+	var servers []string
+	t := now()
+	for _, u := range c.upstreams {
+		if !u.healthy(t) {
+			servers = append(servers, u.address)
+		}
+	}
+
+	return servers
 }
 
+// Close stops the provider's health probes, if any.
+func (c *DNSProvider) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+	c.probes.Wait()
+
+	return nil
+}
+
+// Query resolves a question against one of the provider's servers; it
+// implements secop.Provider.
 func (c *DNSProvider) Query(q secop.DNSQuestion) (*secop.DNSResponse, error) {
-	// we need to look it up
-	server := c.servers.Random()
-	msg := dns.Msg{}
-	msg.SetQuestion(dns.Fqdn(q.Name), q.Type)
+	resp, err := c.Resolve(context.Background(), Question{DNSQuestion: q})
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp.DNSResponse, nil
+}
+
+// Resolve resolves a question against one of the provider's servers, passing
+// the question's flags along to the server; it implements Resolver. If an
+// identical question is already being resolved, its response is shared
+// rather than querying the server again. Once the context is done, the
+// caller stops waiting, and the upstream queries are cancelled unless other
+// callers are waiting on them.
+func (c *DNSProvider) Resolve(ctx context.Context, q Question) (*Response, error) {
+	atomic.AddUint64(&c.queries, 1)
+
+	resp, err, shared := c.flights.do(ctx, newQuestionKey(q), func(ctx context.Context) (*Response, error) {
+		return c.resolve(ctx, q)
+	})
+	if shared {
+		atomic.AddUint64(&c.coalesced, 1)
+	}
+
+	return resp, err
+}
+
+// resolve resolves a question against the provider's servers, validating the
+// response if so configured.
+func (c *DNSProvider) resolve(ctx context.Context, q Question) (*Response, error) {
+	deadline := c.opts.Deadline
+	if deadline <= 0 {
+		deadline = DefaultDeadline
+	}
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	// once resolved, the queries still in flight are abandoned
+	defer cancel()
+
+	msg := questionToMsg(q)
+	if c.validator != nil {
+		// signatures are needed to validate, and bogus data is needed to
+		// know that it is bogus
+		setDNSSECOK(msg)
+		msg.CheckingDisabled = true
+	}
 
-	r, err := exchange(&msg, server.String())
+	r, err := c.query(ctx, q, msg)
 	if err != nil {
 		return nil, err
 	}
+	if c.validator != nil && isUsefulResponse(r) {
+		c.validate(ctx, q, r)
+	}
+
+	return msgToResponse(q, r), nil
+}
+
+// validate validates a response to a question, setting its AD bit if it is
+// secure, or replacing it with SERVFAIL if it is bogus and the question
+// didn't disable checking. DNSSEC records are then removed if the question
+// didn't ask for them.
+func (c *DNSProvider) validate(ctx context.Context, q Question, r *dns.Msg) {
+	s, reason := c.validator.validate(ctx, q, r)
+	r.AuthenticatedData = s == secure
+	r.CheckingDisabled = q.CheckingDisabled
+	if s == bogus {
+		log.Warnf("response for %v[%v] is bogus: %v", q.Name, q.Type, reason)
+		if !q.CheckingDisabled {
+			r.Rcode = dns.RcodeServerFailure
+			r.Answer, r.Ns, r.Extra = nil, nil, nil
+		}
+	}
+
+	if !q.DNSSECOK {
+		stripDNSSEC(r, q.Type)
+	}
+}
+
+// validationQuery fetches the records the validator needs from the servers,
+// with their signatures, and without their servers validating them.
+func (c *DNSProvider) validationQuery(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	q := Question{
+		DNSQuestion:      secop.DNSQuestion{Name: name, Type: qtype},
+		CheckingDisabled: true,
+		DNSSECOK:         true,
+	}
+	r, err := c.query(ctx, q, questionToMsg(q))
+	if err != nil {
+		return nil, err
+	}
+	if !isUsefulResponse(r) {
+		return nil, fmt.Errorf("upstream responded %v", dns.RcodeToString[r.Rcode])
+	}
+
+	return r, nil
+}
+
+// query sends a message to healthy servers; a server which fails is replaced
+// by another, and if so configured, the message is raced or hedged across
+// several servers.
+func (c *DNSProvider) query(ctx context.Context, q Question, msg *dns.Msg) (*dns.Msg, error) {
+	retries := c.opts.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	race := c.opts.Race
+	if race < 1 {
+		race = 1
+	}
+	limit := race + retries
+	if c.opts.HedgeDelay > 0 {
+		limit++
+	}
+
+	var (
+		tried    = make(map[*upstream]bool)
+		results  = make(chan attemptResult, len(c.upstreams))
+		inflight int
+	)
+	send := func() bool {
+		if len(tried) >= limit || len(tried) >= len(c.upstreams) {
+			return false
+		}
+
+		u := c.pick(tried)
+		tried[u] = true
+		inflight++
+		go func() {
+			results <- c.attempt(ctx, q, msg, u)
+		}()
+		return true
+	}
+
+	for i := 0; i < race; i++ {
+		send()
+	}
+
+	var hedge <-chan time.Time
+	if c.opts.HedgeDelay > 0 {
+		t := time.NewTimer(c.opts.HedgeDelay)
+		defer t.Stop()
+		hedge = t.C
+	}
+
+	var (
+		failed *dns.Msg
+		err    error
+	)
+	for inflight > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-hedge:
+			hedge = nil
+			if send() {
+				atomic.AddUint64(&c.hedged, 1)
+			}
+			continue
+		case res := <-results:
+			inflight--
+			if res.err != nil {
+				err = res.err
+			} else if isUsefulResponse(res.r) {
+				return res.r, nil
+			} else {
+				// the server is answering, but another may have a better
+				// answer; SERVFAIL and REFUSED never win while one might
+				failed = res.r
+			}
+		}
+
+		if send() {
+			atomic.AddUint64(&c.retried, 1)
+		}
+	}
+
+	// a server's failed response is preferred over an error
+	if failed != nil {
+		return failed, nil
+	}
+
+	return nil, err
+}
+
+type attemptResult struct {
+	r   *dns.Msg
+	err error
+}
+
+// attempt sends a query to a server, recording its health and response time.
+func (c *DNSProvider) attempt(ctx context.Context, q Question, msg *dns.Msg, u *upstream) attemptResult {
+	actx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+
+	start := now()
+	r, err := c.exchange(actx, msg.Copy(), u.address)
+	if err != nil {
+		// a query cancelled because another server answered first says
+		// nothing of this one's health
+		if ctx.Err() == nil {
+			log.Warnf("upstream %v failed for %v[%v]: %v", u.address, q.Name, q.Type, err)
+			u.failure(c.health)
+		}
+		return attemptResult{err: err}
+	}
+	u.observe(now().Sub(start))
+	u.success()
+
+	if !isUsefulResponse(r) {
+		log.Debugf("upstream %v responded %v for %v[%v]", u.address, dns.RcodeToString[r.Rcode], q.Name, q.Type)
+	}
+
+	return attemptResult{r: r}
+}
+
+// timeout is how long a server is given to respond to a query.
+func (c *DNSProvider) timeout() time.Duration {
+	if c.opts.Timeout > 0 {
+		return c.opts.Timeout
+	}
+	return DefaultTimeout
+}
+
+// isUsefulResponse reports whether a response answers the question, rather
+// than reporting the server couldn't or wouldn't.
+func isUsefulResponse(r *dns.Msg) bool {
+	return r.Rcode != dns.RcodeServerFailure && r.Rcode != dns.RcodeRefused
+}
+
+// pick chooses a server which hasn't yet been tried for a query, from those
+// which are healthy, according to the provider's strategy; if every untried
+// server is unhealthy, one of those is chosen rather than failing outright.
+func (c *DNSProvider) pick(tried map[*upstream]bool) *upstream {
+	var healthy, untried []*upstream
+	t := now()
+	for _, u := range c.upstreams {
+		if tried[u] {
+			continue
+		}
+		untried = append(untried, u)
+		if u.healthy(t) {
+			healthy = append(healthy, u)
+		}
+	}
+
+	if len(healthy) > 0 {
+		return c.choose(healthy)
+	}
+	return c.choose(untried)
+}
+
+// exchange sends a message to a server over UDP, falling back to TCP if the
+// response was truncated, or over TCP or TLS only if so configured.
+func (c *DNSProvider) exchange(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, error) {
+	if c.tls != nil {
+		return c.tls.exchange(ctx, m, address)
+	}
+	if c.opts.TCPOnly {
+		return exchange(ctx, m, "tcp", address)
+	}
+
+	r, err := exchange(ctx, m, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if !r.Truncated {
+		return r, nil
+	}
+
+	log.Debugf("response for %v was truncated, retrying over tcp", m.Question[0].Name)
+	return exchange(ctx, m, "tcp", address)
+}
+
+// questionToMsg builds the upstream query for a question.
+func questionToMsg(q Question) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(q.Name), q.Type)
+	msg.CheckingDisabled = q.CheckingDisabled
+	if q.DNSSECOK || q.ClientSubnet != nil {
+		msg.SetEdns0(ednsUDPSize, q.DNSSECOK)
+	}
+	if q.ClientSubnet != nil {
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, clientSubnetToOption(q.ClientSubnet))
+	}
+
+	return msg
+}
+
+// setDNSSECOK sets the DO bit of a message, adding an OPT record if needed.
+func setDNSSECOK(m *dns.Msg) {
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+		return
+	}
+	m.SetEdns0(ednsUDPSize, true)
+}
+
+// msgToResponse converts an upstream's reply to a question into a Response.
+func msgToResponse(q Question, r *dns.Msg) *Response {
+	resp := &Response{
+		DNSResponse: secop.DNSResponse{
+			Truncated:          r.MsgHdr.Truncated,
+			RecursionDesired:   r.MsgHdr.RecursionDesired,
+			RecursionAvailable: r.MsgHdr.RecursionAvailable,
+			AuthenticatedData:  r.MsgHdr.AuthenticatedData,
+			CheckingDisabled:   r.MsgHdr.CheckingDisabled || q.CheckingDisabled,
+			ResponseCode:       r.MsgHdr.Rcode,
+			Question:           questionToDNSQuestion(r.Question),
+			Answer:             rrToDNSRR(r.Answer),
+			Authority:          rrToDNSRR(r.Ns),
+			Extra:              rrToDNSRR(r.Extra),
+		},
+		Authoritative: r.MsgHdr.Authoritative,
+	}
+
+	// the upstream tells us which portion of the subnet its answer applies
+	// to; we only trust it if we asked
+	if q.ClientSubnet != nil {
+		if e := clientSubnetOption(r.IsEdns0()); e != nil {
+			n, err := optionToClientSubnet(e, e.SourceScope)
+			if err != nil {
+				log.Debugf("ignoring client subnet of response for %v: %v", q.Name, err)
+			}
+			resp.ClientSubnet = n
+		}
+	}
 
-	return &secop.DNSResponse{
-		Truncated:          r.MsgHdr.Truncated,
-		RecursionDesired:   r.MsgHdr.RecursionDesired,
-		RecursionAvailable: r.MsgHdr.RecursionAvailable,
-		AuthenticatedData:  r.MsgHdr.AuthenticatedData,
-		CheckingDisabled:   r.MsgHdr.CheckingDisabled,
-		ResponseCode:       r.MsgHdr.Rcode,
-		Question:           questionToDNSQuestion(r.Question),
-		Answer:             rrToDNSRR(r.Answer),
-		Authority:          rrToDNSRR(r.Ns),
-		Extra:              rrToDNSRR(r.Extra),
-	}, nil
+	return resp
 }
 
 func questionToDNSQuestion(qs []dns.Question) []secop.DNSQuestion {
@@ -59,6 +606,11 @@ func questionToDNSQuestion(qs []dns.Question) []secop.DNSQuestion {
 func rrToDNSRR(rrs []dns.RR) []secop.DNSRR {
 	var drs []secop.DNSRR
 	for _, rr := range rrs {
+		// the OPT pseudo-record describes the message, not the answer, and
+		// has no presentation format that could be parsed back
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
 		drs = append(drs, secop.DNSRR{
 			Name: rr.Header().Name,
 			Type: rr.Header().Rrtype,
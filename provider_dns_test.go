@@ -0,0 +1,264 @@
+package reverseoperator
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+func mockExchange(answer func(*dns.Msg) *dns.Msg) func() {
+	return mockExchangeNet(func(m *dns.Msg, network string) *dns.Msg {
+		return answer(m)
+	})
+}
+
+func mockExchangeNet(answer func(*dns.Msg, string) *dns.Msg) func() {
+	orig := exchange
+	exchange = func(ctx context.Context, m *dns.Msg, network, a string) (*dns.Msg, error) {
+		return answer(m, network), nil
+	}
+
+	return func() {
+		exchange = orig
+	}
+}
+
+func TestDNSProviderResolveFlags(t *testing.T) {
+	var sent *dns.Msg
+	defer mockExchange(func(m *dns.Msg) *dns.Msg {
+		sent = m
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.SetEdns0(ednsUDPSize, true)
+		return r
+	})()
+
+	p, err := NewDNSProvider(secop.Endpoints{secop.Endpoint{Port: 53}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := p.Resolve(context.Background(), Question{
+		DNSQuestion:      secop.DNSQuestion{Name: "example.com", Type: dns.TypeA},
+		CheckingDisabled: true,
+		DNSSECOK:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sent.CheckingDisabled {
+		t.Error("expected CD to be sent upstream")
+	}
+	if opt := sent.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("expected DO to be sent upstream")
+	}
+	if !resp.CheckingDisabled {
+		t.Error("expected CD in response")
+	}
+	if l := len(resp.Extra); l != 0 {
+		t.Errorf("expected OPT record to be omitted, got %v extra records", l)
+	}
+}
+
+func TestDNSProviderQueryNoFlags(t *testing.T) {
+	var sent *dns.Msg
+	defer mockExchange(func(m *dns.Msg) *dns.Msg {
+		sent = m
+		r := new(dns.Msg)
+		r.SetReply(m)
+		return r
+	})()
+
+	p, err := NewDNSProvider(secop.Endpoints{secop.Endpoint{Port: 53}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent.CheckingDisabled {
+		t.Error("unexpected CD sent upstream")
+	}
+	if opt := sent.IsEdns0(); opt != nil {
+		t.Error("unexpected EDNS0 sent upstream")
+	}
+}
+
+func TestDNSProviderResolveClientSubnet(t *testing.T) {
+	var sent *dns.Msg
+	defer mockExchange(func(m *dns.Msg) *dns.Msg {
+		sent = m
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.SetEdns0(ednsUDPSize, false)
+		e := *clientSubnetOption(m.IsEdns0())
+		e.SourceScope = 16
+		r.IsEdns0().Option = append(r.IsEdns0().Option, &e)
+		return r
+	})()
+
+	p, err := NewDNSProvider(secop.Endpoints{secop.Endpoint{Port: 53}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecs, err := parseClientSubnet("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := p.Resolve(context.Background(), Question{
+		DNSQuestion:  secop.DNSQuestion{Name: "example.com", Type: dns.TypeA},
+		ClientSubnet: ecs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := clientSubnetOption(sent.IsEdns0())
+	if e == nil {
+		t.Fatal("expected client subnet to be sent upstream")
+	}
+	if e.Family != 1 || e.SourceNetmask != 24 || !e.Address.Equal(ecs.IP) {
+		t.Errorf("unexpected client subnet sent upstream: %v", e)
+	}
+	if opt := sent.IsEdns0(); opt.Do() {
+		t.Error("unexpected DO sent upstream")
+	}
+
+	if resp.ClientSubnet == nil {
+		t.Fatal("expected client subnet in response")
+	}
+	if s := clientSubnetString(resp.ClientSubnet); s != "192.0.2.0/16" {
+		t.Errorf("unexpected client subnet in response: %v", s)
+	}
+}
+
+func TestDNSProviderTCPFallback(t *testing.T) {
+	var networks []string
+	defer mockExchangeNet(func(m *dns.Msg, network string) *dns.Msg {
+		networks = append(networks, network)
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Truncated = network == "udp"
+		return r
+	})()
+
+	p, err := NewDNSProvider(secop.Endpoints{secop.Endpoint{Port: 53}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := p.Resolve(context.Background(), question("example.com", dns.TypeTXT))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Truncated {
+		t.Error("expected complete response")
+	}
+	if len(networks) != 2 || networks[0] != "udp" || networks[1] != "tcp" {
+		t.Errorf("unexpected exchanges %v", networks)
+	}
+}
+
+func TestDNSProviderTCPOnly(t *testing.T) {
+	var networks []string
+	defer mockExchangeNet(func(m *dns.Msg, network string) *dns.Msg {
+		networks = append(networks, network)
+		r := new(dns.Msg)
+		r.SetReply(m)
+		return r
+	})()
+
+	p, err := NewDNSProvider(secop.Endpoints{secop.Endpoint{Port: 53}}, &DNSProviderOptions{
+		TCPOnly: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Resolve(context.Background(), question("example.com", dns.TypeTXT)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(networks) != 1 || networks[0] != "tcp" {
+		t.Errorf("unexpected exchanges %v", networks)
+	}
+}
+
+func TestNewDNSProviderNoServers(t *testing.T) {
+	if _, err := NewDNSProvider(secop.Endpoints{}, nil); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// startTestServer starts a DNS server on the loopback address, listening on
+// both UDP and TCP on the same port, and returns its endpoint.
+func startTestServer(t *testing.T, handler dns.HandlerFunc) (secop.Endpoint, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	pc, err := net.ListenPacket("udp", addr.String())
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+
+	tcp := &dns.Server{Listener: l, Handler: handler}
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	go tcp.ActivateAndServe()
+	go udp.ActivateAndServe()
+
+	return secop.Endpoint{IP: addr.IP, Port: uint16(addr.Port)}, func() {
+		tcp.Shutdown()
+		udp.Shutdown()
+	}
+}
+
+func TestDNSProviderTCPFallbackServer(t *testing.T) {
+	txt := strings.Repeat("a", 200)
+	ep, shutdown := startTestServer(t, func(w dns.ResponseWriter, m *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		for i := 0; i < 10; i++ {
+			r.Answer = append(r.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{txt},
+			})
+		}
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			r.Answer = nil
+			r.Truncated = true
+		}
+		w.WriteMsg(r)
+	})
+	defer shutdown()
+
+	p, err := NewDNSProvider(secop.Endpoints{ep}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := p.Resolve(context.Background(), question("example.com", dns.TypeTXT))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Truncated {
+		t.Error("expected complete response")
+	}
+	if l := len(resp.Answer); l != 10 {
+		t.Errorf("expected 10 answers, got %v", l)
+	}
+}
@@ -0,0 +1,331 @@
+package reverseoperator
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultDNSTLSPort is the port DNS-over-TLS servers listen on, per
+	// RFC 7858
+	DefaultDNSTLSPort = 853
+)
+
+var (
+	errTLSConnClosed = errors.New("dns-over-tls connection closed")
+	errTLSTimeout    = errors.New("dns-over-tls query timed out")
+	errSPKIMismatch  = errors.New("no certificate in the server's chain matched a pinned public key")
+)
+
+// DNSTLSOptions configures DNS-over-TLS (RFC 7858) for a DNSProvider.
+type DNSTLSOptions struct {
+	// RootCAs verifies server certificates; if nil, the system roots are used
+	RootCAs *x509.CertPool
+	// Servers holds the configuration of each server, keyed by its endpoint
+	// in `ip:port` form. Servers without an entry are verified by IP alone.
+	Servers map[string]DNSTLSServer
+}
+
+// DNSTLSServer is the configuration of a single DNS-over-TLS server.
+type DNSTLSServer struct {
+	// ServerName is the name the server's certificate is verified against
+	ServerName string
+	// SPKIPins are base64 encoded SHA-256 digests of public keys, per RFC
+	// 7469; if set, a certificate in the server's verified chain must have
+	// one of these keys.
+	SPKIPins []string
+}
+
+func (o *DNSTLSOptions) config(address string) *tls.Config {
+	s := o.Servers[address]
+
+	c := &tls.Config{
+		RootCAs:    o.RootCAs,
+		ServerName: s.ServerName,
+	}
+	if c.ServerName == "" {
+		c.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	if len(s.SPKIPins) > 0 {
+		c.VerifyPeerCertificate = verifySPKIPins(s.SPKIPins)
+	}
+
+	return c
+}
+
+// verifySPKIPins returns a function which checks that one of the verified
+// chains contains a certificate with a pinned public key; it runs after the
+// usual certificate verification, so pinning is in addition to it.
+func verifySPKIPins(pins []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				digest := base64.StdEncoding.EncodeToString(sum[:])
+				for _, p := range pins {
+					if digest == p {
+						return nil
+					}
+				}
+			}
+		}
+
+		return errSPKIMismatch
+	}
+}
+
+// tlsPool holds one persistent connection per DNS-over-TLS server, over
+// which queries are pipelined as described in RFC 7766.
+type tlsPool struct {
+	opts *DNSTLSOptions
+	// timeout bounds dialing and each query when the caller's context has
+	// no deadline of its own
+	timeout time.Duration
+
+	mutex   sync.Mutex
+	servers map[string]*tlsServer
+}
+
+// tlsServer holds the connection to a single server. dial is held while the
+// connection is checked or dialed, so that a server which is slow to dial
+// holds up only the queries to it.
+type tlsServer struct {
+	dial chan struct{}
+	conn *pipelineConn
+}
+
+func newTLSPool(opts *DNSTLSOptions, timeout time.Duration) *tlsPool {
+	return &tlsPool{
+		opts:    opts,
+		timeout: timeout,
+		servers: make(map[string]*tlsServer),
+	}
+}
+
+// exchange sends a message to a server over its persistent connection,
+// dialing it if there is none. Servers may close idle connections at any
+// time, so a query which fails because its connection closed is retried once
+// over a fresh one.
+func (p *tlsPool) exchange(ctx context.Context, m *dns.Msg, address string) (*dns.Msg, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(p.timeout)
+	}
+
+	c, err := p.conn(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := c.exchange(ctx, m, deadline)
+	if err == nil || !c.isClosed() {
+		return r, err
+	}
+
+	log.Debugf("dns-over-tls connection to %v closed, redialing: %v", address, err)
+	if c, err = p.conn(ctx, address); err != nil {
+		return nil, err
+	}
+	return c.exchange(ctx, m, deadline)
+}
+
+// conn returns the open connection to a server, dialing one if there is
+// none; a caller whose context is done stops waiting on another's dial.
+func (p *tlsPool) conn(ctx context.Context, address string) (*pipelineConn, error) {
+	p.mutex.Lock()
+	s, ok := p.servers[address]
+	if !ok {
+		s = &tlsServer{dial: make(chan struct{}, 1)}
+		p.servers[address] = s
+	}
+	p.mutex.Unlock()
+
+	select {
+	case s.dial <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-s.dial }()
+
+	if s.conn != nil && !s.conn.isClosed() {
+		return s.conn, nil
+	}
+
+	d := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: p.timeout},
+		Config:    p.opts.config(address),
+	}
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.conn = newPipelineConn(conn)
+	return s.conn, nil
+}
+
+// pipelineConn is a stream connection to a DNS server over which many
+// queries may be outstanding at once; responses are matched to their queries
+// by message ID, and may arrive in any order.
+type pipelineConn struct {
+	conn net.Conn
+
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	err     error
+}
+
+func newPipelineConn(conn net.Conn) *pipelineConn {
+	c := &pipelineConn{
+		conn:    conn,
+		pending: make(map[uint16]chan *dns.Msg),
+	}
+	go c.read()
+
+	return c
+}
+
+func (c *pipelineConn) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.err != nil
+}
+
+func (c *pipelineConn) exchange(ctx context.Context, m *dns.Msg, deadline time.Time) (*dns.Msg, error) {
+	// the message's ID must be unique among those outstanding on this
+	// connection, so it is sent as a copy with an ID of our choosing
+	q := m.Copy()
+	ch := make(chan *dns.Msg, 1)
+
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+	for {
+		q.Id = dns.Id()
+		if _, ok := c.pending[q.Id]; !ok {
+			break
+		}
+	}
+	c.pending[q.Id] = ch
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, q.Id)
+		c.mutex.Unlock()
+	}()
+
+	if err := c.write(q, deadline); err != nil {
+		c.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return nil, c.closeErr()
+		}
+		r.Id = m.Id
+		return r, nil
+	case <-timer.C:
+		return nil, errTLSTimeout
+	case <-ctx.Done():
+		// the connection is shared, so only this query is abandoned
+		return nil, ctx.Err()
+	}
+}
+
+// write sends a message, prefixed with its length as on any DNS stream
+// transport; dns.Conn isn't used as it isn't safe for a concurrent reader
+// and writer.
+func (c *pipelineConn) write(m *dns.Msg, deadline time.Time) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2, len(b)+2)
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	buf = append(buf, b...)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.conn.SetWriteDeadline(deadline)
+	_, err = c.conn.Write(buf)
+	return err
+}
+
+// read delivers responses to their waiting queries until the connection
+// fails, at which point every outstanding query fails with it.
+func (c *pipelineConn) read() {
+	l := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(c.conn, l); err != nil {
+			c.close(err)
+			return
+		}
+		b := make([]byte, binary.BigEndian.Uint16(l))
+		if _, err := io.ReadFull(c.conn, b); err != nil {
+			c.close(err)
+			return
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(b); err != nil {
+			log.Errorf("discarding malformed dns-over-tls response: %v", err)
+			continue
+		}
+
+		c.mutex.Lock()
+		if ch, ok := c.pending[r.Id]; ok {
+			delete(c.pending, r.Id)
+			ch <- r
+		}
+		c.mutex.Unlock()
+	}
+}
+
+func (c *pipelineConn) close(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = fmt.Errorf("%v: %v", errTLSConnClosed, err)
+	c.conn.Close()
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *pipelineConn) closeErr() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.err
+}
@@ -0,0 +1,280 @@
+package reverseoperator
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// newTestCert creates a self-signed certificate for the given name, along
+// with a pool trusting it and the pin of its public key.
+func newTestCert(t *testing.T, name string) (tls.Certificate, *x509.CertPool, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool,
+		base64.StdEncoding.EncodeToString(sum[:])
+}
+
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return c, err
+}
+
+// startTLSTestServer starts a DNS-over-TLS server on the loopback address
+// which answers every A question with 127.0.0.1.
+func startTLSTestServer(t *testing.T, cert tls.Certificate) (secop.Endpoint, *countingListener, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: l}
+
+	s := &dns.Server{
+		Listener: tls.NewListener(cl, &tls.Config{Certificates: []tls.Certificate{cert}}),
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			r := new(dns.Msg)
+			r.SetReply(m)
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("127.0.0.1"),
+			})
+			w.WriteMsg(r)
+		}),
+	}
+	go s.ActivateAndServe()
+
+	addr := l.Addr().(*net.TCPAddr)
+	return secop.Endpoint{IP: addr.IP, Port: uint16(addr.Port)}, cl, func() {
+		s.Shutdown()
+	}
+}
+
+func TestDNSProviderTLS(t *testing.T) {
+	cert, pool, _ := newTestCert(t, "dns.test")
+	ep, l, shutdown := startTLSTestServer(t, cert)
+	defer shutdown()
+
+	p, err := NewDNSProvider(secop.Endpoints{ep}, &DNSProviderOptions{
+		TLS: &DNSTLSOptions{
+			RootCAs: pool,
+			Servers: map[string]DNSTLSServer{
+				ep.String(): DNSTLSServer{ServerName: "dns.test"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// many concurrent queries share a single connection
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("host%v.example.com.", i)
+			resp, err := p.Resolve(context.Background(), question(name, dns.TypeA))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if l := len(resp.Answer); l != 1 || resp.Answer[0].Name != name {
+				t.Errorf("unexpected answer for %v: %v", name, resp.Answer)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if a := atomic.LoadInt32(&l.accepted); a != 1 {
+		t.Errorf("expected a single connection, got %v", a)
+	}
+
+	// a closed connection is replaced on the next query
+	p.tls.mutex.Lock()
+	p.tls.servers[ep.String()].conn.conn.Close()
+	p.tls.mutex.Unlock()
+
+	if _, err := p.Resolve(context.Background(), question("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if a := atomic.LoadInt32(&l.accepted); a != 2 {
+		t.Errorf("expected a second connection, got %v", a)
+	}
+}
+
+func TestDNSProviderTLSBadServerName(t *testing.T) {
+	cert, pool, _ := newTestCert(t, "dns.test")
+	ep, _, shutdown := startTLSTestServer(t, cert)
+	defer shutdown()
+
+	p, err := NewDNSProvider(secop.Endpoints{ep}, &DNSProviderOptions{
+		TLS: &DNSTLSOptions{
+			RootCAs: pool,
+			Servers: map[string]DNSTLSServer{
+				ep.String(): DNSTLSServer{ServerName: "wrong.test"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Resolve(context.Background(), question("example.com", dns.TypeA)); err == nil {
+		t.Error("expected certificate verification to fail")
+	}
+}
+
+func TestDNSProviderTLSPins(t *testing.T) {
+	cert, pool, pin := newTestCert(t, "dns.test")
+	ep, _, shutdown := startTLSTestServer(t, cert)
+	defer shutdown()
+
+	for _, tt := range []struct {
+		pin string
+		ok  bool
+	}{
+		{pin, true},
+		{base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)), false},
+	} {
+		p, err := NewDNSProvider(secop.Endpoints{ep}, &DNSProviderOptions{
+			TLS: &DNSTLSOptions{
+				RootCAs: pool,
+				Servers: map[string]DNSTLSServer{
+					ep.String(): DNSTLSServer{ServerName: "dns.test", SPKIPins: []string{tt.pin}},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = p.Resolve(context.Background(), question("example.com", dns.TypeA))
+		if tt.ok && err != nil {
+			t.Errorf("unexpected error for pin %v: %v", tt.pin, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("expected pin %v to fail", tt.pin)
+		}
+	}
+}
+
+func TestDNSProviderTLSStalledDial(t *testing.T) {
+	cert, pool, _ := newTestCert(t, "dns.test")
+	ep, _, shutdown := startTLSTestServer(t, cert)
+	defer shutdown()
+
+	// a server which accepts connections but never completes a handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	stalled := l.Addr().String()
+
+	p, err := NewDNSProvider(secop.Endpoints{ep}, &DNSProviderOptions{
+		TLS: &DNSTLSOptions{
+			RootCAs: pool,
+			Servers: map[string]DNSTLSServer{
+				ep.String(): DNSTLSServer{ServerName: "dns.test"},
+				stalled:     DNSTLSServer{ServerName: "dns.test"},
+			},
+		},
+		Timeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialing := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			_, err := p.tls.exchange(ctx, questionToMsg(question("example.com", dns.TypeA)), stalled)
+			dialing <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := p.tls.exchange(ctx, questionToMsg(question("example.com", dns.TypeA)), ep.String()); err != nil {
+		t.Errorf("expected a query to another server to succeed, got %v", err)
+	}
+
+	// both queries to the stalled server give up with their context, rather
+	// than the provider's timeout, including the one waiting on the other's
+	// dial
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-dialing:
+			if err == nil {
+				t.Error("expected the stalled server to fail")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected the stalled dial to end with its context")
+		}
+	}
+}
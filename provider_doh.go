@@ -0,0 +1,156 @@
+package reverseoperator
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultQueryPaddingBlockSize is the block size queries are padded to, as
+// recommended for queries by RFC 8467.
+const DefaultQueryPaddingBlockSize = 128
+
+// DoHOptions is a configuration object for optional DoHProvider configuration
+type DoHOptions struct {
+	// BootstrapIPs is a list of IPs to connect to for the endpoint, avoiding
+	// a DNS lookup of its host; one is chosen randomly for each connection.
+	// If not provided, the system DNS resolver is used.
+	BootstrapIPs []net.IP
+	// Pad specifies if queries should be padded to a multiple of
+	// DefaultQueryPaddingBlockSize, so their length doesn't reveal the name
+	Pad bool
+	// RootCAs verifies the endpoint's certificate; if nil, the system roots
+	// are used
+	RootCAs *x509.CertPool
+}
+
+// NewDoHProvider creates a DoHProvider
+func NewDoHProvider(endpoint string, opts *DoHOptions) (*DoHProvider, error) {
+	if opts == nil {
+		opts = &DoHOptions{}
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("endpoint %v must use https", endpoint)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if l := len(opts.BootstrapIPs); l > 0 {
+		// connect to one of the bootstrap IPs in place of the host; TLS is
+		// still verified against the endpoint's host, as it's the one in
+		// the request url
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			ip := opts.BootstrapIPs[rand.Intn(l)]
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	// a single long-lived HTTP/2 connection carries every query, rather than
+	// a handshake per query
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       &tls.Config{RootCAs: opts.RootCAs},
+	}
+
+	return &DoHProvider{
+		url:    u,
+		opts:   opts,
+		client: &http.Client{Transport: tr},
+	}, nil
+}
+
+// DoHProvider is an RFC 8484 DNS-over-HTTPS client, which sends wire-format
+// queries to another DoH service; it implements Resolver.
+type DoHProvider struct {
+	url    *url.URL
+	opts   *DoHOptions
+	client *http.Client
+}
+
+// Resolve sends a DNS question to the endpoint, and returns the response; it
+// implements Resolver.
+func (d *DoHProvider) Resolve(ctx context.Context, q Question) (*Response, error) {
+	msg := questionToMsg(q)
+	// HTTP matches each response to its request, so the ID serves no
+	// purpose; RFC 8484 asks for zero, so that it tells the server nothing
+	msg.Id = 0
+	if d.opts.Pad {
+		if msg.IsEdns0() == nil {
+			msg.SetEdns0(ednsUDPSize, false)
+		}
+		if err := padDNSMsg(msg, DefaultQueryPaddingBlockSize); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.url.String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("content-type", dnsMessageContentType)
+	req.Header.Set("accept", dnsMessageContentType)
+
+	httpresp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpresp.Body.Close()
+
+	if httpresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v from %v", httpresp.Status, d.url.Host)
+	}
+	// an error page served with a 200 status shouldn't be taken for a
+	// malformed message
+	ct, _, _ := mime.ParseMediaType(httpresp.Header.Get("content-type"))
+	if ct != dnsMessageContentType {
+		return nil, fmt.Errorf("unexpected content type %q from %v, expected %v", ct, d.url.Host, dnsMessageContentType)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(httpresp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+
+	return msgToResponse(q, r), nil
+}
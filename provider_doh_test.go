@@ -0,0 +1,218 @@
+package reverseoperator
+
+import (
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// startDoHTestServer starts an HTTP/2 TLS server answering RFC 8484 POSTs;
+// the handler receives each unpacked query, and returns the reply.
+func startDoHTestServer(t *testing.T, answer func(*http.Request, *dns.Msg) *dns.Msg) (*httptest.Server, *x509.CertPool) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp, err := answer(r, m).Pack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Header().Set("content-type", dnsMessageContentType)
+		w.Write(resp)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	return s, pool
+}
+
+func TestDoHProviderResolve(t *testing.T) {
+	var (
+		mutex   sync.Mutex
+		sent    []*dns.Msg
+		remotes = make(map[string]bool)
+	)
+	s, pool := startDoHTestServer(t, func(r *http.Request, m *dns.Msg) *dns.Msg {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if r.Method != http.MethodPost {
+			t.Errorf("expected POST, got %v", r.Method)
+		}
+		if ct := r.Header.Get("content-type"); ct != dnsMessageContentType {
+			t.Errorf("unexpected content-type %v", ct)
+		}
+		if r.ProtoMajor != 2 {
+			t.Errorf("expected HTTP/2, got %v", r.Proto)
+		}
+		sent = append(sent, m)
+		remotes[r.RemoteAddr] = true
+
+		reply := new(dns.Msg)
+		reply.SetReply(m)
+		rr, _ := dns.NewRR("example.com. 300 IN A 127.0.0.1")
+		reply.Answer = append(reply.Answer, rr)
+		return reply
+	})
+	defer s.Close()
+
+	p, err := NewDoHProvider(s.URL+"/dns-query", &DoHOptions{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := p.Resolve(context.Background(), Question{
+			DNSQuestion:      secop.DNSQuestion{Name: "example.com", Type: dns.TypeA},
+			CheckingDisabled: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l := len(resp.Answer); l != 1 {
+			t.Fatalf("expected 1 answer, got %v", l)
+		}
+		if d := resp.Answer[0].Data; d != "127.0.0.1" {
+			t.Errorf("unexpected answer %v", d)
+		}
+	}
+
+	if sent[0].Id != 0 {
+		t.Errorf("expected a zero message ID, got %v", sent[0].Id)
+	}
+	if !sent[0].CheckingDisabled {
+		t.Error("expected CD to be sent upstream")
+	}
+	if sent[0].IsEdns0() != nil {
+		t.Error("expected no OPT record without padding")
+	}
+	if l := len(remotes); l != 1 {
+		t.Errorf("expected queries to reuse 1 connection, used %v", l)
+	}
+}
+
+func TestDoHProviderPadding(t *testing.T) {
+	var (
+		sent   *dns.Msg
+		length int64
+	)
+	s, pool := startDoHTestServer(t, func(r *http.Request, m *dns.Msg) *dns.Msg {
+		sent, length = m, r.ContentLength
+		reply := new(dns.Msg)
+		reply.SetReply(m)
+		return reply
+	})
+	defer s.Close()
+
+	p, err := NewDoHProvider(s.URL, &DoHOptions{RootCAs: pool, Pad: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Resolve(context.Background(), question("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !requestsPadding(sent) {
+		t.Fatal("expected query to be padded")
+	}
+	if length%DefaultQueryPaddingBlockSize != 0 {
+		t.Errorf("expected query length to be a multiple of %v, got %v", DefaultQueryPaddingBlockSize, length)
+	}
+}
+
+func TestDoHProviderBootstrap(t *testing.T) {
+	s, pool := startDoHTestServer(t, func(r *http.Request, m *dns.Msg) *dns.Msg {
+		reply := new(dns.Msg)
+		reply.SetReply(m)
+		return reply
+	})
+	defer s.Close()
+
+	// the test certificate is valid for example.com, which must never be
+	// looked up, as it would resolve elsewhere
+	u, _ := url.Parse(s.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+	endpoint := "https://" + net.JoinHostPort("example.com", port) + "/dns-query"
+
+	p, err := NewDoHProvider(endpoint, &DoHOptions{
+		RootCAs:      pool,
+		BootstrapIPs: []net.IP{net.ParseIP("127.0.0.1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Resolve(context.Background(), question("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDoHProviderBadStatus(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadGateway)
+	}))
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	p, err := NewDoHProvider(s.URL, &DoHOptions{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Resolve(context.Background(), question("example.com", dns.TypeA)); err == nil {
+		t.Error("expected an error for a bad status")
+	}
+}
+
+func TestDoHProviderBadContentType(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body>captive portal</body></html>"))
+	}))
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	p, err := NewDoHProvider(s.URL, &DoHOptions{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.Resolve(context.Background(), question("example.com", dns.TypeA))
+	if err == nil || !strings.Contains(err.Error(), "content type") {
+		t.Errorf("expected an error for the content type, got %v", err)
+	}
+}
+
+func TestDoHProviderHTTPEndpoint(t *testing.T) {
+	if _, err := NewDoHProvider("http://example.com/dns-query", nil); err == nil {
+		t.Error("expected an error for a non-https endpoint")
+	}
+}
@@ -0,0 +1,77 @@
+package reverseoperator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// blockingProvider is a secop.Provider which doesn't respond until released.
+type blockingProvider struct {
+	release chan struct{}
+}
+
+func (b *blockingProvider) Query(q secop.DNSQuestion) (*secop.DNSResponse, error) {
+	<-b.release
+	return &secop.DNSResponse{}, nil
+}
+
+func TestProviderResolverContext(t *testing.T) {
+	p := &blockingProvider{release: make(chan struct{})}
+	defer close(p.release)
+
+	r := NewProviderResolver(p)
+	if _, ok := r.(*providerResolver); !ok {
+		t.Fatalf("expected provider to be adapted, got %T", r)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.Resolve(ctx, question("example.com", dns.TypeA)); err != context.Canceled {
+		t.Errorf("expected the query to be abandoned, got %v", err)
+	}
+}
+
+func TestProviderResolverPassthrough(t *testing.T) {
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := NewProviderResolver(p); r != Resolver(p) {
+		t.Errorf("expected a Resolver to be returned as-is, got %T", r)
+	}
+}
+
+func TestResolverProvider(t *testing.T) {
+	var resolved Question
+	r := &funcResolver{resolve: func(q Question) (*Response, error) {
+		resolved = q
+		return &Response{DNSResponse: secop.DNSResponse{ResponseCode: dns.RcodeNameError}}, nil
+	}}
+
+	p := NewResolverProvider(r)
+	resp, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeNameError {
+		t.Errorf("unexpected response code %v", resp.ResponseCode)
+	}
+	if resolved.Name != "example.com" || resolved.Type != dns.TypeA {
+		t.Errorf("unexpected question resolved %v", resolved.DNSQuestion)
+	}
+
+	// adapting back unwraps the resolver, so that questions keep their flags
+	if a := NewProviderResolver(p); a != Resolver(r) {
+		t.Errorf("expected the resolver to be unwrapped, got %T", a)
+	}
+
+	b := &blockingProvider{}
+	if a := NewResolverProvider(NewProviderResolver(b)); a != secop.Provider(b) {
+		t.Errorf("expected the provider to be unwrapped, got %T", a)
+	}
+}
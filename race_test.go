@@ -0,0 +1,287 @@
+package reverseoperator
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// upstreamBehaviour describes how a mocked server responds: after delay, with
+// rcode; a negative delay never responds, waiting until cancelled.
+type upstreamBehaviour struct {
+	delay time.Duration
+	rcode int
+}
+
+// mockUpstreams mocks exchange with servers behaving as described, keyed by
+// address; the returned channel receives the address of each cancelled query.
+func mockUpstreams(servers map[string]upstreamBehaviour) (chan string, func()) {
+	cancelled := make(chan string, 10)
+
+	orig := exchange
+	exchange = func(ctx context.Context, m *dns.Msg, network, address string) (*dns.Msg, error) {
+		b := servers[address]
+
+		var wait <-chan time.Time
+		if b.delay >= 0 {
+			wait = time.After(b.delay)
+		}
+		select {
+		case <-wait:
+			return reply(m, b.rcode), nil
+		case <-ctx.Done():
+			cancelled <- address
+			return nil, ctx.Err()
+		}
+	}
+
+	return cancelled, func() {
+		exchange = orig
+	}
+}
+
+func waitCancelled(t *testing.T, cancelled chan string, address string) {
+	select {
+	case a := <-cancelled:
+		if a != address {
+			t.Errorf("expected query to %v to be cancelled, got %v", address, a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected query to %v to be cancelled", address)
+	}
+}
+
+func TestDNSProviderRace(t *testing.T) {
+	cancelled, restore := mockUpstreams(map[string]upstreamBehaviour{
+		"10.0.0.1:53": {delay: -1},
+		"10.0.0.2:53": {rcode: dns.RcodeNameError},
+	})
+	defer restore()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+		Race:   2,
+		Health: &HealthOptions{MaxFailures: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN to win, got %v", resp.ResponseCode)
+	}
+
+	waitCancelled(t, cancelled, "10.0.0.1:53")
+
+	// losing a race isn't a failure
+	if u := p.Stats().Unhealthy; len(u) != 0 {
+		t.Errorf("expected no unhealthy servers, got %v", u)
+	}
+}
+
+func TestDNSProviderRaceServFailLoses(t *testing.T) {
+	for _, rcode := range []int{dns.RcodeServerFailure, dns.RcodeRefused} {
+		_, restore := mockUpstreams(map[string]upstreamBehaviour{
+			"10.0.0.1:53": {rcode: rcode},
+			"10.0.0.2:53": {delay: 20 * time.Millisecond},
+		})
+
+		p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+			Race:    2,
+			Retries: -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ResponseCode != dns.RcodeSuccess {
+			t.Errorf("expected NOERROR to beat %v, got %v", dns.RcodeToString[rcode], resp.ResponseCode)
+		}
+
+		restore()
+	}
+}
+
+func TestDNSProviderRaceAllServFail(t *testing.T) {
+	_, restore := mockUpstreams(map[string]upstreamBehaviour{
+		"10.0.0.1:53": {rcode: dns.RcodeServerFailure},
+		"10.0.0.2:53": {rcode: dns.RcodeServerFailure},
+	})
+	defer restore()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+		Race: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", resp.ResponseCode)
+	}
+}
+
+func TestDNSProviderHedge(t *testing.T) {
+	cancelled, restore := mockUpstreams(map[string]upstreamBehaviour{
+		"10.0.0.1:53": {delay: -1},
+		"10.0.0.2:53": {},
+	})
+	defer restore()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+		Strategy:   StrategyPriority,
+		HedgeDelay: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeSuccess {
+		t.Errorf("expected NOERROR, got %v", resp.ResponseCode)
+	}
+	if h := p.Stats().Hedged; h != 1 {
+		t.Errorf("expected 1 hedged query, got %v", h)
+	}
+
+	waitCancelled(t, cancelled, "10.0.0.1:53")
+}
+
+func TestDNSProviderHedgeNotNeeded(t *testing.T) {
+	_, restore := mockUpstreams(map[string]upstreamBehaviour{
+		"10.0.0.1:53": {},
+		"10.0.0.2:53": {},
+	})
+	defer restore()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+		HedgeDelay: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != nil {
+		t.Fatal(err)
+	}
+	if h := p.Stats().Hedged; h != 0 {
+		t.Errorf("expected no hedged queries, got %v", h)
+	}
+}
+
+func TestExchangeCancel(t *testing.T) {
+	var (
+		once     sync.Once
+		received = make(chan struct{})
+	)
+	ep, shutdown := startTestServer(t, func(w dns.ResponseWriter, m *dns.Msg) {
+		// never respond
+		once.Do(func() { close(received) })
+	})
+	defer shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+
+	start := time.Now()
+	if _, err := exchange(ctx, m, "udp", ep.String()); err != context.Canceled {
+		t.Errorf("expected the exchange to be cancelled, got %v", err)
+	}
+	if d := time.Since(start); d >= DefaultTimeout {
+		t.Errorf("expected cancellation to end the exchange early, took %v", d)
+	}
+}
+
+func TestDNSProviderTimeout(t *testing.T) {
+	cancelled, restore := mockUpstreams(map[string]upstreamBehaviour{
+		"10.0.0.1:53": {delay: -1},
+		"10.0.0.2:53": {},
+	})
+	defer restore()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+		Strategy: StrategyPriority,
+		Timeout:  10 * time.Millisecond,
+		Health:   &HealthOptions{MaxFailures: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != nil {
+		t.Fatalf("expected the query to be retried after timing out, got %v", err)
+	}
+
+	waitCancelled(t, cancelled, "10.0.0.1:53")
+
+	// timing out is a failure, unlike losing a race
+	if u := p.Stats().Unhealthy; len(u) != 1 {
+		t.Errorf("expected the server which timed out to be unhealthy, got %v", u)
+	}
+}
+
+func TestDNSProviderDeadline(t *testing.T) {
+	_, restore := mockUpstreams(map[string]upstreamBehaviour{
+		"10.0.0.1:53": {delay: -1},
+		"10.0.0.2:53": {delay: -1},
+	})
+	defer restore()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+		Timeout:  time.Minute,
+		Deadline: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+}
+
+func TestDNSProviderContextCancelled(t *testing.T) {
+	cancelled, restore := mockUpstreams(map[string]upstreamBehaviour{
+		"10.0.0.1:53": {delay: -1},
+	})
+	defer restore()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Resolve(ctx, question("example.com", dns.TypeA)); err != context.DeadlineExceeded {
+		t.Errorf("expected the caller's deadline to be exceeded, got %v", err)
+	}
+
+	// with no one else waiting, the upstream query is cancelled too
+	waitCancelled(t, cancelled, "10.0.0.1:53")
+}
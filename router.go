@@ -0,0 +1,179 @@
+package reverseoperator
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// NewRouter creates a Router, which sends questions within each zone of
+// routes to that zone's Resolver, and all others to fallback.
+func NewRouter(fallback Resolver, routes map[string]Resolver) *Router {
+	r := &Router{
+		fallback: fallback,
+		routes:   make(map[string]Resolver),
+	}
+	for zone, resolver := range routes {
+		r.routes[canonicalName(zone)] = resolver
+	}
+
+	return r
+}
+
+// Router is a Resolver which forwards each question to the resolver for the
+// longest zone it falls within, so that, for instance, internal names may be
+// resolved by internal servers.
+type Router struct {
+	fallback Resolver
+	routes   map[string]Resolver
+}
+
+// Resolve routes a question to its resolver; it implements Resolver.
+func (r *Router) Resolve(ctx context.Context, q Question) (*Response, error) {
+	return r.route(q.Name).Resolve(ctx, q)
+}
+
+// route finds the resolver of the longest zone which name falls within.
+func (r *Router) route(name string) Resolver {
+	name = canonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if resolver, ok := r.routes[name[off:]]; ok {
+			log.Debugf("routing %v to zone %v", name, name[off:])
+			return resolver
+		}
+	}
+	if resolver, ok := r.routes["."]; ok {
+		return resolver
+	}
+
+	return r.fallback
+}
+
+// canonicalName returns the lowercase, fully qualified form of a name.
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// ParseRoutes parses forwarding routes, one per line in the form
+// "zone server[,server...]", where each server is given as "ip[:port]".
+// Blank lines and those starting with "#" are ignored. A zone may also be
+// given as a CIDR, such as "10.0.0.0/8", which routes the reverse zones of
+// that network.
+func ParseRoutes(r io.Reader, defaultPort uint16) (map[string]secop.Endpoints, error) {
+	routes := make(map[string]secop.Endpoints)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %v: route must be given as zone server[,server...]", line)
+		}
+
+		zones, err := routeZones(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+
+		var servers secop.Endpoints
+		for _, s := range strings.Split(strings.Join(fields[1:], ""), ",") {
+			if s == "" {
+				continue
+			}
+			ep, err := secop.ParseEndpoint(s, defaultPort)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", line, err)
+			}
+			servers = append(servers, ep)
+		}
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("line %v: at least one server is required", line)
+		}
+
+		for _, z := range zones {
+			routes[z] = append(routes[z], servers...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// routeZones returns the zones a route applies to: the zone itself, or the
+// reverse zones of a network given as a CIDR.
+func routeZones(zone string) ([]string, error) {
+	if !strings.Contains(zone, "/") {
+		if _, ok := dns.IsDomainName(zone); !ok {
+			return nil, fmt.Errorf("invalid zone %v", zone)
+		}
+		return []string{canonicalName(zone)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	return reverseZones(network), nil
+}
+
+// reverseZones returns the in-addr.arpa or ip6.arpa zones covering a
+// network. Reverse zones are delegated on octet (IPv4) or nibble (IPv6)
+// boundaries, so a network between boundaries is covered by several zones,
+// one for each of its subnets on the next boundary.
+func reverseZones(network *net.IPNet) []string {
+	ones, _ := network.Mask.Size()
+	ip := network.IP.To4()
+	step, suffix := 8, "in-addr.arpa."
+	if ip == nil {
+		ip = network.IP.To16()
+		step, suffix = 4, "ip6.arpa."
+	}
+
+	// round the prefix up to the next boundary, and enumerate the subnets
+	// of the network at that length
+	labels := (ones + step - 1) / step
+	extra := uint(labels*step - ones)
+
+	var zones []string
+	for i := 0; i < 1<<extra; i++ {
+		subnet := make(net.IP, len(ip))
+		copy(subnet, ip)
+		// set the bits between the prefix and the boundary to i
+		for b := uint(0); b < extra; b++ {
+			if i&(1<<b) == 0 {
+				continue
+			}
+			pos := labels*step - 1 - int(b)
+			subnet[pos/8] |= 0x80 >> uint(pos%8)
+		}
+
+		var parts []string
+		for l := labels - 1; l >= 0; l-- {
+			if step == 8 {
+				parts = append(parts, fmt.Sprintf("%d", subnet[l]))
+			} else {
+				nibble := subnet[l/2] >> uint(4*(1-l%2)) & 0xf
+				parts = append(parts, fmt.Sprintf("%x", nibble))
+			}
+		}
+		parts = append(parts, suffix)
+		zones = append(zones, strings.Join(parts, "."))
+	}
+
+	return zones
+}
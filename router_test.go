@@ -0,0 +1,169 @@
+package reverseoperator
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// namedResolver is a Resolver which is told apart from others by its name.
+type namedResolver string
+
+func (n namedResolver) Resolve(ctx context.Context, q Question) (*Response, error) {
+	return &Response{}, nil
+}
+
+func TestRouterLongestMatch(t *testing.T) {
+	r := NewRouter(namedResolver("default"), map[string]Resolver{
+		"corp.example":           namedResolver("corp"),
+		"Dev.Corp.Example.":      namedResolver("dev"),
+		"10.in-addr.arpa":        namedResolver("reverse"),
+		"example.net.":           namedResolver("net"),
+		"unrelated.corp.example": namedResolver("unrelated"),
+	})
+
+	for name, expected := range map[string]string{
+		"corp.example":            "corp",
+		"host.corp.example.":      "corp",
+		"HOST.CORP.EXAMPLE":       "corp",
+		"dev.corp.example":        "dev",
+		"a.b.dev.corp.example":    "dev",
+		"xdev.corp.example":       "corp",
+		"notcorp.example":         "default",
+		"4.3.2.10.in-addr.arpa.":  "reverse",
+		"4.3.2.192.in-addr.arpa.": "default",
+		"www.example.net":         "net",
+		"example.com":             "default",
+		".":                       "default",
+	} {
+		if r := r.route(name); r != namedResolver(expected) {
+			t.Errorf("%v: expected to be routed to %v, got %v", name, expected, r)
+		}
+	}
+}
+
+func TestRouterRoot(t *testing.T) {
+	r := NewRouter(namedResolver("default"), map[string]Resolver{
+		".":            namedResolver("root"),
+		"corp.example": namedResolver("corp"),
+	})
+
+	if r := r.route("example.com"); r != namedResolver("root") {
+		t.Errorf("expected the root route to be used, got %v", r)
+	}
+	if r := r.route("a.corp.example"); r != namedResolver("corp") {
+		t.Errorf("expected the corp route to be used, got %v", r)
+	}
+}
+
+func TestRouterResolve(t *testing.T) {
+	var sent []string
+	defer mockExchangeAddr(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		sent = append(sent, address)
+		return reply(m, dns.RcodeSuccess), nil
+	})()
+
+	internal, err := NewDNSProvider(testEndpoints("10.0.0.1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := NewDNSProvider(testEndpoints("8.8.8.8"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRouter(public, map[string]Resolver{"corp.example": internal})
+	if _, err := r.Resolve(context.Background(), question("www.corp.example", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Resolve(context.Background(), question("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(sent, []string{"10.0.0.1:53", "8.8.8.8:53"}) {
+		t.Errorf("unexpected servers queried %v", sent)
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes(strings.NewReader(`
+# internal names
+corp.example.    10.1.0.53, 10.1.0.54:5353
+Lab.Example      10.2.0.53
+
+10.0.0.0/8       10.1.0.53
+172.16.0.0/12    10.1.0.53
+fd00::/7         10.1.0.53
+`), 53)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ep := func(ip string, port uint16) secop.Endpoint {
+		return secop.Endpoint{IP: net.ParseIP(ip), Port: port}
+	}
+	for zone, servers := range map[string]secop.Endpoints{
+		"corp.example.":        {ep("10.1.0.53", 53), ep("10.1.0.54", 5353)},
+		"lab.example.":         {ep("10.2.0.53", 53)},
+		"10.in-addr.arpa.":     {ep("10.1.0.53", 53)},
+		"16.172.in-addr.arpa.": {ep("10.1.0.53", 53)},
+		"31.172.in-addr.arpa.": {ep("10.1.0.53", 53)},
+		"c.f.ip6.arpa.":        {ep("10.1.0.53", 53)},
+		"d.f.ip6.arpa.":        {ep("10.1.0.53", 53)},
+	} {
+		if len(routes[zone]) != len(servers) {
+			t.Errorf("%v: expected %v, got %v", zone, servers, routes[zone])
+			continue
+		}
+		for i, s := range servers {
+			if !s.IP.Equal(routes[zone][i].IP) || s.Port != routes[zone][i].Port {
+				t.Errorf("%v: expected %v, got %v", zone, servers, routes[zone])
+			}
+		}
+	}
+
+	// 2 names, and 1, 16 and 2 reverse zones
+	if l := len(routes); l != 21 {
+		t.Errorf("expected 21 zones, got %v", l)
+	}
+}
+
+func TestParseRoutesErrors(t *testing.T) {
+	for _, input := range []string{
+		"corp.example",
+		"corp.example ,",
+		"corp..example 10.0.0.1",
+		"10.0.0.0/33 10.0.0.1",
+		"corp.example not-an-ip",
+	} {
+		if _, err := ParseRoutes(strings.NewReader(input), 53); err == nil {
+			t.Errorf("%q: expected an error", input)
+		}
+	}
+}
+
+func TestReverseZones(t *testing.T) {
+	for cidr, expected := range map[string][]string{
+		"192.168.0.0/16": {"168.192.in-addr.arpa."},
+		"192.168.1.0/24": {"1.168.192.in-addr.arpa."},
+		"10.0.0.0/7":     {"10.in-addr.arpa.", "11.in-addr.arpa."},
+		"0.0.0.0/0":      {"in-addr.arpa."},
+		"2001:db8::/32":  {"8.b.d.0.1.0.0.2.ip6.arpa."},
+		"2001:db8::/31":  {"8.b.d.0.1.0.0.2.ip6.arpa.", "9.b.d.0.1.0.0.2.ip6.arpa."},
+		"2001:db8::/30":  {"8.b.d.0.1.0.0.2.ip6.arpa.", "9.b.d.0.1.0.0.2.ip6.arpa.", "a.b.d.0.1.0.0.2.ip6.arpa.", "b.b.d.0.1.0.0.2.ip6.arpa."},
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if zones := reverseZones(network); !reflect.DeepEqual(zones, expected) {
+			t.Errorf("%v: expected %v, got %v", cidr, expected, zones)
+		}
+	}
+}
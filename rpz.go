@@ -0,0 +1,484 @@
+package reverseoperator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// DefaultRPZReloadInterval is how often policy zone files are checked for
+// changes when no other interval is configured.
+const DefaultRPZReloadInterval = 30 * time.Second
+
+// ErrDropped is returned for questions which a policy says to drop, which
+// should go unanswered.
+var ErrDropped = errors.New("dropped by policy")
+
+// labels under the origin of a policy zone which hold triggers other than
+// QNAME triggers, and the targets of CNAMEs which are actions rather than
+// local data; see draft-vixie-dnsop-dns-rpz
+const (
+	rpzIP      = "rpz-ip"
+	rpzNSDName = "rpz-nsdname"
+
+	rpzNXDomain = "."
+	rpzNoData   = "*."
+	rpzPassthru = "rpz-passthru."
+	rpzDrop     = "rpz-drop."
+)
+
+// RPZOptions is a configuration object for optional RPZ configuration
+type RPZOptions struct {
+	// ReloadInterval is how often policy zone files are checked for changes,
+	// and reloaded if changed; if zero, DefaultRPZReloadInterval is used, and
+	// if negative, zones are never reloaded.
+	ReloadInterval time.Duration
+}
+
+// NewRPZ creates an RPZ, loading each of the policy zone files, in order of
+// precedence.
+func NewRPZ(fallback Resolver, files []ZoneFile, opts *RPZOptions) (*RPZ, error) {
+	if opts == nil {
+		opts = &RPZOptions{}
+	}
+
+	r := &RPZ{
+		fallback: fallback,
+	}
+	for _, f := range files {
+		zf := &zoneFile{ZoneFile: f}
+		if err := zf.load(); err != nil {
+			return nil, err
+		}
+		r.files = append(r.files, zf)
+		r.policies = append(r.policies, newPolicyZone(zf.zone))
+	}
+
+	interval := opts.ReloadInterval
+	if interval == 0 {
+		interval = DefaultRPZReloadInterval
+	}
+	r.watcher = newWatcher(interval, r.reload)
+
+	return r, nil
+}
+
+// RPZ is a Resolver which applies the policies of response policy zones, as
+// described by draft-vixie-dnsop-dns-rpz, to the questions it passes to
+// another Resolver. QNAME triggers are applied to a question, and response
+// IP and NSDNAME triggers to its response, with the first zone to be
+// triggered taking precedence. Its actions answer that the
+// name doesn't exist, that it has no data, with local data, or not at all,
+// for which ErrDropped is returned; or leave the response as it is. Policy
+// zone files are reloaded when they change on disk.
+type RPZ struct {
+	fallback Resolver
+	files    []*zoneFile
+
+	mutex    sync.RWMutex
+	policies []*policyZone
+
+	watcher *watcher
+}
+
+// Resolve resolves a question, applying the policies triggered by its name
+// or response; it implements Resolver. Each zone's triggers are checked in
+// turn, so that an earlier zone takes precedence whichever kind of trigger
+// it matches; the question is resolved only once a zone has response IP or
+// NSDNAME triggers to check.
+func (r *RPZ) Resolve(ctx context.Context, q Question) (*Response, error) {
+	r.mutex.RLock()
+	policies := r.policies
+	r.mutex.RUnlock()
+
+	var (
+		resp        *Response
+		nameservers []string
+	)
+	for _, p := range policies {
+		if a := p.qname(q.Name); a != nil {
+			return r.apply(ctx, q, a, resp)
+		}
+		if len(p.ips) == 0 && !p.hasNSDNames {
+			continue
+		}
+
+		if resp == nil {
+			var err error
+			if resp, err = r.fallback.Resolve(ctx, q); err != nil {
+				return nil, err
+			}
+		}
+		if a := p.responseIP(resp); a != nil {
+			return r.apply(ctx, q, a, resp)
+		}
+		if !p.hasNSDNames {
+			continue
+		}
+		if nameservers == nil {
+			nameservers = r.nameservers(ctx, q)
+		}
+		if a := p.nsdname(nameservers); a != nil {
+			return r.apply(ctx, q, a, resp)
+		}
+	}
+
+	if resp == nil {
+		return r.fallback.Resolve(ctx, q)
+	}
+	return resp, nil
+}
+
+// apply applies the action of a policy to a question; resp is the response
+// to the question, if it has already been resolved.
+func (r *RPZ) apply(ctx context.Context, q Question, a *rpzAction, resp *Response) (*Response, error) {
+	log.Debugf("policy %v applies to %v", a, q.Name)
+
+	if a.kind == rpzActionPassthru {
+		if resp != nil {
+			return resp, nil
+		}
+		return r.fallback.Resolve(ctx, q)
+	}
+	if a.kind == rpzActionDrop {
+		return nil, ErrDropped
+	}
+
+	m := new(dns.Msg)
+	m.Question = []dns.Question{{Name: dns.Fqdn(q.Name), Qtype: q.Type, Qclass: dns.ClassINET}}
+	m.RecursionDesired = true
+	m.RecursionAvailable = true
+
+	var cname string
+	switch a.kind {
+	case rpzActionNXDomain:
+		m.Rcode = dns.RcodeNameError
+	case rpzActionLocalData:
+		for _, rr := range a.data {
+			rr = dns.Copy(rr)
+			rr.Header().Name = dns.Fqdn(q.Name)
+
+			t := rr.Header().Rrtype
+			if c, ok := rr.(*dns.CNAME); ok && q.Type != dns.TypeCNAME && q.Type != dns.TypeANY {
+				m.Answer = []dns.RR{rr}
+				cname = c.Target
+				break
+			}
+			if t == q.Type || q.Type == dns.TypeANY {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+
+	local := msgToResponse(q, m)
+	local.Comment = fmt.Sprintf("Rewritten by policy %v", a)
+	if cname == "" {
+		return local, nil
+	}
+
+	// local data which is a CNAME is followed, as a zone's would be
+	target := q
+	target.Name = cname
+	tresp, err := r.fallback.Resolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	local.Answer = append(local.Answer, tresp.Answer...)
+	local.ResponseCode = tresp.ResponseCode
+	return local, nil
+}
+
+// nameservers returns the names of the servers of the zone a question's
+// name is within, by asking for the NS records of the name and each of its
+// parents in turn.
+func (r *RPZ) nameservers(ctx context.Context, q Question) []string {
+	name := canonicalName(q.Name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		nq := Question{DNSQuestion: secop.DNSQuestion{Name: name[off:], Type: dns.TypeNS}}
+		resp, err := r.fallback.Resolve(ctx, nq)
+		if err != nil {
+			log.Errorf("error finding nameservers of %v: %v", nq.Name, err)
+			return []string{}
+		}
+
+		var nameservers []string
+		for _, rr := range resp.Answer {
+			if rr.Type == dns.TypeNS {
+				nameservers = append(nameservers, canonicalName(rr.Data))
+			}
+		}
+		if len(nameservers) > 0 {
+			return nameservers
+		}
+	}
+
+	return []string{}
+}
+
+// Close stops watching policy zone files for changes.
+func (r *RPZ) Close() error {
+	r.watcher.close()
+
+	return nil
+}
+
+// reload reloads any policy zone files which have changed; a file which
+// fails to load keeps its previous policies.
+func (r *RPZ) reload() {
+	var reloaded bool
+	for _, f := range r.files {
+		changed, err := f.stamp.changed(f.Path)
+		if err != nil {
+			log.Errorf("error checking policy zone file %v: %v", f.Path, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		if err := f.load(); err != nil {
+			log.Errorf("error reloading policy zone file, keeping previous policies: %v", err)
+			continue
+		}
+		reloaded = true
+		log.Infof("reloaded policy zone %v from %v", f.zone.origin, f.Path)
+	}
+	if !reloaded {
+		return
+	}
+
+	var policies []*policyZone
+	for _, f := range r.files {
+		policies = append(policies, newPolicyZone(f.zone))
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.policies = policies
+}
+
+type rpzActionKind int
+
+const (
+	rpzActionNXDomain rpzActionKind = iota
+	rpzActionNoData
+	rpzActionPassthru
+	rpzActionDrop
+	rpzActionLocalData
+)
+
+// rpzAction is the action of a triggered policy.
+type rpzAction struct {
+	kind rpzActionKind
+	// data holds the records of local data
+	data []dns.RR
+	// owner is the name of the policy's records in its zone
+	owner string
+}
+
+func (a *rpzAction) String() string {
+	return a.owner
+}
+
+// policyZone holds the triggers of a response policy zone.
+type policyZone struct {
+	zone *Zone
+	// ips holds the owners of response IP triggers, by the length of their
+	// prefix and then the masked address
+	ips map[int]map[string]string
+	// hasNSDNames is set when the zone has NSDNAME triggers, so that the
+	// nameservers of a name need only be found when they're used
+	hasNSDNames bool
+}
+
+// newPolicyZone finds the triggers of a policy zone; triggers which can't be
+// understood are ignored.
+func newPolicyZone(z *Zone) *policyZone {
+	p := &policyZone{zone: z, ips: make(map[int]map[string]string)}
+
+	ipSuffix := rpzIP + "." + z.origin
+	nsdSuffix := rpzNSDName + "." + z.origin
+	for owner := range z.records {
+		switch {
+		case strings.HasSuffix(owner, "."+ipSuffix):
+			network, err := parseRPZIP(strings.TrimSuffix(owner, "."+ipSuffix))
+			if err != nil {
+				log.Warnf("ignoring response IP trigger %v: %v", owner, err)
+				continue
+			}
+			ones, _ := network.Mask.Size()
+			if p.ips[ones] == nil {
+				p.ips[ones] = make(map[string]string)
+			}
+			p.ips[ones][network.IP.String()] = owner
+		case strings.HasSuffix(owner, "."+nsdSuffix):
+			p.hasNSDNames = true
+		}
+	}
+
+	return p
+}
+
+// qname returns the action of the QNAME trigger for name, if any.
+func (p *policyZone) qname(name string) *rpzAction {
+	return p.nameTrigger(canonicalName(name), p.zone.origin)
+}
+
+// nsdname returns the action of the first NSDNAME trigger for any of the
+// nameservers, if any.
+func (p *policyZone) nsdname(nameservers []string) *rpzAction {
+	for _, ns := range nameservers {
+		if a := p.nameTrigger(ns, rpzNSDName+"."+p.zone.origin); a != nil {
+			return a
+		}
+	}
+
+	return nil
+}
+
+// nameTrigger returns the action of the trigger for a name under suffix: an
+// exact match, or otherwise the wildcard of the closest parent.
+func (p *policyZone) nameTrigger(name, suffix string) *rpzAction {
+	if name == "." {
+		return nil
+	}
+	if a := p.action(name + suffix); a != nil {
+		return a
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if a := p.action("*." + name[off:] + suffix); a != nil {
+			return a
+		}
+	}
+
+	return nil
+}
+
+// responseIP returns the action of the response IP trigger with the longest
+// prefix matching any address in the answer of a response, if any.
+func (p *policyZone) responseIP(resp *Response) *rpzAction {
+	if len(p.ips) == 0 {
+		return nil
+	}
+
+	var best string
+	bestLen := -1
+	for _, rr := range resp.Answer {
+		if rr.Type != dns.TypeA && rr.Type != dns.TypeAAAA {
+			continue
+		}
+		ip := net.ParseIP(rr.Data)
+		if ip == nil {
+			continue
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+
+		for ones, networks := range p.ips {
+			if ones > bits || ones <= bestLen {
+				continue
+			}
+			masked := ip.Mask(net.CIDRMask(ones, bits))
+			if owner, ok := networks[masked.String()]; ok {
+				best, bestLen = owner, ones
+			}
+		}
+	}
+	if best == "" {
+		return nil
+	}
+
+	return p.action(best)
+}
+
+// action returns the action of the policy records at owner, if any.
+func (p *policyZone) action(owner string) *rpzAction {
+	rrs, ok := p.zone.records[owner]
+	if !ok {
+		return nil
+	}
+
+	a := &rpzAction{kind: rpzActionLocalData, owner: owner}
+	for _, rr := range rrs {
+		if c, ok := rr.(*dns.CNAME); ok {
+			switch canonicalName(c.Target) {
+			case rpzNXDomain:
+				a.kind = rpzActionNXDomain
+			case rpzNoData:
+				a.kind = rpzActionNoData
+			case rpzPassthru:
+				a.kind = rpzActionPassthru
+			case rpzDrop:
+				a.kind = rpzActionDrop
+			}
+			if a.kind != rpzActionLocalData {
+				return a
+			}
+		}
+		a.data = append(a.data, rr)
+	}
+
+	return a
+}
+
+// parseRPZIP parses the network of a response IP trigger, given as the
+// prefix length followed by the address with its labels reversed, such as
+// "24.0.2.0.192" for 192.0.2.0/24. IPv6 addresses are written as groups of
+// 16 bits, with "zz" standing for the longest run of zeroes, such as
+// "48.zz.1.db8.2001" for 2001:db8:1::/48.
+func parseRPZIP(trigger string) (*net.IPNet, error) {
+	labels := strings.Split(trigger, ".")
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("invalid trigger")
+	}
+	ones, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, err
+	}
+
+	parts := labels[1:]
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+
+	var address string
+	bits := 32
+	if len(parts) == 4 && !strings.Contains(trigger, "zz") && !strings.ContainsAny(trigger, "abcdef") {
+		address = strings.Join(parts, ".")
+	} else {
+		bits = 128
+		address = strings.Replace(strings.Join(parts, ":"), "zz", "", 1)
+		if strings.HasPrefix(address, ":") {
+			address = ":" + address
+		}
+		if strings.HasSuffix(address, ":") {
+			address += ":"
+		}
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil || ones < 0 || ones > bits {
+		return nil, fmt.Errorf("invalid address %v", address)
+	}
+	if bits == 32 {
+		ip = ip.To4()
+	}
+	mask := net.CIDRMask(ones, bits)
+	if !ip.Mask(mask).Equal(ip) {
+		return nil, fmt.Errorf("address %v has bits set beyond its prefix", address)
+	}
+
+	return &net.IPNet{IP: ip, Mask: mask}, nil
+}
@@ -0,0 +1,339 @@
+package reverseoperator
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+const testPolicyZone = `$ORIGIN rpz.test.
+$TTL 300
+@                         SOA   localhost. hostmaster 1 3600 600 86400 60
+@                         NS    localhost.
+
+; QNAME triggers
+nx.example.com            CNAME .
+*.nx.example.com          CNAME .
+pass.nx.example.com       CNAME rpz-passthru.
+nodata.example.com        CNAME *.
+drop.example.com          CNAME rpz-drop.
+walled.example.com        CNAME walled-garden.example.net.
+local.example.com         A     192.0.2.66
+local.example.com         TXT   "local"
+
+; response IP triggers
+24.0.100.51.198.rpz-ip    CNAME .
+32.7.100.51.198.rpz-ip    CNAME rpz-passthru.
+32.10.2.0.192.rpz-ip      A     192.0.2.200
+128.1.zz.db8.2001.rpz-ip  CNAME *.
+
+; NSDNAME triggers
+ns.evil.example.rpz-nsdname     CNAME .
+*.bad-ns.example.rpz-nsdname    CNAME rpz-drop.
+`
+
+// policyFallback answers A and AAAA questions from a table of addresses, and
+// NS questions from a table of nameservers.
+func policyFallback() *funcResolver {
+	addresses := map[string]string{
+		"pass.nx.example.com.":       "192.0.2.1",
+		"walled-garden.example.net.": "192.0.2.250",
+		"clean.example.com.":         "192.0.2.2",
+		"badnet.example.com.":        "198.51.100.5",
+		"goodhost.example.com.":      "198.51.100.7",
+		"rewrite.example.com.":       "192.0.2.10",
+		"v6.example.com.":            "2001:db8::1",
+		"www.evilzone.example.":      "192.0.2.3",
+		"www.dropzone.example.":      "192.0.2.4",
+		"www.goodzone.example.":      "192.0.2.5",
+	}
+	nameservers := map[string]string{
+		"evilzone.example.": "ns.evil.example.",
+		"dropzone.example.": "a.b.bad-ns.example.",
+		"goodzone.example.": "ns.good.example.",
+	}
+
+	return &funcResolver{resolve: func(q Question) (*Response, error) {
+		name := canonicalName(q.Name)
+		resp := &Response{DNSResponse: secop.DNSResponse{
+			Question: []secop.DNSQuestion{q.DNSQuestion},
+		}}
+		data, ok := addresses[name]
+		if q.Type == dns.TypeNS {
+			data, ok = nameservers[name]
+		}
+		if ok {
+			resp.Answer = []secop.DNSRR{{Name: name, Type: q.Type, TTL: 60, Data: data}}
+		}
+		return resp, nil
+	}}
+}
+
+func writePolicyZone(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "rpz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "rpz.zone")
+	writeZoneFile(t, path, content)
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestRPZ(t *testing.T) {
+	path, cleanup := writePolicyZone(t, testPolicyZone)
+	defer cleanup()
+
+	r, err := NewRPZ(policyFallback(), []ZoneFile{{Path: path}}, &RPZOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, c := range []struct {
+		name     string
+		qtype    uint16
+		rcode    int
+		expected []string
+	}{
+		// QNAME triggers
+		{"nx.example.com", dns.TypeA, dns.RcodeNameError, []string{}},
+		{"a.b.nx.example.com", dns.TypeA, dns.RcodeNameError, []string{}},
+		{"pass.nx.example.com", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.1"}},
+		{"nodata.example.com", dns.TypeA, dns.RcodeSuccess, []string{}},
+		{"walled.example.com", dns.TypeA, dns.RcodeSuccess, []string{"walled-garden.example.net.", "192.0.2.250"}},
+		{"walled.example.com", dns.TypeCNAME, dns.RcodeSuccess, []string{"walled-garden.example.net."}},
+		{"local.example.com", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.66"}},
+		{"LOCAL.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{`"local"`}},
+		{"local.example.com", dns.TypeMX, dns.RcodeSuccess, []string{}},
+		{"clean.example.com", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.2"}},
+		// a wildcard doesn't match the name it is under
+		{"example.com", dns.TypeA, dns.RcodeSuccess, []string{}},
+
+		// response IP triggers, where the longest prefix wins
+		{"badnet.example.com", dns.TypeA, dns.RcodeNameError, []string{}},
+		{"goodhost.example.com", dns.TypeA, dns.RcodeSuccess, []string{"198.51.100.7"}},
+		{"rewrite.example.com", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.200"}},
+		{"v6.example.com", dns.TypeAAAA, dns.RcodeSuccess, []string{}},
+
+		// NSDNAME triggers
+		{"www.evilzone.example", dns.TypeA, dns.RcodeNameError, []string{}},
+		{"www.goodzone.example", dns.TypeA, dns.RcodeSuccess, []string{"192.0.2.5"}},
+	} {
+		resp, err := r.Resolve(context.Background(), question(c.name, c.qtype))
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if resp.ResponseCode != c.rcode {
+			t.Errorf("%v[%v]: expected rcode %v, got %v", c.name, c.qtype, c.rcode, resp.ResponseCode)
+		}
+		data := []string{}
+		for _, a := range resp.Answer {
+			data = append(data, a.Data)
+		}
+		if !reflect.DeepEqual(data, c.expected) {
+			t.Errorf("%v[%v]: expected %v, got %v", c.name, c.qtype, c.expected, data)
+		}
+	}
+
+	for _, name := range []string{"drop.example.com", "www.dropzone.example"} {
+		if _, err := r.Resolve(context.Background(), question(name, dns.TypeA)); err != ErrDropped {
+			t.Errorf("%v: expected to be dropped, got %v", name, err)
+		}
+	}
+}
+
+func TestRPZComment(t *testing.T) {
+	path, cleanup := writePolicyZone(t, testPolicyZone)
+	defer cleanup()
+
+	r, err := NewRPZ(policyFallback(), []ZoneFile{{Path: path}}, &RPZOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	resp, err := r.Resolve(context.Background(), question("a.nx.example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Rewritten by policy *.nx.example.com.rpz.test."; resp.Comment != expected {
+		t.Errorf("expected comment %q, got %q", expected, resp.Comment)
+	}
+
+	resp, err = r.Resolve(context.Background(), question("pass.nx.example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Comment != "" {
+		t.Errorf("expected no comment when passed through, got %q", resp.Comment)
+	}
+}
+
+func TestRPZPrecedence(t *testing.T) {
+	first, cleanup := writePolicyZone(t, `$ORIGIN first.test.
+@ 60 SOA localhost. hostmaster 1 3600 600 86400 60
+blocked.example.com 60 CNAME rpz-passthru.
+`)
+	defer cleanup()
+	second, cleanupSecond := writePolicyZone(t, `$ORIGIN second.test.
+@ 60 SOA localhost. hostmaster 1 3600 600 86400 60
+blocked.example.com 60 CNAME .
+other.example.com 60 CNAME .
+`)
+	defer cleanupSecond()
+
+	fallback := answerResolver(60)
+	r, err := NewRPZ(fallback, []ZoneFile{{Path: first}, {Path: second}}, &RPZOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if data := answerData(t, r, "blocked.example.com", dns.TypeA); !reflect.DeepEqual(data, []string{"127.0.0.1"}) {
+		t.Errorf("expected the first zone to pass the name through, got %v", data)
+	}
+	resp, err := r.Resolve(context.Background(), question("other.example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeNameError {
+		t.Errorf("expected the second zone to apply, got rcode %v", resp.ResponseCode)
+	}
+}
+
+func TestRPZPrecedenceAcrossTriggers(t *testing.T) {
+	first, cleanup := writePolicyZone(t, `$ORIGIN first.test.
+@ 60 SOA localhost. hostmaster 1 3600 600 86400 60
+24.0.100.51.198.rpz-ip 60 CNAME .
+`)
+	defer cleanup()
+	second, cleanupSecond := writePolicyZone(t, `$ORIGIN second.test.
+@ 60 SOA localhost. hostmaster 1 3600 600 86400 60
+badnet.example.com 60 A 192.0.2.99
+clean.example.com 60 A 192.0.2.98
+`)
+	defer cleanupSecond()
+
+	r, err := NewRPZ(policyFallback(), []ZoneFile{{Path: first}, {Path: second}}, &RPZOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// the response IP trigger of the first zone beats the QNAME trigger of
+	// the second
+	resp, err := r.Resolve(context.Background(), question("badnet.example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeNameError {
+		t.Errorf("expected the first zone to apply, got rcode %v and %v", resp.ResponseCode, resp.Answer)
+	}
+
+	// but the second zone applies where the first isn't triggered
+	if data := answerData(t, r, "clean.example.com", dns.TypeA); !reflect.DeepEqual(data, []string{"192.0.2.98"}) {
+		t.Errorf("expected the second zone to apply, got %v", data)
+	}
+}
+
+func TestRPZReload(t *testing.T) {
+	path, cleanup := writePolicyZone(t, testPolicyZone)
+	defer cleanup()
+
+	r, err := NewRPZ(policyFallback(), []ZoneFile{{Path: path}}, &RPZOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	writeZoneFile(t, path, testPolicyZone+"clean.example.com CNAME .\n")
+	r.reload()
+	resp, err := r.Resolve(context.Background(), question("clean.example.com", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ResponseCode != dns.RcodeNameError {
+		t.Errorf("expected the new policy to apply, got rcode %v", resp.ResponseCode)
+	}
+}
+
+func TestRPZHandlerDrop(t *testing.T) {
+	path, cleanup := writePolicyZone(t, testPolicyZone)
+	defer cleanup()
+
+	r, err := NewRPZ(policyFallback(), []ZoneFile{{Path: path}}, &RPZOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	h := NewHandler(NewResolverProvider(r), &HandlerOptions{})
+
+	b, err := questionToMsg(question("drop.example.com", dns.TypeA)).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{
+		"/resolve?name=drop.example.com&type=A",
+		"/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(b),
+	} {
+		func() {
+			defer func() {
+				if p := recover(); p != http.ErrAbortHandler {
+					t.Errorf("%v: expected the response to be abandoned, got %v", target, p)
+				}
+			}()
+
+			handle := h.Handle
+			if target[1] == 'd' {
+				handle = h.HandleDNSMessage
+			}
+			handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+		}()
+	}
+}
+
+func TestParseRPZIP(t *testing.T) {
+	for trigger, expected := range map[string]string{
+		"32.1.2.0.192":             "192.0.2.1/32",
+		"24.0.2.0.192":             "192.0.2.0/24",
+		"8.0.0.0.10":               "10.0.0.0/8",
+		"128.1.zz.db8.2001":        "2001:db8::1/128",
+		"48.zz.1.db8.2001":         "2001:db8:1::/48",
+		"128.1.zz":                 "::1/128",
+		"64.0.0.0.0.0.0.0.fd00":    "fd00::/64",
+		"128.1.0.0.0.0.0.db8.2001": "2001:db8::1/128",
+	} {
+		network, err := parseRPZIP(trigger)
+		if err != nil {
+			t.Errorf("%v: %v", trigger, err)
+			continue
+		}
+		if network.String() != expected {
+			t.Errorf("%v: expected %v, got %v", trigger, expected, network)
+		}
+	}
+
+	for _, trigger := range []string{
+		"32",
+		"x.1.2.0.192",
+		"33.1.2.0.192",
+		"24.1.2.0.192",
+		"32.1.2.192",
+	} {
+		if _, err := parseRPZIP(trigger); err == nil {
+			t.Errorf("%v: expected an error", trigger)
+		}
+	}
+}
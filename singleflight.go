@@ -0,0 +1,85 @@
+package reverseoperator
+
+import (
+	"context"
+	"sync"
+)
+
+// flightGroup deduplicates concurrent resolutions of the same question, so
+// that one upstream query satisfies every caller waiting on it.
+type flightGroup struct {
+	mutex   sync.Mutex
+	flights map[questionKey]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	resp *Response
+	err  error
+	// waiters is the number of callers still waiting on this flight; once
+	// every one has given up, the flight is cancelled
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do calls fn, unless a call for the same key is already in flight, in which
+// case it waits for and returns that call's result instead; shared reports
+// whether the result came from another caller's call.
+//
+// The call outlives any one caller's context, as others may be waiting on
+// it; a caller whose context is done stops waiting, and the call's context is
+// cancelled only once no callers are waiting.
+func (g *flightGroup) do(ctx context.Context, key questionKey, fn func(context.Context) (*Response, error)) (resp *Response, err error, shared bool) {
+	g.mutex.Lock()
+	if g.flights == nil {
+		g.flights = make(map[questionKey]*flight)
+	}
+	f, shared := g.flights[key]
+	if shared {
+		f.waiters++
+	} else {
+		fctx, cancel := context.WithCancel(context.Background())
+		f = &flight{
+			done:    make(chan struct{}),
+			waiters: 1,
+			cancel:  cancel,
+		}
+		g.flights[key] = f
+
+		go func() {
+			f.resp, f.err = fn(fctx)
+
+			g.mutex.Lock()
+			g.forget(key, f)
+			g.mutex.Unlock()
+
+			cancel()
+			close(f.done)
+		}()
+	}
+	g.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.resp, f.err, shared
+	case <-ctx.Done():
+	}
+
+	g.mutex.Lock()
+	if f.waiters--; f.waiters == 0 {
+		// a new caller must start a new flight, rather than join one which
+		// is being cancelled
+		g.forget(key, f)
+		f.cancel()
+	}
+	g.mutex.Unlock()
+
+	return nil, ctx.Err(), shared
+}
+
+// forget removes a flight, unless it has already been replaced by another.
+func (g *flightGroup) forget(key questionKey, f *flight) {
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
@@ -0,0 +1,170 @@
+package reverseoperator
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+func TestDNSProviderCoalescesQueries(t *testing.T) {
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	var exchanges int
+	defer mockExchange(func(m *dns.Msg) *dns.Msg {
+		mutex.Lock()
+		exchanges++
+		mutex.Unlock()
+
+		<-release
+		r := new(dns.Msg)
+		r.SetReply(m)
+		return r
+	})()
+
+	p, err := NewDNSProvider(secop.Endpoints{secop.Endpoint{Port: 53}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := question("example.com", dns.TypeA)
+	key := newQuestionKey(q)
+
+	const waiters = 5
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Resolve(context.Background(), q); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// wait for every caller to have joined the flight before letting it land
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.flights.mutex.Lock()
+		f, ok := p.flights.flights[key]
+		joined := ok && f.waiters == waiters
+		p.flights.mutex.Unlock()
+
+		if joined {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for callers to join flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if exchanges != 1 {
+		t.Errorf("expected exactly one exchange, got %v", exchanges)
+	}
+	stats := p.Stats()
+	if stats.Queries != waiters {
+		t.Errorf("unexpected query count %v", stats.Queries)
+	}
+	if stats.Coalesced != waiters-1 {
+		t.Errorf("unexpected coalesced count %v", stats.Coalesced)
+	}
+
+	// once landed, a new question gets its own flight
+	if _, err := p.Resolve(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	if exchanges != 2 {
+		t.Errorf("expected a second exchange, got %v", exchanges)
+	}
+}
+
+func TestFlightGroupCallerCancelled(t *testing.T) {
+	var g flightGroup
+	key := newQuestionKey(question("example.com", dns.TypeA))
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	fn := func(ctx context.Context) (*Response, error) {
+		close(started)
+		<-release
+		return &Response{}, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, err, _ := g.do(ctx, key, fn)
+		errs <- err
+	}()
+	<-started
+
+	results := make(chan error)
+	go func() {
+		_, err, _ := g.do(context.Background(), key, fn)
+		results <- err
+	}()
+
+	// wait for the second caller to join
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		g.mutex.Lock()
+		joined := g.flights[key].waiters == 2
+		g.mutex.Unlock()
+		if joined {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for caller to join flight")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("expected the cancelled caller to stop waiting, got %v", err)
+	}
+
+	// the flight continues for the caller still waiting on it
+	close(release)
+	if err := <-results; err != nil {
+		t.Errorf("expected the flight to complete, got %v", err)
+	}
+}
+
+func TestFlightGroupAllCancelled(t *testing.T) {
+	var g flightGroup
+	key := newQuestionKey(question("example.com", dns.TypeA))
+
+	cancelled := make(chan struct{})
+	fn := func(ctx context.Context) (*Response, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err, _ := g.do(ctx, key, fn); err != context.Canceled {
+		t.Errorf("expected the caller to be cancelled, got %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the flight to be cancelled once no one waited on it")
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.flights[key]; ok {
+		t.Error("expected the cancelled flight to be forgotten")
+	}
+}
@@ -0,0 +1,143 @@
+package reverseoperator
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy is how a DNSProvider chooses which of its servers to query.
+type Strategy int
+
+const (
+	// StrategyRandom chooses a server at random
+	StrategyRandom Strategy = iota
+	// StrategyRoundRobin chooses each server in turn
+	StrategyRoundRobin
+	// StrategyPriority chooses the first server in the order configured,
+	// using later servers only when earlier ones are unhealthy or have failed
+	StrategyPriority
+	// StrategyWeighted chooses a server at random, in proportion to its
+	// configured weight
+	StrategyWeighted
+	// StrategyFastest chooses the server with the lowest moving average
+	// response time
+	StrategyFastest
+)
+
+var strategyNames = map[Strategy]string{
+	StrategyRandom:     "random",
+	StrategyRoundRobin: "round-robin",
+	StrategyPriority:   "priority",
+	StrategyWeighted:   "weighted",
+	StrategyFastest:    "fastest",
+}
+
+func (s Strategy) String() string {
+	if n, ok := strategyNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// ParseStrategy parses the name of a Strategy, as returned by its String
+// method.
+func ParseStrategy(name string) (Strategy, error) {
+	for s, n := range strategyNames {
+		if n == name {
+			return s, nil
+		}
+	}
+
+	var names []string
+	for _, n := range strategyNames {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return 0, fmt.Errorf("strategy must be one of %v", strings.Join(names, ", "))
+}
+
+const (
+	// latencyWeight is how much each new response time counts toward a
+	// server's moving average
+	latencyWeight = 0.3
+	// fastestExplore is how often StrategyFastest chooses a server at random
+	// instead, so that servers which have since become faster are noticed
+	fastestExplore = 0.05
+)
+
+// choose picks one of the candidate servers for a query according to the
+// provider's strategy; candidates are in the order configured.
+func (c *DNSProvider) choose(candidates []*upstream) *upstream {
+	switch c.opts.Strategy {
+	case StrategyRoundRobin:
+		// rotate through every server, skipping those which aren't
+		// candidates, so that skipping one doesn't disturb the rotation
+		next := int((atomic.AddUint64(&c.next, 1) - 1) % uint64(len(c.upstreams)))
+		for _, u := range candidates {
+			if u.index >= next {
+				return u
+			}
+		}
+		return candidates[0]
+	case StrategyPriority:
+		return candidates[0]
+	case StrategyWeighted:
+		total := 0
+		for _, u := range candidates {
+			total += c.weight(u)
+		}
+		n := rand.Intn(total)
+		for _, u := range candidates {
+			if n -= c.weight(u); n < 0 {
+				return u
+			}
+		}
+	case StrategyFastest:
+		if rand.Float64() < fastestExplore {
+			break
+		}
+
+		fastest := candidates[0]
+		for _, u := range candidates[1:] {
+			if u.latency() < fastest.latency() {
+				fastest = u
+			}
+		}
+		return fastest
+	}
+
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// weight returns a server's configured weight, or 1 if it has none.
+func (c *DNSProvider) weight(u *upstream) int {
+	if w, ok := c.opts.Weights[u.address]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+// observe records how long the server took to respond to a query.
+func (u *upstream) observe(d time.Duration) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.rtt == 0 {
+		u.rtt = d
+		return
+	}
+	u.rtt = time.Duration(latencyWeight*float64(d) + (1-latencyWeight)*float64(u.rtt))
+}
+
+// latency returns the moving average of the server's response times; servers
+// which haven't yet responded have none, so are preferred until measured.
+func (u *upstream) latency() time.Duration {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.rtt
+}
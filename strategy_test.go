@@ -0,0 +1,165 @@
+package reverseoperator
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// countQueries mocks exchange, answering every query and counting those sent
+// to each server; servers in failing return errors.
+func countQueries(failing ...string) (map[string]int, func()) {
+	var mutex sync.Mutex
+	calls := make(map[string]int)
+
+	restore := mockExchangeAddr(func(m *dns.Msg, address string) (*dns.Msg, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		calls[address]++
+		for _, f := range failing {
+			if address == f {
+				return nil, errTestUpstream
+			}
+		}
+		return reply(m, dns.RcodeSuccess), nil
+	})
+
+	return calls, restore
+}
+
+func queryN(t *testing.T, p *DNSProvider, n int) {
+	for i := 0; i < n; i++ {
+		if _, err := p.Query(secop.DNSQuestion{Name: "example.com", Type: dns.TypeA}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStrategyRoundRobin(t *testing.T) {
+	calls, restore := countQueries()
+	defer restore()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2", "10.0.0.3"), &DNSProviderOptions{
+		Strategy: StrategyRoundRobin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryN(t, p, 9)
+
+	for _, a := range []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"} {
+		if c := calls[a]; c != 3 {
+			t.Errorf("expected 3 queries to %v, got %v", a, c)
+		}
+	}
+}
+
+func TestStrategyPriority(t *testing.T) {
+	calls, restore := countQueries("10.0.0.1:53")
+	defer restore()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2", "10.0.0.3"), &DNSProviderOptions{
+		Strategy: StrategyPriority,
+		Health:   &HealthOptions{MaxFailures: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryN(t, p, 10)
+
+	// the first server fails, so the second is used while it's ejected
+	if c := calls["10.0.0.1:53"]; c != 1 {
+		t.Errorf("expected 1 query to the failing server, got %v", c)
+	}
+	if c := calls["10.0.0.2:53"]; c != 10 {
+		t.Errorf("expected 10 queries to the next server, got %v", c)
+	}
+	if c := calls["10.0.0.3:53"]; c != 0 {
+		t.Errorf("expected no queries to the last server, got %v", c)
+	}
+}
+
+func TestStrategyWeighted(t *testing.T) {
+	calls, restore := countQueries()
+	defer restore()
+
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2"), &DNSProviderOptions{
+		Strategy: StrategyWeighted,
+		Weights:  map[string]int{"10.0.0.1:53": 9},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryN(t, p, 1000)
+
+	// 900 are expected; allow plenty of room for chance
+	if c := calls["10.0.0.1:53"]; c < 800 || c == 1000 {
+		t.Errorf("expected ~900 queries to the heavier server, got %v", c)
+	}
+}
+
+func TestStrategyFastest(t *testing.T) {
+	p, err := NewDNSProvider(testEndpoints("10.0.0.1", "10.0.0.2", "10.0.0.3"), &DNSProviderOptions{
+		Strategy: StrategyFastest,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.upstreams[0].observe(50 * time.Millisecond)
+	p.upstreams[1].observe(5 * time.Millisecond)
+	p.upstreams[2].observe(80 * time.Millisecond)
+
+	// choose directly, as queries would observe their own response times
+	calls := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		calls[p.choose(p.upstreams).address]++
+	}
+
+	// a few queries explore the others
+	if c := calls["10.0.0.2:53"]; c < 900 {
+		t.Errorf("expected most queries to the fastest server, got %v", c)
+	}
+	if c := calls["10.0.0.1:53"] + calls["10.0.0.3:53"]; c == 0 {
+		t.Error("expected some queries to explore slower servers")
+	}
+}
+
+func TestUpstreamObserve(t *testing.T) {
+	u := &upstream{}
+	u.observe(100 * time.Millisecond)
+	if l := u.latency(); l != 100*time.Millisecond {
+		t.Errorf("expected first sample to be used as-is, got %v", l)
+	}
+
+	u.observe(200 * time.Millisecond)
+	if l := u.latency(); l != 130*time.Millisecond {
+		t.Errorf("expected 130ms, got %v", l)
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	for s, n := range strategyNames {
+		p, err := ParseStrategy(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != s {
+			t.Errorf("expected %v, got %v", s, p)
+		}
+		if p.String() != n {
+			t.Errorf("expected %v, got %v", n, p.String())
+		}
+	}
+
+	if _, err := ParseStrategy("fastest-ever"); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+}
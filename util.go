@@ -1,7 +1,9 @@
 package reverseoperator
 
 import (
+	"encoding/base64"
 	"errors"
+	"net"
 	"net/url"
 	"strconv"
 	"strings"
@@ -16,9 +18,17 @@ var (
 	errNameFragmentInvalid = errors.New("length of fragment in name parameter must be between 1 and 63")
 	errTypeInvalid         = errors.New("type could not be mapped to a valid DNS record type")
 	errTypeOutOfRange      = errors.New("type was not within valid bounds 1 < x < 65535")
+	errCDInvalid           = errors.New("cd parameter must be a boolean")
+	errDOInvalid           = errors.New("do parameter must be a boolean")
+	errDNSInvalid          = errors.New("dns parameter must be a base64url encoded DNS message")
+	errDNSQuestionCount    = errors.New("DNS message must contain exactly one question")
+	errDNSFormat           = errors.New("DNS message is malformed")
 )
 
-func urlToDNSQuestion(url *url.URL) (*secop.DNSQuestion, error) {
+// urlToDNSQuestion parses the parameters of a Google API request. Clients may
+// also send `random_padding` to disguise the length of their request; it
+// carries no meaning, but asks for the response to be padded in turn.
+func urlToDNSQuestion(url *url.URL) (*Question, error) {
 	v := url.Query()
 
 	name := v.Get("name")
@@ -45,14 +55,185 @@ func urlToDNSQuestion(url *url.URL) (*secop.DNSQuestion, error) {
 		rtype = uint16(rt)
 	}
 
-	return &secop.DNSQuestion{
-		Name: name,
-		Type: uint16(rtype),
+	cd, err := parseBoolParam(v.Get("cd"))
+	if err != nil {
+		return nil, errCDInvalid
+	}
+	do, err := parseBoolParam(v.Get("do"))
+	if err != nil {
+		return nil, errDOInvalid
+	}
+
+	var ecs *net.IPNet
+	if p := v.Get("edns_client_subnet"); p != "" {
+		if ecs, err = parseClientSubnet(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Question{
+		DNSQuestion: secop.DNSQuestion{
+			Name: name,
+			Type: uint16(rtype),
+		},
+		CheckingDisabled: cd,
+		DNSSECOK:         do,
+		ClientSubnet:     ecs,
 	}, nil
 }
 
-func fromDNStoGDNS(d *secop.DNSResponse) *secop.GDNSResponse {
-	return &secop.GDNSResponse{
+// parseBoolParam parses a boolean query parameter, where a missing parameter
+// is false; Google's API documents `1` and `true`, but strconv is lenient.
+func parseBoolParam(p string) (bool, error) {
+	if p == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(p)
+}
+
+// urlToDNSMsg decodes the RFC 8484 `dns` parameter of a GET request into a
+// DNS message.
+func urlToDNSMsg(url *url.URL) (*dns.Msg, error) {
+	// the parameter is specified as unpadded base64url, but be lenient with
+	// clients which send padding anyway
+	p := strings.TrimRight(url.Query().Get("dns"), "=")
+	if p == "" {
+		return nil, errDNSInvalid
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errDNSInvalid
+	}
+
+	return bytesToDNSMsg(b)
+}
+
+// bytesToDNSMsg unpacks a request message. A message which is malformed
+// beyond its question, such as by an invalid EDNS option, is returned with
+// only its header and question, along with errDNSFormat, so that it may be
+// answered with FORMERR.
+func bytesToDNSMsg(b []byte) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		if len(m.Question) != 1 {
+			return nil, errDNSInvalid
+		}
+		m.Answer, m.Ns, m.Extra = nil, nil, nil
+		return m, errDNSFormat
+	}
+	if len(m.Question) != 1 {
+		return nil, errDNSQuestionCount
+	}
+
+	return m, nil
+}
+
+func dnsMsgToQuestion(m *dns.Msg) (*Question, error) {
+	opt := m.IsEdns0()
+
+	q := &Question{
+		DNSQuestion: secop.DNSQuestion{
+			Name: m.Question[0].Name,
+			Type: m.Question[0].Qtype,
+		},
+		CheckingDisabled: m.CheckingDisabled,
+		DNSSECOK:         opt != nil && opt.Do(),
+	}
+	if e := clientSubnetOption(opt); e != nil {
+		n, err := optionToClientSubnet(e, e.SourceNetmask)
+		if err != nil {
+			return nil, err
+		}
+		q.ClientSubnet = n
+	}
+
+	return q, nil
+}
+
+// fromDNStoDNSMsg builds a reply to the request message from a provider's
+// response; the reply carries the request's message ID.
+func fromDNStoDNSMsg(req *dns.Msg, d *Response) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Truncated = d.Truncated
+	m.Authoritative = d.Authoritative
+	m.RecursionDesired = d.RecursionDesired
+	m.RecursionAvailable = d.RecursionAvailable
+	m.AuthenticatedData = d.AuthenticatedData
+	m.CheckingDisabled = d.CheckingDisabled
+	m.Rcode = d.ResponseCode
+
+	var err error
+	if m.Answer, err = fromDNSRRsToRRs(d.Answer); err != nil {
+		return nil, err
+	}
+	if m.Ns, err = fromDNSRRsToRRs(d.Authority); err != nil {
+		return nil, err
+	}
+	if m.Extra, err = fromDNSRRsToRRs(d.Extra); err != nil {
+		return nil, err
+	}
+
+	// the client's EDNS0 options are echoed back, so that it sees its own
+	// buffer size and DO bit reflected in the reply; a client subnet option
+	// additionally carries the scope the answer is valid for
+	if opt := req.IsEdns0(); opt != nil {
+		o := *opt
+		o.Option = nil
+		for _, e := range opt.Option {
+			// the client's padding is only for its query, and the reply is
+			// padded separately if required
+			if _, ok := e.(*dns.EDNS0_PADDING); ok {
+				continue
+			}
+			if s, ok := e.(*dns.EDNS0_SUBNET); ok {
+				c := *s
+				c.SourceScope = 0
+				if d.ClientSubnet != nil {
+					ones, _ := d.ClientSubnet.Mask.Size()
+					c.SourceScope = uint8(ones)
+				}
+				e = &c
+			}
+			o.Option = append(o.Option, e)
+		}
+		m.Extra = append(m.Extra, &o)
+	}
+
+	return m, nil
+}
+
+func fromDNSRRsToRRs(d []secop.DNSRR) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, r := range d {
+		rr, err := r.DNSRR()
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// minTTL returns the lowest TTL of all records in a message, used to compute
+// how long a response may be cached by HTTP caches.
+func minTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if t := rr.Header().Ttl; !ok || t < ttl {
+				ttl, ok = t, true
+			}
+		}
+	}
+	return
+}
+
+func fromDNStoGDNS(d *Response) *secop.GDNSResponse {
+	g := &secop.GDNSResponse{
 		Status:     int32(d.ResponseCode),
 		TC:         d.Truncated,
 		RD:         d.RecursionDesired,
@@ -63,7 +244,13 @@ func fromDNStoGDNS(d *secop.DNSResponse) *secop.GDNSResponse {
 		Answer:     fromDNSRRsToGDNSRRs(d.Answer),
 		Authority:  fromDNSRRsToGDNSRRs(d.Authority),
 		Additional: fromDNSRRsToGDNSRRs(d.Extra),
+		Comment:    d.Comment,
 	}
+	if d.ClientSubnet != nil {
+		g.EDNSClientSubnet = clientSubnetString(d.ClientSubnet)
+	}
+
+	return g
 }
 
 func fromDNSRRsToGDNSRRs(d []secop.DNSRR) secop.GDNSRRs {
@@ -1,8 +1,11 @@
 package reverseoperator
 
 import (
+	"encoding/base64"
 	"net/url"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func TestURLToDNSQuestionValid(t *testing.T) {
@@ -49,6 +52,49 @@ func TestURLToDNSQuestionValidTypeString(t *testing.T) {
 	}
 }
 
+func TestURLToDNSQuestionFlags(t *testing.T) {
+	tests := []struct {
+		cd, do       string
+		expCD, expDO bool
+		expErr       error
+	}{
+		{"", "", false, false, nil},
+		{"1", "0", true, false, nil},
+		{"false", "true", false, true, nil},
+		{"wut", "", false, false, errCDInvalid},
+		{"", "wut", false, false, errDOInvalid},
+	}
+
+	for _, tt := range tests {
+		u := url.URL{}
+		v := u.Query()
+		v.Set("name", "example.com")
+		if tt.cd != "" {
+			v.Set("cd", tt.cd)
+		}
+		if tt.do != "" {
+			v.Set("do", tt.do)
+		}
+		u.RawQuery = v.Encode()
+
+		q, err := urlToDNSQuestion(&u)
+		if err != tt.expErr {
+			t.Errorf("unexpected error for cd=%v do=%v: %v", tt.cd, tt.do, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if q.CheckingDisabled != tt.expCD {
+			t.Errorf("unexpected cd for %v: %v", tt.cd, q.CheckingDisabled)
+		}
+		if q.DNSSECOK != tt.expDO {
+			t.Errorf("unexpected do for %v: %v", tt.do, q.DNSSECOK)
+		}
+	}
+}
+
 func TestURLToDNSQuestionBadName(t *testing.T) {
 	name := ""
 	typ := "1"
@@ -123,3 +169,65 @@ func TestURLToDNSQuestionTypeOutOfRange(t *testing.T) {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
+
+func TestURLToDNSMsgValid(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeMX)
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := url.URL{}
+	v := u.Query()
+	v.Set("dns", base64.RawURLEncoding.EncodeToString(b))
+	u.RawQuery = v.Encode()
+
+	q, err := urlToDNSMsg(&u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Id != m.Id {
+		t.Errorf("unexpected id %v", q.Id)
+	}
+	if n := q.Question[0].Name; n != "example.com." {
+		t.Errorf("unexpected name %v", n)
+	}
+	if y := q.Question[0].Qtype; y != dns.TypeMX {
+		t.Errorf("unexpected type %v", y)
+	}
+}
+
+func TestURLToDNSMsgBadEncoding(t *testing.T) {
+	u := url.URL{}
+	v := u.Query()
+	v.Set("dns", "!!!")
+	u.RawQuery = v.Encode()
+
+	_, err := urlToDNSMsg(&u)
+	if err != errDNSInvalid {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestURLToDNSMsgManyQuestions(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Question = append(m.Question, dns.Question{
+		Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := url.URL{}
+	v := u.Query()
+	v.Set("dns", base64.RawURLEncoding.EncodeToString(b))
+	u.RawQuery = v.Encode()
+
+	_, err = urlToDNSMsg(&u)
+	if err != errDNSQuestionCount {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package reverseoperator
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// watcher calls a function each interval, for resolvers to reload the files
+// they were loaded from when those change on disk.
+type watcher struct {
+	// reloads tracks the loop watching for changed files, which runs until
+	// stop is closed
+	reloads   sync.WaitGroup
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// newWatcher starts calling reload each interval, until the watcher is
+// closed; if the interval isn't positive, reload is never called.
+func newWatcher(interval time.Duration, reload func()) *watcher {
+	w := &watcher{stop: make(chan struct{})}
+	if interval > 0 {
+		w.reloads.Add(1)
+		go w.watch(interval, reload)
+	}
+
+	return w
+}
+
+// close stops calling reload, waiting for any call in progress to return.
+func (w *watcher) close() {
+	w.closeOnce.Do(func() {
+		close(w.stop)
+	})
+	w.reloads.Wait()
+}
+
+func (w *watcher) watch(interval time.Duration, reload func()) {
+	defer w.reloads.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		reload()
+	}
+}
+
+// fileStamp is the modification time and size of a file when it was loaded,
+// to tell when it has changed.
+type fileStamp struct {
+	modified time.Time
+	size     int64
+}
+
+func newFileStamp(info os.FileInfo) fileStamp {
+	return fileStamp{modified: info.ModTime(), size: info.Size()}
+}
+
+// changed reports whether the file at path differs from the stamp.
+func (s fileStamp) changed(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	return !info.ModTime().Equal(s.modified) || info.Size() != s.size, nil
+}
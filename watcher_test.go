@@ -0,0 +1,85 @@
+package reverseoperator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	reloads := make(chan struct{}, 1)
+	w := newWatcher(time.Millisecond, func() {
+		select {
+		case reloads <- struct{}{}:
+		default:
+		}
+	})
+
+	select {
+	case <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for reload")
+	}
+
+	w.close()
+	// closing again is harmless
+	w.close()
+
+	// drain a reload which raced with closing; none may follow it
+	select {
+	case <-reloads:
+	default:
+	}
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-reloads:
+		t.Error("expected no reloads once closed")
+	default:
+	}
+}
+
+func TestWatcherDisabled(t *testing.T) {
+	w := newWatcher(-1, func() {
+		t.Error("expected no reloads")
+	})
+	time.Sleep(10 * time.Millisecond)
+	w.close()
+}
+
+func TestFileStamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("one"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp := newFileStamp(info)
+
+	if changed, err := stamp.changed(path); err != nil || changed {
+		t.Errorf("expected file to be unchanged, got %v, %v", changed, err)
+	}
+
+	// a change of size is noticed, even within the modification time's
+	// resolution
+	if err := ioutil.WriteFile(path, []byte("three"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := stamp.changed(path); err != nil || !changed {
+		t.Errorf("expected file to be changed, got %v, %v", changed, err)
+	}
+
+	os.Remove(path)
+	if _, err := stamp.changed(path); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
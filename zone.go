@@ -0,0 +1,245 @@
+package reverseoperator
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain is the longest chain of CNAMEs followed when answering a
+// question, so that loops end
+const maxCNAMEChain = 8
+
+// ParseZone parses a zone from a master file, as described by RFC 1035. The
+// zone must have exactly one SOA record, whose owner is the zone's origin,
+// and every other record must be within it. Relative names are relative to
+// origin, unless the file sets its own with $ORIGIN.
+func ParseZone(r io.Reader, origin, filename string) (*Zone, error) {
+	z := &Zone{
+		records: make(map[string][]dns.RR),
+		names:   make(map[string]bool),
+	}
+
+	var err error
+	for t := range dns.ParseZone(r, dns.Fqdn(origin), filename) {
+		// the parser stops at its first error, but the channel must still
+		// be drained
+		if err != nil {
+			continue
+		}
+		if t.Error != nil {
+			err = t.Error
+			continue
+		}
+
+		name := canonicalName(t.RR.Header().Name)
+		if soa, ok := t.RR.(*dns.SOA); ok {
+			if z.soa != nil {
+				err = fmt.Errorf("%v: zone has more than one SOA record", filename)
+				continue
+			}
+			z.soa = soa
+			z.origin = name
+		}
+		z.records[name] = append(z.records[name], t.RR)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("%v: zone has no SOA record", filename)
+	}
+
+	for name := range z.records {
+		if !dns.IsSubDomain(z.origin, name) {
+			return nil, fmt.Errorf("%v: %v is outside of zone %v", filename, name, z.origin)
+		}
+
+		// every name between a record's owner and the origin exists, even
+		// if it has no records of its own
+		for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+			z.names[name[off:]] = true
+			if name[off:] == z.origin {
+				break
+			}
+		}
+	}
+
+	return z, nil
+}
+
+// Zone is an in-memory authoritative zone.
+type Zone struct {
+	origin string
+	soa    *dns.SOA
+	// records holds the records of each name, keyed by its canonical form
+	records map[string][]dns.RR
+	// names holds every name which exists in the zone, including empty
+	// non-terminals
+	names map[string]bool
+}
+
+// Origin returns the name of the zone's apex.
+func (z *Zone) Origin() string {
+	return z.origin
+}
+
+// lookup answers a question from the zone, following the rules of RFC 1034
+// section 4.3.2. If the answer is a CNAME to a name outside of the zone,
+// that name is returned as chase, for the caller to continue with.
+func (z *Zone) lookup(qname string, qtype uint16) (m *dns.Msg, chase string) {
+	m = new(dns.Msg)
+	m.Authoritative = true
+
+	for i := 0; i < maxCNAMEChain; i++ {
+		name := canonicalName(qname)
+
+		// below a zone cut, the zone only knows who to ask
+		if cut := z.delegation(name); cut != "" {
+			if i == 0 {
+				m.Authoritative = false
+				m.Ns = filterRRs(z.records[cut], dns.TypeNS)
+				m.Extra = z.glue(m.Ns)
+			}
+			return m, ""
+		}
+
+		rrs, ok := z.records[name]
+		if !ok && !z.names[name] {
+			rrs, ok = z.wildcard(qname, name)
+		}
+		if !ok && !z.names[name] {
+			m.Rcode = dns.RcodeNameError
+			m.Ns = []dns.RR{z.negativeSOA()}
+			return m, ""
+		}
+
+		if qtype != dns.TypeCNAME && qtype != dns.TypeANY {
+			if cname := filterRRs(rrs, dns.TypeCNAME); len(cname) > 0 {
+				m.Answer = append(m.Answer, cname...)
+				qname = cname[0].(*dns.CNAME).Target
+				if !dns.IsSubDomain(z.origin, canonicalName(qname)) {
+					return m, qname
+				}
+				continue
+			}
+		}
+
+		answer := rrs
+		if qtype != dns.TypeANY {
+			answer = filterRRs(rrs, qtype)
+		}
+		if len(answer) == 0 {
+			m.Ns = []dns.RR{z.negativeSOA()}
+			return m, ""
+		}
+		m.Answer = append(m.Answer, answer...)
+		return m, ""
+	}
+
+	// the chain is too long, so is likely a loop
+	m.Rcode = dns.RcodeServerFailure
+	return m, ""
+}
+
+// delegation returns the name of the zone cut at or above name, if any.
+func (z *Zone) delegation(name string) string {
+	var cut string
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		n := name[off:]
+		if n == z.origin {
+			break
+		}
+		// the topmost cut wins, as anything below it belongs to the child
+		if len(filterRRs(z.records[n], dns.TypeNS)) > 0 {
+			cut = n
+		}
+	}
+
+	return cut
+}
+
+// glue returns the addresses held in the zone for the targets of NS records.
+func (z *Zone) glue(ns []dns.RR) []dns.RR {
+	var glue []dns.RR
+	for _, rr := range ns {
+		if n, ok := rr.(*dns.NS); ok {
+			rrs := z.records[canonicalName(n.Ns)]
+			glue = append(glue, filterRRs(rrs, dns.TypeA)...)
+			glue = append(glue, filterRRs(rrs, dns.TypeAAAA)...)
+		}
+	}
+
+	return glue
+}
+
+// wildcard synthesizes the records for a name which doesn't exist from the
+// wildcard at its closest encloser, as described by RFC 4592, if there is
+// one.
+func (z *Zone) wildcard(qname, name string) ([]dns.RR, bool) {
+	// the closest encloser is the longest existing ancestor of the name
+	labels := dns.Split(name)
+	for i := 1; i <= len(labels); i++ {
+		encloser := "."
+		if i < len(labels) {
+			encloser = name[labels[i]:]
+		}
+		if !z.names[encloser] {
+			continue
+		}
+
+		wildcard := "*." + encloser
+		if encloser == "." {
+			wildcard = "*."
+		}
+		rrs, ok := z.records[wildcard]
+		if !ok {
+			return nil, false
+		}
+
+		synthesized := make([]dns.RR, len(rrs))
+		for i, rr := range rrs {
+			synthesized[i] = dns.Copy(rr)
+			synthesized[i].Header().Name = dns.Fqdn(qname)
+		}
+		return synthesized, true
+	}
+
+	return nil, false
+}
+
+// negativeSOA returns the SOA record for a negative answer, whose TTL is the
+// smaller of its own and its minimum field, per RFC 2308.
+func (z *Zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+
+	return soa
+}
+
+func filterRRs(rrs []dns.RR, qtype uint16) []dns.RR {
+	var filtered []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype {
+			filtered = append(filtered, rr)
+		}
+	}
+
+	return filtered
+}
+
+// zoneFor returns the zone of those given with the longest origin which name
+// falls within, if any.
+func zoneFor(zones map[string]*Zone, name string) *Zone {
+	name = canonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if z, ok := zones[name[off:]]; ok {
+			return z
+		}
+	}
+
+	return zones["."]
+}
@@ -0,0 +1,306 @@
+package reverseoperator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+const testZone = `$ORIGIN example.test.
+$TTL 3600
+@       IN SOA   ns1 hostmaster 1 7200 3600 1209600 300
+@       IN NS    ns1
+ns1     IN A     192.0.2.1
+www     IN A     192.0.2.10
+www     IN AAAA  2001:db8::10
+alias   IN CNAME www
+ext     IN CNAME www.example.com.
+loop1   IN CNAME loop2
+loop2   IN CNAME loop1
+a.b.c   IN TXT   "deep"
+*.wild  IN A     192.0.2.20
+*.wild  IN TXT   "wild"
+sub     IN NS    ns.sub
+ns.sub  IN A     192.0.2.53
+`
+
+func parseTestZone(t *testing.T) *Zone {
+	z, err := ParseZone(strings.NewReader(testZone), "", "test.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	var s []string
+	for _, rr := range rrs {
+		s = append(s, rr.String())
+	}
+	return s
+}
+
+func TestZoneLookup(t *testing.T) {
+	z := parseTestZone(t)
+	if o := z.Origin(); o != "example.test." {
+		t.Fatalf("unexpected origin %v", o)
+	}
+
+	for _, c := range []struct {
+		name          string
+		qtype         uint16
+		rcode         int
+		authoritative bool
+		answer        []string
+		ns            []string
+		extra         []string
+	}{
+		{
+			name: "www.example.test", qtype: dns.TypeA, authoritative: true,
+			answer: []string{"www.example.test.\t3600\tIN\tA\t192.0.2.10"},
+		},
+		{
+			name: "WWW.Example.Test.", qtype: dns.TypeAAAA, authoritative: true,
+			answer: []string{"www.example.test.\t3600\tIN\tAAAA\t2001:db8::10"},
+		},
+		{
+			// NODATA
+			name: "www.example.test", qtype: dns.TypeMX, authoritative: true,
+			ns: []string{"example.test.\t300\tIN\tSOA\tns1.example.test. hostmaster.example.test. 1 7200 3600 1209600 300"},
+		},
+		{
+			name: "nope.example.test", qtype: dns.TypeA, authoritative: true, rcode: dns.RcodeNameError,
+			ns: []string{"example.test.\t300\tIN\tSOA\tns1.example.test. hostmaster.example.test. 1 7200 3600 1209600 300"},
+		},
+		{
+			// an empty non-terminal exists, so is NODATA rather than NXDOMAIN
+			name: "b.c.example.test", qtype: dns.TypeTXT, authoritative: true,
+			ns: []string{"example.test.\t300\tIN\tSOA\tns1.example.test. hostmaster.example.test. 1 7200 3600 1209600 300"},
+		},
+		{
+			name: "a.b.c.example.test", qtype: dns.TypeTXT, authoritative: true,
+			answer: []string{"a.b.c.example.test.\t3600\tIN\tTXT\t\"deep\""},
+		},
+		{
+			name: "host.wild.example.test", qtype: dns.TypeA, authoritative: true,
+			answer: []string{"host.wild.example.test.\t3600\tIN\tA\t192.0.2.20"},
+		},
+		{
+			name: "a.host.wild.example.test", qtype: dns.TypeTXT, authoritative: true,
+			answer: []string{"a.host.wild.example.test.\t3600\tIN\tTXT\t\"wild\""},
+		},
+		{
+			// the wildcard doesn't apply to names which exist
+			name: "wild.example.test", qtype: dns.TypeA, authoritative: true,
+			ns: []string{"example.test.\t300\tIN\tSOA\tns1.example.test. hostmaster.example.test. 1 7200 3600 1209600 300"},
+		},
+		{
+			name: "alias.example.test", qtype: dns.TypeA, authoritative: true,
+			answer: []string{
+				"alias.example.test.\t3600\tIN\tCNAME\twww.example.test.",
+				"www.example.test.\t3600\tIN\tA\t192.0.2.10",
+			},
+		},
+		{
+			name: "alias.example.test", qtype: dns.TypeCNAME, authoritative: true,
+			answer: []string{"alias.example.test.\t3600\tIN\tCNAME\twww.example.test."},
+		},
+		{
+			name: "loop1.example.test", qtype: dns.TypeA, authoritative: true, rcode: dns.RcodeServerFailure,
+			answer: []string{
+				"loop1.example.test.\t3600\tIN\tCNAME\tloop2.example.test.",
+				"loop2.example.test.\t3600\tIN\tCNAME\tloop1.example.test.",
+				"loop1.example.test.\t3600\tIN\tCNAME\tloop2.example.test.",
+				"loop2.example.test.\t3600\tIN\tCNAME\tloop1.example.test.",
+				"loop1.example.test.\t3600\tIN\tCNAME\tloop2.example.test.",
+				"loop2.example.test.\t3600\tIN\tCNAME\tloop1.example.test.",
+				"loop1.example.test.\t3600\tIN\tCNAME\tloop2.example.test.",
+				"loop2.example.test.\t3600\tIN\tCNAME\tloop1.example.test.",
+			},
+		},
+		{
+			// below a zone cut, the answer is a referral
+			name: "host.sub.example.test", qtype: dns.TypeA,
+			ns:    []string{"sub.example.test.\t3600\tIN\tNS\tns.sub.example.test."},
+			extra: []string{"ns.sub.example.test.\t3600\tIN\tA\t192.0.2.53"},
+		},
+	} {
+		m, chase := z.lookup(c.name, c.qtype)
+		if chase != "" {
+			t.Errorf("%v: unexpected chase of %v", c.name, chase)
+		}
+		if m.Rcode != c.rcode {
+			t.Errorf("%v: expected rcode %v, got %v", c.name, c.rcode, m.Rcode)
+		}
+		if m.Authoritative != c.authoritative {
+			t.Errorf("%v: expected authoritative %v", c.name, c.authoritative)
+		}
+		for _, s := range []struct {
+			section  string
+			expected []string
+			got      []dns.RR
+		}{
+			{"answer", c.answer, m.Answer},
+			{"authority", c.ns, m.Ns},
+			{"additional", c.extra, m.Extra},
+		} {
+			got := rrStrings(s.got)
+			if strings.Join(got, "\n") != strings.Join(s.expected, "\n") {
+				t.Errorf("%v[%v]: expected %v %v, got %v", c.name, c.qtype, s.section, s.expected, got)
+			}
+		}
+	}
+}
+
+func TestZoneLookupChase(t *testing.T) {
+	z := parseTestZone(t)
+
+	m, chase := z.lookup("ext.example.test", dns.TypeA)
+	if chase != "www.example.com." {
+		t.Errorf("expected to chase www.example.com., got %v", chase)
+	}
+	if l := len(m.Answer); l != 1 {
+		t.Errorf("expected the CNAME alone, got %v records", l)
+	}
+}
+
+func TestParseZoneErrors(t *testing.T) {
+	for name, zone := range map[string]string{
+		"no soa":      "$ORIGIN example.test.\nwww IN A 192.0.2.1\n",
+		"two soas":    "$ORIGIN example.test.\n@ 60 IN SOA ns1 h 1 1 1 1 1\n@ 60 IN SOA ns2 h 1 1 1 1 1\n",
+		"out of zone": "$ORIGIN example.test.\n@ 60 IN SOA ns1 h 1 1 1 1 1\nwww.example.com. 60 IN A 192.0.2.1\n",
+		"syntax":      "$ORIGIN example.test.\n@ 60 IN SOA ns1 h 1 1 1 1 1\nwww 60 IN A not-an-ip\n",
+	} {
+		if _, err := ParseZone(strings.NewReader(zone), "", name); err == nil {
+			t.Errorf("%v: expected an error", name)
+		}
+	}
+}
+
+func writeZoneFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZoneResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "example.test.zone")
+	writeZoneFile(t, path, testZone)
+
+	var asked []string
+	fallback := &funcResolver{resolve: func(q Question) (*Response, error) {
+		asked = append(asked, q.Name)
+		return &Response{DNSResponse: secop.DNSResponse{
+			Question: []secop.DNSQuestion{q.DNSQuestion},
+			Answer:   []secop.DNSRR{{Name: q.Name, Type: dns.TypeA, TTL: 60, Data: "198.51.100.1"}},
+		}}, nil
+	}}
+
+	z, err := NewZoneResolver(fallback, []ZoneFile{{Path: path}}, &ZoneOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+
+	resp, err := z.Resolve(context.Background(), question("www.example.test", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Authoritative || len(resp.Answer) != 1 || resp.Answer[0].Data != "192.0.2.10" {
+		t.Errorf("unexpected local answer %+v", resp)
+	}
+	if !resp.RecursionAvailable {
+		t.Error("expected RA to be set")
+	}
+	if len(asked) != 0 {
+		t.Errorf("expected a local answer without the fallback, asked %v", asked)
+	}
+
+	// names outside of the zone go to the fallback
+	if _, err := z.Resolve(context.Background(), question("example.com", dns.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	if len(asked) != 1 || asked[0] != "example.com" {
+		t.Errorf("expected the fallback to be asked for example.com, asked %v", asked)
+	}
+
+	// CNAMEs out of the zone are followed
+	resp, err = z.Resolve(context.Background(), question("ext.example.test", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Authoritative {
+		t.Error("expected a partly upstream answer not to be authoritative")
+	}
+	if l := len(resp.Answer); l != 2 {
+		t.Fatalf("expected the CNAME and its target, got %v", resp.Answer)
+	}
+	if resp.Answer[0].Type != dns.TypeCNAME || resp.Answer[1].Data != "198.51.100.1" {
+		t.Errorf("unexpected answer %+v", resp.Answer)
+	}
+
+	// authoritative answers set AA on the wire
+	m, err := fromDNStoDNSMsg(questionToMsg(question("www.example.test", dns.TypeA)), &Response{Authoritative: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Authoritative {
+		t.Error("expected AA to be set")
+	}
+}
+
+func TestZoneResolverReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "example.test.zone")
+	writeZoneFile(t, path, testZone)
+
+	z, err := NewZoneResolver(answerResolver(60), []ZoneFile{{Path: path}}, &ZoneOptions{ReloadInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+
+	lookup := func() string {
+		resp, err := z.Resolve(context.Background(), question("new.example.test", dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Answer) == 0 {
+			return ""
+		}
+		return resp.Answer[0].Data
+	}
+
+	if a := lookup(); a != "" {
+		t.Fatalf("expected no answer before reloading, got %v", a)
+	}
+
+	writeZoneFile(t, path, testZone+"new IN A 192.0.2.99\n")
+	z.reload(z.files[0])
+	if a := lookup(); a != "192.0.2.99" {
+		t.Errorf("expected the new record after reloading, got %v", a)
+	}
+
+	// a broken file leaves the zone as it was
+	writeZoneFile(t, path, testZone+"new IN A 192.0.2.99\nbroken IN A nope\n")
+	z.reload(z.files[0])
+	if a := lookup(); a != "192.0.2.99" {
+		t.Errorf("expected the previous zone to remain, got %v", a)
+	}
+}
@@ -0,0 +1,200 @@
+package reverseoperator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+
+	secop "github.com/fardog/secureoperator"
+)
+
+// DefaultZoneReloadInterval is how often zone files are checked for changes
+// when no other interval is configured.
+const DefaultZoneReloadInterval = 5 * time.Second
+
+// ZoneFile is a master file to load a zone from.
+type ZoneFile struct {
+	// Path is the location of the file
+	Path string
+	// Origin is the origin of relative names in the file which precede any
+	// $ORIGIN directive; if empty, the root is used.
+	Origin string
+}
+
+// ZoneOptions is a configuration object for optional ZoneResolver
+// configuration
+type ZoneOptions struct {
+	// ReloadInterval is how often zone files are checked for changes, and
+	// reloaded if changed; if zero, DefaultZoneReloadInterval is used, and if
+	// negative, zones are never reloaded.
+	ReloadInterval time.Duration
+}
+
+// NewZoneResolver creates a ZoneResolver, loading each of the zone files.
+func NewZoneResolver(fallback Resolver, files []ZoneFile, opts *ZoneOptions) (*ZoneResolver, error) {
+	if opts == nil {
+		opts = &ZoneOptions{}
+	}
+
+	z := &ZoneResolver{
+		fallback: fallback,
+		zones:    make(map[string]*Zone),
+	}
+	for _, f := range files {
+		zf := &zoneFile{ZoneFile: f}
+		if err := zf.load(); err != nil {
+			return nil, err
+		}
+		if _, ok := z.zones[zf.zone.origin]; ok {
+			return nil, fmt.Errorf("%v: zone %v is already loaded", f.Path, zf.zone.origin)
+		}
+		z.files = append(z.files, zf)
+		z.zones[zf.zone.origin] = zf.zone
+	}
+
+	interval := opts.ReloadInterval
+	if interval == 0 {
+		interval = DefaultZoneReloadInterval
+	}
+	z.watcher = newWatcher(interval, func() {
+		for _, f := range z.files {
+			z.reload(f)
+		}
+	})
+
+	return z, nil
+}
+
+// ZoneResolver answers questions within its zones authoritatively, and
+// passes all others to another Resolver. Zone files are reloaded when they
+// change on disk.
+type ZoneResolver struct {
+	fallback Resolver
+	files    []*zoneFile
+
+	mutex sync.RWMutex
+	zones map[string]*Zone
+
+	watcher *watcher
+}
+
+type zoneFile struct {
+	ZoneFile
+	stamp fileStamp
+	zone  *Zone
+}
+
+// Resolve answers a question from the zone it falls within, or otherwise
+// from the fallback; it implements Resolver. A CNAME in a zone which points
+// outside of it is followed, so that clients receive a complete answer.
+func (z *ZoneResolver) Resolve(ctx context.Context, q Question) (*Response, error) {
+	var chain []secop.DNSRR
+	for i := 0; i < maxCNAMEChain; i++ {
+		z.mutex.RLock()
+		zone := zoneFor(z.zones, q.Name)
+		z.mutex.RUnlock()
+
+		if zone == nil {
+			resp, err := z.fallback.Resolve(ctx, q)
+			if err != nil || chain == nil {
+				return resp, err
+			}
+
+			// responses may be shared, so the chain is prepended to a copy
+			c := *resp
+			c.Answer = append(append([]secop.DNSRR(nil), chain...), resp.Answer...)
+			c.Authoritative = false
+			return &c, nil
+		}
+
+		m, chase := zone.lookup(q.Name, q.Type)
+		m.Question = []dns.Question{{Name: dns.Fqdn(q.Name), Qtype: q.Type, Qclass: dns.ClassINET}}
+		m.RecursionDesired = true
+		m.RecursionAvailable = true
+		resp := msgToResponse(q, m)
+		if chain != nil {
+			resp.Answer = append(chain, resp.Answer...)
+			resp.Authoritative = false
+		}
+		if chase == "" {
+			return resp, nil
+		}
+
+		chain = resp.Answer
+		q.Name = chase
+	}
+
+	return &Response{DNSResponse: secop.DNSResponse{
+		Question:           []secop.DNSQuestion{q.DNSQuestion},
+		ResponseCode:       dns.RcodeServerFailure,
+		RecursionDesired:   true,
+		RecursionAvailable: true,
+	}}, nil
+}
+
+// Close stops watching zone files for changes.
+func (z *ZoneResolver) Close() error {
+	z.watcher.close()
+
+	return nil
+}
+
+// reload reloads a zone file if it has changed; a file which fails to load
+// leaves the zone as it was.
+func (z *ZoneResolver) reload(f *zoneFile) {
+	changed, err := f.stamp.changed(f.Path)
+	if err != nil {
+		log.Errorf("error checking zone file %v: %v", f.Path, err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	previous := f.zone
+	if err := f.load(); err != nil {
+		log.Errorf("error reloading zone file, keeping previous zone: %v", err)
+		return
+	}
+
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	delete(z.zones, previous.origin)
+	z.zones[f.zone.origin] = f.zone
+	log.Infof("reloaded zone %v from %v", f.zone.origin, f.Path)
+}
+
+// load loads the zone from the file, recording the file's modification time
+// and size to tell when it has changed.
+func (f *zoneFile) load() error {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	origin := f.Origin
+	if origin == "" {
+		origin = "."
+	}
+	zone, err := ParseZone(file, origin, f.Path)
+	if err != nil {
+		return err
+	}
+
+	// the recorded time and size are those from before parsing, so a change
+	// made during parsing is picked up by the next check
+	f.zone, f.stamp = zone, newFileStamp(info)
+	return nil
+}